@@ -11,12 +11,104 @@ import (
 const (
 	LOCAL_MODE = 0
 	NET_MODE   = 1
+	// 备份到数据块仓库，dstpath 为仓库目录
+	REPO_MODE = 2
+	// 同步到 S3 兼容的对象存储，使用 [s3] 的桶和前缀
+	S3_MODE = 3
+	// 通过 ssh 的 sftp 子系统同步到远程目录，使用 [ssh] 的连接设置
+	SSH_MODE = 4
+	// 同步到 WebDAV 目录，使用 [webdav] 的地址和账号
+	WEBDAV_MODE = 5
 )
 
 type Config struct {
-	Sync   SyncConfig
-	Server ServerConfig
-	Client ClientConfig
+	Sync     SyncConfig
+	Server   ServerConfig
+	Client   ClientConfig
+	Limit    LimitConfig
+	Log      LogConfig
+	Backup   BackupConfig
+	Snapshot SnapshotConfig
+	Repo     RepoConfig
+	S3       S3Config
+	Ssh      SshConfig
+	Webdav   WebdavConfig
+}
+
+// WebDAV 目标设置
+type WebdavConfig struct {
+	// 目标目录地址，如 https://cloud.example.com/remote.php/dav/files/user/backup
+	Url      string
+	User     string
+	Password string
+}
+
+// SSH/SFTP 目标设置，认证使用密钥文件和 ssh-agent
+type SshConfig struct {
+	Host string
+	Port int
+	User string
+	// 私钥文件，为空时使用 ssh 的默认密钥或 ssh-agent
+	Identityfile string
+	// ssh 选项，支持 StrictHostKeyChecking=yes|no 和 UserKnownHostsFile=<路径>
+	Options []string
+}
+
+// S3 兼容对象存储设置
+type S3Config struct {
+	// 服务地址，如 http://127.0.0.1:9000，为空时使用 AWS 的区域地址
+	Endpoint string
+	Region   string
+	Bucket   string
+	// 对象名前缀，相当于目标目录
+	Prefix    string
+	Accesskey string
+	Secretkey string
+	// 使用 endpoint/bucket/key 形式的地址，MinIO 等通常需要开启
+	Pathstyle bool
+	// 分片大小(MB)，不小于该大小的文件使用分片上传，0 为默认 16MB
+	Partsize int
+}
+
+// 数据块仓库设置
+type RepoConfig struct {
+	// 仓库口令，配置后新建的仓库加密保存，为空时不加密
+	Password string
+	// 从文件读取口令，优先于 Password
+	Passwordfile string
+}
+
+// 快照模式：每次同步在目标目录下创建带时间的新目录，未变化的文件从上一个快照硬链接
+type SnapshotConfig struct {
+	Enabled bool
+	// 保留的快照数量，0 不限
+	Keep int
+	// 快照保留天数，0 不限
+	Days int
+}
+
+// 目标文件被替换前的旧版本保存设置
+type BackupConfig struct {
+	// 旧版本保存目录，为空时不备份，不要放在目标目录内
+	Dir string
+	// 每个文件保留的版本数，0 不限
+	Keep int
+	// 版本保留天数，0 不限
+	Days int
+}
+
+type LogConfig struct {
+	// debug, info, warn, error
+	Level string
+	// text 或 json
+	Format string
+	Path   string
+	// 单个日志文件大小(MB)，超过后轮转
+	Maxsize int
+	// 保留的历史日志数量，0 表示不清理
+	Maxfiles int
+	Compress bool
+	Syslog   bool
 }
 
 type SyncConfig struct {
@@ -26,37 +118,143 @@ type SyncConfig struct {
 	Dstcachefile string
 	Excludefrom  string
 	Syncmode     int
+	// 每次同步的 JSON 报告输出目录，为空时不输出
+	Reportdir string
+	// 单个文件失败后的重试次数，0 为默认 3 次，-1 不重试
+	Retries int
+	// 首次重试前的等待时间(毫秒)，之后每次翻倍，不超过 Retrymaxbackoff
+	Retrybackoff    int
+	Retrymaxbackoff int
+	// 重试后仍失败的文件清单，为空时不输出
+	Failurelist string
 }
 
 type ServerConfig struct {
-	Port        int
-	Token       string
-	Compression bool
-	Workers     int
-	Blocksize   int
+	Port          int
+	Token         string
+	Compression   bool
+	Compresslevel int
+	Workers       int
+	Blocksize     int
+	// Prometheus 指标监听地址，为空时关闭
+	Metricsaddr string
+	// 额外的账号名与 token，指标按账号统计
+	Accounts map[string]string
+	// 管理 API 监听地址及其独立的 token，为空时关闭
+	Adminaddr  string
+	Admintoken string
+	// 审计日志路径，为空时不记录
+	Auditlog string
+	// 客户端加密仓库(远程存储操作)可以访问的目录，为空时拒绝这类操作
+	Reporoot string
 }
 
 type ClientConfig struct {
-	Serverip   string
-	Serverport int
-	Token      string
-	Threads    int
+	Serverip      string
+	Serverport    int
+	Token         string
+	Threads       int
+	Conns         int
+	Compression   bool
+	Compresslevel int
+	Compressskip  []string
+	// 小于该大小(KB)的文件打包发送，-1 关闭打包
+	Batchthreshold int
+	// 单个批次的总大小(KB)
+	Batchsize int
+}
+
+// 限速配置，单位 KB/s，0 表示不限速
+type LimitConfig struct {
+	Global   int
+	Perconn  int
+	Schedule []LimitSchedule
+}
+
+// 时间段限速，格式 HH:MM，结束时间早于开始时间表示跨零点
+type LimitSchedule struct {
+	Start   string
+	End     string
+	Global  int
+	Perconn int
 }
 
 var InstanceConfig Config
 
-func init() {
+// Redacted 返回口令和 token 替换为占位符的副本，用于日志和管理接口
+func (c Config) Redacted() Config {
+	const redacted = "******"
+	redact := func(s string) string {
+		if s == "" {
+			return ""
+		}
+		return redacted
+	}
+	c.Server.Token = redact(c.Server.Token)
+	c.Server.Admintoken = redact(c.Server.Admintoken)
+	c.Client.Token = redact(c.Client.Token)
+	accounts := make(map[string]string, len(c.Server.Accounts))
+	for name, token := range c.Server.Accounts {
+		accounts[name] = redact(token)
+	}
+	c.Server.Accounts = accounts
+	c.Repo.Password = redact(c.Repo.Password)
+	c.S3.Accesskey = redact(c.S3.Accesskey)
+	c.S3.Secretkey = redact(c.S3.Secretkey)
+	c.Webdav.Password = redact(c.Webdav.Password)
+	return c
+}
+
+func readConfig() (*Config, error) {
 	v := viper.New()
 	v.SetConfigName("config")
 	v.AddConfigPath(".")
 	v.SetConfigType("toml")
 	if err := v.ReadInConfig(); err != nil {
-		logger.Error("read config failed.err:%s", err)
+		return nil, err
 	}
-	if err := v.Unmarshal(&InstanceConfig); err != nil {
-		logger.Error("make config obj failed.err:%s", err)
+	conf := &Config{}
+	if err := v.Unmarshal(conf); err != nil {
+		return nil, err
 	}
+	return conf, nil
+}
+
+// Reload 重新读取配置文件并返回，不修改 InstanceConfig，由调用方决定哪些设置在运行时生效
+func Reload() (*Config, error) {
+	conf, err := readConfig()
+	if err != nil {
+		logger.Error("reload config failed.err:%s", err)
+		return nil, err
+	}
+	logger.Info("config reloaded. limit: %v", conf.Limit)
+	return conf, nil
+}
+
+// Load 读取当前目录下的 config.toml 并应用日志配置，由命令行程序在启动时调用。
+// 读取失败时使用零值配置并返回错误
+func Load() error {
+	conf, err := readConfig()
+	if err != nil {
+		logger.Error("read config failed.err:%s", err)
+	} else {
+		InstanceConfig = *conf
+	}
+	logger.Configure(logger.Options{
+		Level:    InstanceConfig.Log.Level,
+		Format:   InstanceConfig.Log.Format,
+		Path:     InstanceConfig.Log.Path,
+		MaxSize:  int64(InstanceConfig.Log.Maxsize) * 1024 * 1024,
+		MaxFiles: InstanceConfig.Log.Maxfiles,
+		Compress: InstanceConfig.Log.Compress,
+		Syslog:   InstanceConfig.Log.Syslog,
+	})
 	InstanceConfig.Sync.Srcpath = filepath.Clean(InstanceConfig.Sync.Srcpath)
 	InstanceConfig.Server.Blocksize *= (1024 * 1024)
-	logger.Info("config read:%v", InstanceConfig)
+	if InstanceConfig.Client.Batchthreshold > 0 {
+		InstanceConfig.Client.Batchthreshold *= 1024
+	}
+	InstanceConfig.Client.Batchsize *= 1024
+	logger.Info("config read:%v", InstanceConfig.Redacted())
+	return err
 }
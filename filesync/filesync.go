@@ -0,0 +1,295 @@
+// Package filesync 供其他 Go 程序嵌入使用的同步接口：Scan 扫描两端，Plan 得到需要同步的文件，
+// Apply 执行同步。不读取 config.toml，也不创建日志文件，所有设置通过 Options 传入
+package filesync
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	gosync "sync"
+	"time"
+
+	"stacktrace.top/filesync/config"
+	"stacktrace.top/filesync/sync"
+)
+
+// FileInfo 是一个文件或目录的信息
+type FileInfo = sync.SyncFileInfo
+
+// FS 是读写文件使用的存储，可以使用 Local、NewMemFS 或自己的实现
+type FS = sync.FS
+
+// Local 是本地文件系统
+var Local FS = sync.Local
+
+// NewMemFS 返回内存中的文件系统
+func NewMemFS() FS {
+	return sync.NewMemFS()
+}
+
+type Options struct {
+	// 源目录和目标目录，分别是 SrcFS 和 DstFS 中的路径
+	Src string
+	Dst string
+	// 为 nil 时使用本地文件系统
+	SrcFS FS
+	DstFS FS
+	// 排除的文件名、相对路径或完整路径
+	Exclude []string
+	// 并行同步的文件数，0 为 CPU 数
+	Workers int
+	// 单个文件失败后的重试次数，0 为默认 3 次，负数不重试
+	Retries int
+	// 首次重试前的等待时间，之后每次翻倍，不超过 RetryMaxBackoff。0 使用默认值
+	RetryBackoff    time.Duration
+	RetryMaxBackoff time.Duration
+	// 替换目标文件前把旧版本保存到 DstFS 中的 BackupDir，为空时不备份。
+	// BackupKeep 为每个文件保留的版本数，BackupDays 为保留天数，0 不限
+	BackupDir  string
+	BackupKeep int
+	BackupDays int
+	// 同步过程中的事件回调，会在多个协程中并发调用
+	OnEvent func(Event)
+}
+
+type EventType int
+
+const (
+	// 开始同步一个条目
+	EventStart EventType = iota
+	// 同步失败，等待后重试
+	EventRetry
+	// 同步成功
+	EventDone
+	// 重试后仍失败，或被取消
+	EventFailed
+)
+
+func (t EventType) String() string {
+	switch t {
+	case EventStart:
+		return "start"
+	case EventRetry:
+		return "retry"
+	case EventDone:
+		return "done"
+	case EventFailed:
+		return "failed"
+	}
+	return "unknown"
+}
+
+type Event struct {
+	Type EventType
+	// 相对源目录的路径
+	Path string
+	Info *FileInfo
+	// 第几次尝试，从 1 开始
+	Attempt int
+	// EventRetry 和 EventFailed 时的错误
+	Err error
+}
+
+// ScanResult 是两端的文件信息，键为相对路径
+type ScanResult struct {
+	Src map[string]*FileInfo
+	Dst map[string]*FileInfo
+}
+
+// Plan 是需要从源端同步到目标端的条目
+type Plan struct {
+	Files map[string]*FileInfo
+	// 需要传输的文件字节数
+	Bytes int64
+}
+
+// Result 是 Apply 的结果
+type Result struct {
+	// 同步成功的条目数和文件字节数
+	Done  int
+	Bytes int64
+	// 失败的条目及其最后一次的错误
+	Failed map[string]error
+}
+
+// Syncer 在两个目录之间同步。同一个 Syncer 的方法不能并发调用，不同的 Syncer 互不影响
+type Syncer struct {
+	opts    Options
+	scanner *sync.Scanner
+	policy  sync.RetryPolicy
+	scanned bool
+}
+
+// New 检查选项并创建 Syncer，不访问文件系统
+func New(opts Options) (*Syncer, error) {
+	if opts.Src == "" || opts.Dst == "" {
+		return nil, errors.New("filesync: src and dst are required")
+	}
+	if opts.SrcFS == nil {
+		opts.SrcFS = Local
+	}
+	if opts.DstFS == nil {
+		opts.DstFS = Local
+	}
+	if opts.BackupDir != "" {
+		opts.DstFS = sync.WithBackup(opts.DstFS, config.BackupConfig{
+			Dir:  filepath.Clean(opts.BackupDir),
+			Keep: opts.BackupKeep,
+			Days: opts.BackupDays,
+		})
+	}
+	if opts.Workers <= 0 {
+		opts.Workers = runtime.NumCPU()
+	}
+	conf := config.SyncConfig{
+		Srcpath:         filepath.Clean(opts.Src),
+		Dstpath:         filepath.Clean(opts.Dst),
+		Retries:         opts.Retries,
+		Retrybackoff:    int(opts.RetryBackoff / time.Millisecond),
+		Retrymaxbackoff: int(opts.RetryMaxBackoff / time.Millisecond),
+	}
+	scanner, err := sync.NewScanner(conf)
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range opts.Exclude {
+		scanner.Exclude(path)
+	}
+	return &Syncer{opts: opts, scanner: scanner, policy: scanner.RetryPolicy()}, nil
+}
+
+// ctxFS 在遍历中检查 ctx，取消后停止遍历，由调用方检查 ctx 的错误
+type ctxFS struct {
+	FS
+	ctx context.Context
+}
+
+func (f ctxFS) Walk(root string, fn filepath.WalkFunc) error {
+	return f.FS.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if f.ctx.Err() != nil {
+			return filepath.SkipAll
+		}
+		// 目录不存在时视为空目录
+		if err != nil && path == root && os.IsNotExist(err) {
+			return nil
+		}
+		return fn(path, info, err)
+	})
+}
+
+// Scan 扫描源目录和目标目录，不存在的目录视为空目录
+func (s *Syncer) Scan(ctx context.Context) (*ScanResult, error) {
+	conf := s.scanner.Config
+	src := s.scanner.ScanDir(ctxFS{s.opts.SrcFS, ctx}, conf.Srcpath, false)
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	dst := s.scanner.ScanDir(ctxFS{s.opts.DstFS, ctx}, conf.Dstpath, false)
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	s.scanner.Src = src
+	s.scanner.SetDst(dst)
+	s.scanned = true
+	return &ScanResult{Src: src, Dst: dst}, nil
+}
+
+// Plan 返回源端中新增或修改的条目，尚未扫描或已执行过 Apply 时先重新扫描
+func (s *Syncer) Plan(ctx context.Context) (*Plan, error) {
+	if !s.scanned {
+		if _, err := s.Scan(ctx); err != nil {
+			return nil, err
+		}
+	}
+	plan := &Plan{Files: s.scanner.Compare()}
+	for _, info := range plan.Files {
+		if !info.IsDir {
+			plan.Bytes += info.Size
+		}
+	}
+	return plan, nil
+}
+
+func (s *Syncer) emit(event Event) {
+	if s.opts.OnEvent != nil {
+		s.opts.OnEvent(event)
+	}
+}
+
+// Apply 按计划同步，失败的条目按重试设置重试。ctx 取消后不再开始新的条目，
+// 返回已完成部分的结果和 ctx 的错误
+func (s *Syncer) Apply(ctx context.Context, plan *Plan) (*Result, error) {
+	s.scanned = false
+	result := &Result{Failed: make(map[string]error)}
+	var mu gosync.Mutex
+	// 按路径排序，目录在其中的文件之前
+	paths := make([]string, 0, len(plan.Files))
+	for relPath := range plan.Files {
+		paths = append(paths, relPath)
+	}
+	sort.Strings(paths)
+	jobs := make(chan string)
+	var wg gosync.WaitGroup
+	for i := 0; i < s.opts.Workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for relPath := range jobs {
+				info := plan.Files[relPath]
+				err := s.applyOne(ctx, relPath, info)
+				mu.Lock()
+				if err != nil {
+					result.Failed[relPath] = err
+				} else {
+					result.Done++
+					if !info.IsDir {
+						result.Bytes += info.Size
+					}
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+feed:
+	for _, relPath := range paths {
+		select {
+		case jobs <- relPath:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(jobs)
+	wg.Wait()
+	return result, ctx.Err()
+}
+
+// applyOne 同步一个条目，失败时按指数退避重试
+func (s *Syncer) applyOne(ctx context.Context, relPath string, info *FileInfo) error {
+	conf := s.scanner.Config
+	srcPath := filepath.Join(conf.Srcpath, relPath)
+	dstPath := filepath.Join(conf.Dstpath, relPath)
+	for attempt := 1; ; attempt++ {
+		s.emit(Event{Type: EventStart, Path: relPath, Info: info, Attempt: attempt})
+		err := sync.ApplyFile(s.opts.SrcFS, srcPath, s.opts.DstFS, dstPath, info)
+		if err == nil {
+			s.emit(Event{Type: EventDone, Path: relPath, Info: info, Attempt: attempt})
+			return nil
+		}
+		if attempt > s.policy.Retries {
+			s.emit(Event{Type: EventFailed, Path: relPath, Info: info, Attempt: attempt, Err: err})
+			return err
+		}
+		s.emit(Event{Type: EventRetry, Path: relPath, Info: info, Attempt: attempt, Err: err})
+		timer := time.NewTimer(s.policy.Delay(attempt))
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			s.emit(Event{Type: EventFailed, Path: relPath, Info: info, Attempt: attempt, Err: ctx.Err()})
+			return ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,267 @@
+package filesync
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	gosync "sync"
+	"testing"
+	"time"
+
+	"stacktrace.top/filesync/sync"
+)
+
+func writeFile(t *testing.T, fsys FS, name string, data string) {
+	t.Helper()
+	if err := fsys.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		t.Fatal(err)
+	}
+	file, err := fsys.Create(name, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Write([]byte(data))
+	if err := file.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readFile(t *testing.T, fsys FS, name string) string {
+	t.Helper()
+	file, err := fsys.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	data, err := io.ReadAll(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+// failFS 写入文件名包含 match 的文件时失败，times 为负数时一直失败
+type failFS struct {
+	FS
+	match string
+	mu    gosync.Mutex
+	times int
+}
+
+func (f *failFS) Create(name string, perm os.FileMode) (sync.File, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if strings.Contains(name, f.match) && f.times != 0 {
+		f.times--
+		return nil, errors.New("injected failure")
+	}
+	return f.FS.Create(name, perm)
+}
+
+func TestNew(t *testing.T) {
+	if _, err := New(Options{Src: "/src"}); err == nil {
+		t.Fatal("missing dst should fail")
+	}
+	s, err := New(Options{Src: "/src/", Dst: "/dst"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.opts.SrcFS != Local || s.opts.DstFS != Local || s.opts.Workers <= 0 {
+		t.Fatalf("defaults: %+v", s.opts)
+	}
+	if s.scanner.Config.Srcpath != "/src" {
+		t.Fatalf("src path %q", s.scanner.Config.Srcpath)
+	}
+}
+
+func TestScanPlanApply(t *testing.T) {
+	src, dst := NewMemFS(), NewMemFS()
+	writeFile(t, src, "/src/a", "aa")
+	writeFile(t, src, "/src/d/b", "bbb")
+	writeFile(t, src, "/src/skip/c", "c")
+	writeFile(t, dst, "/dst/old", "o")
+	s, err := New(Options{Src: "/src", Dst: "/dst", SrcFS: src, DstFS: dst, Exclude: []string{"skip"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	scan, err := s.Scan(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(scan.Src) != 3 || len(scan.Dst) != 1 || scan.Dst["old"] == nil {
+		t.Fatalf("scan: %v %v", scan.Src, scan.Dst)
+	}
+	plan, err := s.Plan(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plan.Files) != 3 || plan.Bytes != 5 {
+		t.Fatalf("plan: %v %d", plan.Files, plan.Bytes)
+	}
+	result, err := s.Apply(ctx, plan)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Done != 3 || result.Bytes != 5 || len(result.Failed) != 0 {
+		t.Fatalf("result: %+v", result)
+	}
+	if got := readFile(t, dst, "/dst/d/b"); got != "bbb" {
+		t.Fatalf("synced %q", got)
+	}
+	info, _ := dst.Stat("/dst/a")
+	if !info.ModTime().Equal(plan.Files["a"].ModTime) {
+		t.Fatalf("mtime %v, want %v", info.ModTime(), plan.Files["a"].ModTime)
+	}
+	// Apply 后再次 Plan 会重新扫描，没有需要同步的条目
+	plan, err = s.Plan(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plan.Files) != 0 {
+		t.Fatalf("plan after apply: %v", plan.Files)
+	}
+}
+
+func TestScanMissingDirs(t *testing.T) {
+	s, err := New(Options{Src: "/src", Dst: "/dst", SrcFS: NewMemFS(), DstFS: NewMemFS()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	scan, err := s.Scan(context.Background())
+	if err != nil || len(scan.Src) != 0 || len(scan.Dst) != 0 {
+		t.Fatalf("scan: %v %v", scan, err)
+	}
+}
+
+func TestApplyEvents(t *testing.T) {
+	src := NewMemFS()
+	writeFile(t, src, "/src/ok", "1")
+	writeFile(t, src, "/src/flaky", "2")
+	writeFile(t, src, "/src/bad", "3")
+	dst := NewMemFS()
+	flaky := &failFS{FS: dst, match: "flaky", times: 1}
+	bad := &failFS{FS: flaky, match: "bad", times: -1}
+	var mu gosync.Mutex
+	events := make(map[string][]EventType)
+	s, err := New(Options{
+		Src: "/src", Dst: "/dst", SrcFS: src, DstFS: bad,
+		Retries: 2, RetryBackoff: time.Millisecond, RetryMaxBackoff: time.Millisecond,
+		OnEvent: func(e Event) {
+			mu.Lock()
+			events[e.Path] = append(events[e.Path], e.Type)
+			mu.Unlock()
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	plan, err := s.Plan(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := s.Apply(context.Background(), plan)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Done != 2 || len(result.Failed) != 1 || result.Failed["bad"] == nil {
+		t.Fatalf("result: %+v", result)
+	}
+	want := map[string]string{
+		"ok":    "start done",
+		"flaky": "start retry start done",
+		"bad":   "start retry start retry start failed",
+	}
+	for path, seq := range want {
+		var got []string
+		for _, e := range events[path] {
+			got = append(got, e.String())
+		}
+		if strings.Join(got, " ") != seq {
+			t.Fatalf("%v events: %v, want %v", path, got, seq)
+		}
+	}
+}
+
+func TestCancel(t *testing.T) {
+	src := NewMemFS()
+	writeFile(t, src, "/src/f", "1")
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	s, err := New(Options{Src: "/src", Dst: "/dst", SrcFS: src, DstFS: NewMemFS()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Scan(ctx); !errors.Is(err, context.Canceled) {
+		t.Fatalf("scan after cancel: %v", err)
+	}
+
+	// 重试等待中取消，条目以 ctx 的错误结束
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	var failedErr error
+	s, err = New(Options{
+		Src: "/src", Dst: "/dst", SrcFS: src,
+		DstFS:        &failFS{FS: NewMemFS(), match: "f", times: -1},
+		RetryBackoff: time.Hour, RetryMaxBackoff: time.Hour,
+		OnEvent: func(e Event) {
+			switch e.Type {
+			case EventRetry:
+				cancel()
+			case EventFailed:
+				failedErr = e.Err
+			}
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	plan, err := s.Plan(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	var result *Result
+	go func() {
+		result, err = s.Apply(ctx, plan)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("apply did not stop after cancel")
+	}
+	if !errors.Is(err, context.Canceled) || !errors.Is(result.Failed["f"], context.Canceled) || !errors.Is(failedErr, context.Canceled) {
+		t.Fatalf("apply after cancel: %v %+v %v", err, result, failedErr)
+	}
+}
+
+func TestApplyBackup(t *testing.T) {
+	src, dst := NewMemFS(), NewMemFS()
+	writeFile(t, dst, "/dst/f", "old")
+	writeFile(t, src, "/src/f", "new")
+	s, err := New(Options{Src: "/src", Dst: "/dst", SrcFS: src, DstFS: dst, BackupDir: "/backup", BackupKeep: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	plan, err := s.Plan(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Apply(context.Background(), plan); err != nil {
+		t.Fatal(err)
+	}
+	if got := readFile(t, dst, "/dst/f"); got != "new" {
+		t.Fatalf("synced %q", got)
+	}
+	versions, err := sync.ReadDirFS(dst, "/backup/dst")
+	if err != nil || len(versions) != 1 {
+		t.Fatalf("versions: %v %v", versions, err)
+	}
+	if got := readFile(t, dst, filepath.Join("/backup/dst", versions[0].Name())); got != "old" {
+		t.Fatalf("backup %q", got)
+	}
+}
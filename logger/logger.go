@@ -1,110 +1,351 @@
-package logger
-
-import (
-	"fmt"
-	"io"
-	"log"
-	"os"
-	"path"
-	"runtime"
-	"time"
-)
-
-type LogMsg struct {
-	Prefix string
-	Msg    string
-	Args   []any
-}
-
-var logFile *os.File
-var logChan chan *LogMsg
-
-const logFileName = "logs/filesync.log"
-
-func createLogDir() {
-	const dir = "logs"
-	if _, err := os.Stat(dir); os.IsNotExist(err) {
-		// 创建目录
-		err := os.Mkdir(dir, 0755) // 0755表示具有读写执行权限的目录
-		if err != nil {
-			log.Fatalf("Failed to create directory: %v", err)
-		} else {
-			fmt.Println("Directory created successfully.")
-		}
-	}
-}
-
-func init() {
-	logChan = make(chan *LogMsg, 100)
-	createLogDir()
-	checkLogFile()
-	go doLog()
-}
-
-func createLogFile() {
-	if logFile != nil {
-		logFile.Close()
-	}
-	lF, err := os.OpenFile(logFileName, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
-	if err != nil {
-		log.Fatalf("Error opening log file: %v", err)
-	}
-	logFile = lF
-}
-
-func checkLogFile() {
-	if fileInfo, err := os.Stat(logFileName); os.IsNotExist(err) {
-		createLogFile()
-	} else if fileInfo.Size() >= 1*1024*1024 || logFile == nil {
-		// logFile.Close()
-		os.Rename(logFileName, "logs/filesync_"+time.Now().Format("20060102150405")+".log")
-		createLogFile()
-	} else {
-		return
-	}
-	log.SetOutput(io.MultiWriter(logFile, os.Stdout))
-	log.SetFlags(0)
-}
-
-func getCallerInfo(skip int) (info string) {
-
-	_, file, lineNo, ok := runtime.Caller(skip)
-	if !ok {
-
-		info = "runtime.Caller() failed"
-		return
-	}
-	fileName := path.Base(file) // Base函数返回路径的最后一个元素
-	now := time.Now()
-	// 使用自定义格式字符串格式化时间
-	formattedTime := now.Format("2006-01-02 15:04:05")
-	return fmt.Sprintf("%s file:%s, line:%d ", formattedTime, fileName, lineNo)
-}
-
-func Info(msg string, args ...any) {
-	logChan <- &LogMsg{
-		Prefix: "[INFO] " + getCallerInfo(2) + " ",
-		Msg:    msg,
-		Args:   args,
-	}
-}
-
-func Error(msg string, args ...any) {
-	logChan <- &LogMsg{
-		Prefix: "[ERROR] " + getCallerInfo(2) + " ",
-		Msg:    msg,
-		Args:   args,
-	}
-}
-
-func doLog() {
-	for msg := range logChan {
-		checkLogFile()
-		log.SetPrefix(msg.Prefix)
-		log.Printf(msg.Msg+"\n", msg.Args...)
-	}
-}
-
-func Writer() io.Writer {
-	return log.Writer()
-}
+package logger
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	LevelDebug = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var levelNames = []string{"DEBUG", "INFO", "WARN", "ERROR"}
+
+// Options 日志配置，零值字段使用默认值
+type Options struct {
+	// debug, info, warn, error
+	Level string
+	// text 或 json
+	Format string
+	Path   string
+	// 单个日志文件的大小上限，超过后轮转
+	MaxSize int64
+	// 保留的历史日志文件数量，0 表示不清理
+	MaxFiles int
+	// 轮转后的日志是否 gzip 压缩
+	Compress bool
+	// 同时写入系统日志(syslog，journald 会一并收集)
+	Syslog bool
+}
+
+type LogMsg struct {
+	Level  int
+	Time   time.Time
+	Caller string
+	Line   int
+	Msg    string
+	Args   []any
+	// 非空时表示刷新请求，写完之前的日志后关闭该通道
+	flushed chan struct{}
+}
+
+const defaultLogFile = "logs/filesync.log"
+const defaultMaxSize = 1 * 1024 * 1024
+
+var logChan = make(chan *LogMsg, 1024)
+var level int32 = LevelInfo
+var console int32 = 1
+var closed int32
+
+// 调用 Configure 之前只写到标准错误，不创建日志文件，作为库使用时不产生文件
+var configured int32
+var startOnce sync.Once
+
+var mu sync.Mutex
+var options = Options{Path: defaultLogFile, MaxSize: defaultMaxSize}
+var logFile *os.File
+var logSize int64
+var sysWriter syslogWriter
+
+// start 在第一次使用时启动写日志的协程
+func start() {
+	startOnce.Do(func() {
+		go doLog()
+	})
+}
+
+// Configure 应用日志配置，可在运行中调用
+func Configure(opts Options) error {
+	if opts.Path == "" {
+		opts.Path = defaultLogFile
+	}
+	if opts.MaxSize <= 0 {
+		opts.MaxSize = defaultMaxSize
+	}
+	atomic.StoreInt32(&level, int32(ParseLevel(opts.Level)))
+	// 等待已排队的日志按旧配置写完
+	Flush()
+	mu.Lock()
+	defer mu.Unlock()
+	atomic.StoreInt32(&configured, 1)
+	if logFile != nil && opts.Path != options.Path {
+		logFile.Close()
+		logFile = nil
+	}
+	if sysWriter != nil && !opts.Syslog {
+		sysWriter.Close()
+		sysWriter = nil
+	}
+	var err error
+	if opts.Syslog && sysWriter == nil {
+		sysWriter, err = newSyslogWriter()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "open syslog failed: %v\n", err)
+		}
+	}
+	options = opts
+	return err
+}
+
+func ParseLevel(name string) int {
+	switch strings.ToLower(name) {
+	case "debug":
+		return LevelDebug
+	case "warn", "warning":
+		return LevelWarn
+	case "error":
+		return LevelError
+	default:
+		return LevelInfo
+	}
+}
+
+// SetConsole 控制是否同时输出到标准输出，进度显示期间关闭以免打乱终端
+func SetConsole(enabled bool) {
+	if enabled {
+		atomic.StoreInt32(&console, 1)
+	} else {
+		atomic.StoreInt32(&console, 0)
+	}
+}
+
+// openLogFile 在第一次写日志时才创建目录和文件
+func openLogFile() error {
+	if err := os.MkdirAll(filepath.Dir(options.Path), 0755); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(options.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	logFile = file
+	logSize = info.Size()
+	return nil
+}
+
+// rotate 把当前日志改名为带时间戳的文件，按需压缩并清理超出数量的旧日志
+func rotate() {
+	logFile.Close()
+	logFile = nil
+	ext := filepath.Ext(options.Path)
+	base := strings.TrimSuffix(options.Path, ext)
+	// 精确到毫秒，避免同一秒内多次轮转覆盖
+	rotated := base + "_" + strings.Replace(time.Now().Format("20060102150405.000"), ".", "", 1) + ext
+	if err := os.Rename(options.Path, rotated); err != nil {
+		fmt.Fprintf(os.Stderr, "rotate log file failed: %v\n", err)
+		return
+	}
+	if options.Compress {
+		if err := gzipFile(rotated); err != nil {
+			fmt.Fprintf(os.Stderr, "compress log file failed: %v\n", err)
+		}
+	}
+	if options.MaxFiles > 0 {
+		matches, _ := filepath.Glob(base + "_*" + ext + "*")
+		sort.Strings(matches)
+		for len(matches) > options.MaxFiles {
+			os.Remove(matches[0])
+			matches = matches[1:]
+		}
+	}
+}
+
+func gzipFile(name string) error {
+	src, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := os.Create(name + ".gz")
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(dst)
+	_, err = io.Copy(zw, src)
+	if closeErr := zw.Close(); err == nil {
+		err = closeErr
+	}
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(name + ".gz")
+		return err
+	}
+	src.Close()
+	return os.Remove(name)
+}
+
+func format(msg *LogMsg) []byte {
+	text := fmt.Sprintf(msg.Msg, msg.Args...)
+	if options.Format == "json" {
+		data, _ := json.Marshal(map[string]any{
+			"time":  msg.Time.Format(time.RFC3339Nano),
+			"level": strings.ToLower(levelNames[msg.Level]),
+			"file":  msg.Caller,
+			"line":  msg.Line,
+			"msg":   text,
+		})
+		return append(data, '\n')
+	}
+	return []byte(fmt.Sprintf("[%s] %s file:%s, line:%d  %s\n",
+		levelNames[msg.Level], msg.Time.Format("2006-01-02 15:04:05"), msg.Caller, msg.Line, text))
+}
+
+func write(msg *LogMsg) {
+	mu.Lock()
+	defer mu.Unlock()
+	line := format(msg)
+	// 未配置或已关闭时只写标准错误，Close 之后不再重新打开日志文件
+	if atomic.LoadInt32(&configured) == 0 || atomic.LoadInt32(&closed) == 1 {
+		os.Stderr.Write(line)
+		return
+	}
+	if atomic.LoadInt32(&console) == 1 {
+		os.Stdout.Write(line)
+	}
+	if sysWriter != nil {
+		sysWriter.Write(msg.Level, fmt.Sprintf(msg.Msg, msg.Args...))
+	}
+	if logFile == nil {
+		if err := openLogFile(); err != nil {
+			fmt.Fprintf(os.Stderr, "open log file failed: %v\n", err)
+			return
+		}
+	}
+	n, _ := logFile.Write(line)
+	logSize += int64(n)
+	if logSize >= options.MaxSize {
+		rotate()
+	}
+}
+
+func doLog() {
+	for msg := range logChan {
+		if msg.flushed != nil {
+			close(msg.flushed)
+			continue
+		}
+		write(msg)
+	}
+}
+
+func logf(lv int, msg string, args []any) {
+	if int32(lv) < atomic.LoadInt32(&level) {
+		return
+	}
+	logMsg := &LogMsg{
+		Level: lv,
+		Time:  time.Now(),
+		Msg:   msg,
+		Args:  args,
+	}
+	_, file, lineNo, ok := runtime.Caller(2)
+	if ok {
+		logMsg.Caller = path.Base(file) // Base函数返回路径的最后一个元素
+		logMsg.Line = lineNo
+	}
+	if atomic.LoadInt32(&closed) == 1 {
+		// 关闭后直接同步写出
+		write(logMsg)
+		return
+	}
+	start()
+	logChan <- logMsg
+}
+
+func Debug(msg string, args ...any) {
+	logf(LevelDebug, msg, args)
+}
+
+func Info(msg string, args ...any) {
+	logf(LevelInfo, msg, args)
+}
+
+func Warn(msg string, args ...any) {
+	logf(LevelWarn, msg, args)
+}
+
+func Error(msg string, args ...any) {
+	logf(LevelError, msg, args)
+}
+
+// Flush 等待已排队的日志全部写出
+func Flush() {
+	if atomic.LoadInt32(&closed) == 1 {
+		return
+	}
+	start()
+	done := make(chan struct{})
+	logChan <- &LogMsg{flushed: done}
+	<-done
+	mu.Lock()
+	defer mu.Unlock()
+	if logFile != nil {
+		logFile.Sync()
+	}
+}
+
+// Close 写出剩余日志并关闭文件，之后的日志同步写到标准错误
+func Close() {
+	if atomic.LoadInt32(&closed) == 1 {
+		return
+	}
+	Flush()
+	atomic.StoreInt32(&closed, 1)
+	mu.Lock()
+	defer mu.Unlock()
+	if logFile != nil {
+		logFile.Close()
+		logFile = nil
+	}
+	if sysWriter != nil {
+		sysWriter.Close()
+		sysWriter = nil
+	}
+}
+
+type writerFunc func(p []byte) (int, error)
+
+func (f writerFunc) Write(p []byte) (int, error) {
+	return f(p)
+}
+
+// Writer 返回按 INFO 级别逐行写入日志的 io.Writer
+func Writer() io.Writer {
+	return writerFunc(func(p []byte) (int, error) {
+		for _, line := range strings.Split(strings.TrimRight(string(p), "\n"), "\n") {
+			Info("%s", line)
+		}
+		return len(p), nil
+	})
+}
@@ -0,0 +1,14 @@
+//go:build windows || plan9
+
+package logger
+
+import "errors"
+
+type syslogWriter interface {
+	Write(level int, msg string) error
+	Close() error
+}
+
+func newSyslogWriter() (syslogWriter, error) {
+	return nil, errors.New("syslog is not supported on this platform")
+}
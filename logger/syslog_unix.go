@@ -0,0 +1,39 @@
+//go:build !windows && !plan9
+
+package logger
+
+import "log/syslog"
+
+type syslogWriter interface {
+	Write(level int, msg string) error
+	Close() error
+}
+
+type unixSyslog struct {
+	w *syslog.Writer
+}
+
+func newSyslogWriter() (syslogWriter, error) {
+	w, err := syslog.New(syslog.LOG_INFO|syslog.LOG_DAEMON, "filesync")
+	if err != nil {
+		return nil, err
+	}
+	return &unixSyslog{w: w}, nil
+}
+
+func (s *unixSyslog) Write(level int, msg string) error {
+	switch level {
+	case LevelDebug:
+		return s.w.Debug(msg)
+	case LevelWarn:
+		return s.w.Warning(msg)
+	case LevelError:
+		return s.w.Err(msg)
+	default:
+		return s.w.Info(msg)
+	}
+}
+
+func (s *unixSyslog) Close() error {
+	return s.w.Close()
+}
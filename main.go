@@ -1,117 +1,680 @@
-package main
-
-import (
-	"fmt"
-	"os"
-	"os/signal"
-	"runtime"
-	"time"
-
-	"stacktrace.top/filesync/config"
-	"stacktrace.top/filesync/logger"
-	"stacktrace.top/filesync/net"
-	"stacktrace.top/filesync/sync"
-)
-
-func makeSyncOper() sync.SyncOper {
-	switch config.InstanceConfig.Sync.Syncmode {
-	case config.LOCAL_MODE:
-		return &sync.OsSyncOper{}
-	case config.NET_MODE:
-		sc, err := net.StartClient()
-		if err != nil {
-			logger.Error("StartClient failed. Error: %v", err)
-			os.Exit(1)
-		}
-		return sc
-	default:
-		return &sync.OsSyncOper{}
-	}
-}
-
-func CompareDiffFiles() map[string]*sync.SyncFileInfo {
-	syncOper := makeSyncOper()
-	diffFiles, err := syncOper.CompareDiffFiles()
-	if err != nil {
-		logger.Error("CompareDiffFiles failed. Error: %v", err)
-		return nil
-	}
-	logger.Info("need sync files: %v", len(diffFiles))
-	return diffFiles
-}
-
-func syncFiles(diffFiles map[string]*sync.SyncFileInfo) {
-	syncOper := makeSyncOper()
-	syncOper.SyncFiles(diffFiles)
-}
-
-func DoSync() {
-	diffFiles := CompareDiffFiles()
-	// mySyncFiles := make(map[string]*sync.SyncFileInfo)
-	// for k, v := range diffFiles {
-	// 	mySyncFiles[k] = v
-	// 	break
-	// }
-	syncFiles(diffFiles)
-}
-
-// 全局变量，用于存储 recover() 返回的值
-var panicValue interface{}
-
-// 全局变量，用于存储 panic 发生时的堆栈信息
-var panicStack []byte
-
-// 全局函数，用于恢复 panic 并记录相关信息
-func globalRecover() {
-	if r := recover(); r != nil {
-		// 保存 panic 的值和堆栈信息
-		panicValue = r
-		panicStack = make([]byte, 1024*1024) // 分配足够的空间来保存堆栈信息
-		n := runtime.Stack(panicStack, false)
-		panicStack = panicStack[:n]
-		fmt.Println("Recovered from panic:", r, panicStack)
-	}
-}
-
-func procSignal() {
-	// Set up channel on which to send signal notifications.
-	// We must use a buffered channel or risk missing the signal
-	// if we're not ready to receive when the signal is sent.
-	c := make(chan os.Signal, 1)
-
-	// Passing no signals to Notify means that
-	// all signals will be sent to the channel.
-	signal.Notify(c)
-
-	// Block until any signal is received.
-	s := <-c
-	fmt.Println("Got signal:", s)
-}
-
-func main() {
-	defer globalRecover()
-	go procSignal()
-	args := os.Args[1:]
-	if len(args) > 0 {
-		switch args[0] {
-		case "makecache":
-			// 执行makecache操作
-			sync.MakeSrcInfo()
-		case "compare":
-			// 执行compare操作
-			CompareDiffFiles()
-		case "sync":
-			// 执行sync操作
-			DoSync()
-		case "daemon":
-			net.StartServer()
-		default:
-			fmt.Println("usage: filesync makecache | compare | sync")
-		}
-	} else {
-		fmt.Println("usage: filesync makecache | compare | sync")
-	}
-	// 程序正常退出
-	time.Sleep(time.Second * 100)
-	logger.Info("filesync exited")
-}
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"sync/atomic"
+	"syscall"
+
+	"stacktrace.top/filesync/config"
+	"stacktrace.top/filesync/logger"
+	"stacktrace.top/filesync/net"
+	"stacktrace.top/filesync/repo"
+	"stacktrace.top/filesync/s3"
+	"stacktrace.top/filesync/sftp"
+	"stacktrace.top/filesync/sync"
+	"stacktrace.top/filesync/webdav"
+)
+
+// newScanner 按当前配置创建本次命令使用的 Scanner，读取排除规则失败时退出
+func newScanner() *sync.Scanner {
+	scanner, err := sync.NewScanner(config.InstanceConfig.Sync)
+	if err != nil {
+		logger.Error("load exclude rules failed. Error: %v", err)
+		logger.Close()
+		os.Exit(1)
+	}
+	return scanner
+}
+
+// dialDaemon 按当前配置连接 daemon
+func dialDaemon(scanner *sync.Scanner) (*net.SyncClient, error) {
+	return net.DialClient(scanner, config.InstanceConfig.Client, config.InstanceConfig.Limit)
+}
+
+func makeSyncOper(scanner *sync.Scanner) sync.SyncOper {
+	switch config.InstanceConfig.Sync.Syncmode {
+	case config.LOCAL_MODE:
+		return localSyncOper(scanner)
+	case config.NET_MODE:
+		sc, err := dialDaemon(scanner)
+		if err != nil {
+			logger.Error("connect daemon failed. Error: %v", err)
+			logger.Close()
+			os.Exit(1)
+		}
+		if !encryptedNet() {
+			return sc
+		}
+		oper, err := repo.NewRepoSyncOperFS(scanner, net.NewRemoteFS(sc), config.InstanceConfig.Repo)
+		if err != nil {
+			sc.Close()
+			logger.Error("open repository failed. Error: %v", err)
+			logger.Close()
+			os.Exit(1)
+		}
+		return oper
+	case config.REPO_MODE:
+		oper, err := repo.NewRepoSyncOper(scanner, config.InstanceConfig.Repo)
+		if err != nil {
+			logger.Error("open repository failed. Error: %v", err)
+			logger.Close()
+			os.Exit(1)
+		}
+		return oper
+	case config.S3_MODE:
+		oper, err := s3.NewS3SyncOper(scanner, config.InstanceConfig.S3, config.InstanceConfig.Client)
+		if err != nil {
+			logger.Error("init s3 failed. Error: %v", err)
+			logger.Close()
+			os.Exit(1)
+		}
+		return oper
+	case config.SSH_MODE:
+		oper, err := sftp.NewSFTPSyncOper(scanner, config.InstanceConfig.Ssh, config.InstanceConfig.Client)
+		if err != nil {
+			logger.Error("connect sftp failed. Error: %v", err)
+			logger.Close()
+			os.Exit(1)
+		}
+		return oper
+	case config.WEBDAV_MODE:
+		oper, err := webdav.NewWebDAVSyncOper(scanner, config.InstanceConfig.Webdav, config.InstanceConfig.Client)
+		if err != nil {
+			logger.Error("init webdav failed. Error: %v", err)
+			logger.Close()
+			os.Exit(1)
+		}
+		return oper
+	default:
+		return localSyncOper(scanner)
+	}
+}
+
+// encryptedNet 在网络模式下配置了仓库口令时为 true，此时目标路径是 daemon 上的仓库，
+// 数据块和快照清单在本机加密后才发送，daemon 只保存密文
+func encryptedNet() bool {
+	conf := config.InstanceConfig
+	return conf.Sync.Syncmode == config.NET_MODE && (conf.Repo.Password != "" || conf.Repo.Passwordfile != "")
+}
+
+// closeSyncOper 关闭 SyncOper 持有的连接
+func closeSyncOper(oper sync.SyncOper) {
+	switch o := oper.(type) {
+	case interface{ Close() error }:
+		o.Close()
+	case interface{ Close() }:
+		o.Close()
+	}
+}
+
+// localDst 返回本地目标目录使用的存储，按 [backup] 保留被替换文件的旧版本
+func localDst() *sync.BackupFS {
+	return sync.WithBackup(sync.Local, config.InstanceConfig.Backup)
+}
+
+func localSyncOper(scanner *sync.Scanner) *sync.OsSyncOper {
+	return &sync.OsSyncOper{
+		Scanner: scanner,
+		Dst:     localDst(),
+		Workers: config.InstanceConfig.Client.Threads,
+	}
+}
+
+func CompareDiffFiles(syncOper sync.SyncOper) map[string]*sync.SyncFileInfo {
+	diffFiles, err := syncOper.CompareDiffFiles()
+	if err != nil {
+		logger.Error("CompareDiffFiles failed. Error: %v", err)
+		return nil
+	}
+	logger.Info("need sync files: %v", len(diffFiles))
+	return diffFiles
+}
+
+func syncFiles(scanner *sync.Scanner, syncOper sync.SyncOper, diffFiles map[string]*sync.SyncFileInfo) *sync.StatsReport {
+	stats := sync.NewStats(diffFiles, scanner.Src)
+	stopProgress := sync.StartProgress(stats)
+	syncOper.SyncFiles(diffFiles, stats)
+	stats.Finish()
+	stopProgress()
+	report := stats.Report()
+	report.Print(os.Stdout)
+	if config.InstanceConfig.Sync.Syncmode == config.LOCAL_MODE {
+		// 网络模式下由 daemon 清理过期版本
+		if removed := localDst().Prune(); removed > 0 {
+			logger.Info("pruned %v expired backup versions", removed)
+		}
+	}
+	if oper, ok := syncOper.(*repo.RepoSyncOper); ok {
+		pruneRepo(oper.Repository())
+	}
+	if config.InstanceConfig.Sync.Failurelist != "" {
+		if err := stats.FailureManifest(scanner.Config.Srcpath, scanner.Config.Dstpath).Write(config.InstanceConfig.Sync.Failurelist); err != nil {
+			logger.Error("write failure manifest failed. Error: %v", err)
+		} else if len(report.Failures) > 0 {
+			logger.Info("%v failed files written to %v, run filesync retry to resend them", len(report.Failures), config.InstanceConfig.Sync.Failurelist)
+		}
+	}
+	if config.InstanceConfig.Sync.Reportdir != "" {
+		name, err := report.WriteReport(config.InstanceConfig.Sync.Reportdir)
+		if err != nil {
+			logger.Error("write report failed. Error: %v", err)
+		} else {
+			logger.Info("report written: %v", name)
+		}
+	}
+	return report
+}
+
+// snapshotOper 返回支持快照的 SyncOper，调用方负责关闭
+func snapshotOper(scanner *sync.Scanner) (sync.SyncOper, sync.Snapshotter) {
+	oper := makeSyncOper(scanner)
+	s, ok := oper.(sync.Snapshotter)
+	if !ok {
+		closeSyncOper(oper)
+		logger.Error("sync mode %v does not support snapshots", config.InstanceConfig.Sync.Syncmode)
+		logger.Close()
+		os.Exit(1)
+	}
+	return oper, s
+}
+
+// syncSnapshot 在目标目录下创建新快照，只传输相对上一个快照变化的文件
+func syncSnapshot() {
+	scanner := newScanner()
+	root := scanner.Config.Dstpath
+	oper, s := snapshotOper(scanner)
+	defer closeSyncOper(oper)
+	dir, diffFiles, err := sync.PrepareSnapshot(s, scanner, root)
+	if err != nil {
+		logger.Error("prepare snapshot failed. Error: %v", err)
+		return
+	}
+	// 同步时按 Scanner 中的目标目录写入新快照
+	scanner.Config.Dstpath = dir
+	syncFiles(scanner, oper, diffFiles)
+	scanner.Config.Dstpath = root
+	removed, err := sync.PruneSnapshots(s, root, config.InstanceConfig.Snapshot)
+	if err != nil {
+		logger.Error("prune snapshots failed. Error: %v", err)
+	}
+	for _, name := range removed {
+		logger.Info("snapshot %v removed", name)
+	}
+}
+
+// snapshotMode 为 true 时目标路径下按时间保存快照目录，仓库模式本身按快照保存
+func snapshotMode() bool {
+	return config.InstanceConfig.Snapshot.Enabled && config.InstanceConfig.Sync.Syncmode != config.REPO_MODE && !encryptedNet()
+}
+
+func DoSync() {
+	if snapshotMode() {
+		syncSnapshot()
+		return
+	}
+	scanner := newScanner()
+	// 比较和同步使用同一个连接
+	syncOper := makeSyncOper(scanner)
+	defer closeSyncOper(syncOper)
+	diffFiles := CompareDiffFiles(syncOper)
+	// mySyncFiles := make(map[string]*sync.SyncFileInfo)
+	// for k, v := range diffFiles {
+	// 	mySyncFiles[k] = v
+	// 	break
+	// }
+	syncFiles(scanner, syncOper, diffFiles)
+}
+
+// Verify 按内容对比源目录与目标目录，快照模式下与最新的快照对比。返回进程退出码：0 一致，1 出错，2 存在差异
+func Verify() int {
+	scanner := newScanner()
+	srcInfos, scanErr := scanner.HashDir(sync.Local, scanner.Config.Srcpath)
+	if scanErr != nil {
+		logger.Error("scan src failed. Error: %v", scanErr)
+	}
+	var dstInfos map[string]*sync.SyncFileInfo
+	switch config.InstanceConfig.Sync.Syncmode {
+	case config.NET_MODE:
+		sc, err := dialDaemon(scanner)
+		if err != nil {
+			logger.Error("connect daemon failed. Error: %v", err)
+			return 1
+		}
+		defer sc.Close()
+		dstPath := scanner.Config.Dstpath
+		if snapshotMode() {
+			if dstPath, err = sync.LatestSnapshot(sc, dstPath); err != nil {
+				logger.Error("find latest snapshot failed. Error: %v", err)
+				return 1
+			}
+		}
+		if encryptedNet() {
+			// 与 daemon 上仓库中最新的快照对比
+			dstInfos, err = repo.LatestFileInfos(net.NewRemoteFS(sc), scanner.Config.Dstpath, config.InstanceConfig.Repo)
+		} else {
+			dstInfos, err = sc.FetchDirInfo(dstPath, true)
+		}
+		if err != nil {
+			logger.Error("fetch dst info failed. Error: %v", err)
+			return 1
+		}
+	case config.REPO_MODE:
+		// 与仓库中最新的快照对比
+		var err error
+		dstInfos, err = repo.LatestFileInfos(sync.Local, scanner.Config.Dstpath, config.InstanceConfig.Repo)
+		if err != nil {
+			logger.Error("load latest snapshot failed. Error: %v", err)
+			return 1
+		}
+	case config.S3_MODE:
+		var err error
+		dstInfos, err = s3.DstFileInfos(scanner, config.InstanceConfig.S3)
+		if err != nil {
+			logger.Error("list objects failed. Error: %v", err)
+			return 1
+		}
+	case config.SSH_MODE:
+		oper, err := sftp.NewSFTPSyncOper(scanner, config.InstanceConfig.Ssh, config.InstanceConfig.Client)
+		if err != nil {
+			logger.Error("connect sftp failed. Error: %v", err)
+			return 1
+		}
+		defer oper.Close()
+		if dstInfos, err = oper.DstFileInfos(); err != nil {
+			logger.Error("fetch dst info failed. Error: %v", err)
+			return 1
+		}
+	case config.WEBDAV_MODE:
+		oper, err := webdav.NewWebDAVSyncOper(scanner, config.InstanceConfig.Webdav, config.InstanceConfig.Client)
+		if err != nil {
+			logger.Error("init webdav failed. Error: %v", err)
+			return 1
+		}
+		if dstInfos, err = oper.DstFileInfos(); err != nil {
+			logger.Error("fetch dst info failed. Error: %v", err)
+			return 1
+		}
+	default:
+		dstPath := scanner.Config.Dstpath
+		var err error
+		if snapshotMode() {
+			if dstPath, err = sync.LatestSnapshot(localSyncOper(scanner), dstPath); err != nil {
+				logger.Error("find latest snapshot failed. Error: %v", err)
+				return 1
+			}
+		}
+		if dstInfos, err = scanner.HashDir(sync.Local, dstPath); err != nil {
+			logger.Error("scan dst failed. Error: %v", err)
+			scanErr = err
+		}
+	}
+	report := sync.VerifyTrees(srcInfos, dstInfos)
+	report.Print(os.Stdout)
+	// 无法读取的文件没有真正校验，按出错处理
+	if scanErr != nil || report.Failed() {
+		return 1
+	}
+	if report.Diverged() {
+		return 2
+	}
+	return 0
+}
+
+// Retry 只重传失败清单中的文件，默认使用配置的 failurelist。仍有失败时返回 2
+func Retry(args []string) int {
+	name := config.InstanceConfig.Sync.Failurelist
+	if len(args) > 0 {
+		name = args[0]
+	}
+	if name == "" {
+		fmt.Println("usage: filesync retry [manifest]")
+		return 1
+	}
+	manifest, err := sync.LoadFailureManifest(name)
+	if err != nil {
+		logger.Error("load failure manifest failed. Error: %v", err)
+		return 1
+	}
+	scanner := newScanner()
+	// 快照模式下重传到清单记录的快照目录
+	if config.InstanceConfig.Snapshot.Enabled && filepath.Dir(filepath.Clean(manifest.Dstpath)) == filepath.Clean(scanner.Config.Dstpath) {
+		scanner.Config.Dstpath = manifest.Dstpath
+	}
+	diffFiles, err := manifest.DiffFiles(scanner.Config.Srcpath, scanner.Config.Dstpath)
+	if err != nil {
+		logger.Error("load failure manifest failed. Error: %v", err)
+		return 1
+	}
+	logger.Info("retry files: %v", len(diffFiles))
+	syncOper := makeSyncOper(scanner)
+	defer closeSyncOper(syncOper)
+	report := syncFiles(scanner, syncOper, diffFiles)
+	if report.FilesFailed > 0 {
+		return 2
+	}
+	return 0
+}
+
+// Versions 列出目标文件的历史版本，或用 --restore 恢复指定版本；--prune 清理过期版本
+func Versions(args []string) int {
+	flags := flag.NewFlagSet("versions", flag.ContinueOnError)
+	restore := flags.String("restore", "", "restore the version with this id")
+	prune := flags.Bool("prune", false, "remove versions beyond the retention policy")
+	if err := flags.Parse(args); err != nil {
+		return 1
+	}
+	path := flags.Arg(0)
+	// 允许选项写在路径之后
+	if flags.NArg() > 1 {
+		if err := flags.Parse(flags.Args()[1:]); err != nil {
+			return 1
+		}
+	}
+	backup := localDst()
+	if *prune {
+		fmt.Printf("removed %d expired versions\n", backup.Prune())
+		return 0
+	}
+	if path == "" {
+		fmt.Println("usage: filesync versions <path> [--restore id] | --prune")
+		return 1
+	}
+	if *restore != "" {
+		if err := backup.RestoreVersion(path, *restore); err != nil {
+			fmt.Println(err)
+			return 1
+		}
+		fmt.Printf("restored %s from version %s\n", path, *restore)
+		return 0
+	}
+	versions, err := backup.ListVersions(path)
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	for _, v := range versions {
+		fmt.Printf("%s\t%s\t%s\n", v.ID, v.Time.Format("2006-01-02 15:04:05"), sync.FormatBytes(v.Size))
+	}
+	return 0
+}
+
+// Snapshots 列出目标目录下的快照，--prune 按保留策略清理
+func Snapshots(args []string) int {
+	flags := flag.NewFlagSet("snapshots", flag.ContinueOnError)
+	prune := flags.Bool("prune", false, "remove snapshots beyond the retention policy")
+	if err := flags.Parse(args); err != nil {
+		return 1
+	}
+	scanner := newScanner()
+	root := scanner.Config.Dstpath
+	oper, s := snapshotOper(scanner)
+	defer closeSyncOper(oper)
+	if *prune {
+		removed, err := sync.PruneSnapshots(s, root, config.InstanceConfig.Snapshot)
+		for _, name := range removed {
+			fmt.Printf("removed %s\n", name)
+		}
+		if err != nil {
+			fmt.Println(err)
+			return 1
+		}
+		return 0
+	}
+	names, err := s.ListSnapshots(root)
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	for _, name := range names {
+		fmt.Println(filepath.Join(root, name))
+	}
+	return 0
+}
+
+func pruneRepo(r *repo.Repository) bool {
+	removed, chunks, freed, err := r.Prune(config.InstanceConfig.Snapshot)
+	for _, name := range removed {
+		logger.Info("snapshot %v removed", name)
+	}
+	if err != nil {
+		logger.Error("prune repository failed. Error: %v", err)
+		return false
+	}
+	logger.Info("pruned %v unused chunks, %v freed", chunks, sync.FormatBytes(freed))
+	return true
+}
+
+// Repo 管理数据块仓库：list 列出快照，restore 恢复快照，prune 清理旧快照和不再引用的数据块
+func Repo(args []string) int {
+	usage := "usage: filesync repo list | restore <snapshot|latest> <target> [--path prefix] | prune"
+	if len(args) == 0 {
+		fmt.Println(usage)
+		return 1
+	}
+	fsys := sync.Local
+	if encryptedNet() {
+		// 仓库在 daemon 上，数据在本机解密
+		sc, err := dialDaemon(newScanner())
+		if err != nil {
+			fmt.Println(err)
+			return 1
+		}
+		defer sc.Close()
+		fsys = net.NewRemoteFS(sc)
+	}
+	r, err := repo.OpenFS(fsys, config.InstanceConfig.Sync.Dstpath, config.InstanceConfig.Repo)
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	switch args[0] {
+	case "list":
+		names, err := r.Snapshots()
+		if err != nil {
+			fmt.Println(err)
+			return 1
+		}
+		for _, name := range names {
+			m, err := r.LoadManifest(name)
+			if err != nil {
+				fmt.Printf("%s\t%v\n", name, err)
+				continue
+			}
+			var size int64
+			for _, entry := range m.Files {
+				if !entry.IsDir {
+					size += entry.Size
+				}
+			}
+			fmt.Printf("%s\t%d files\t%s\t%s\n", name, len(m.Files), sync.FormatBytes(size), m.Srcpath)
+		}
+	case "restore":
+		flags := flag.NewFlagSet("restore", flag.ContinueOnError)
+		prefix := flags.String("path", "", "only restore entries under this relative path")
+		if err := flags.Parse(args[1:]); err != nil {
+			return 1
+		}
+		// 允许选项写在参数之后
+		positional := flags.Args()
+		if len(positional) > 2 {
+			if err := flags.Parse(positional[2:]); err != nil {
+				return 1
+			}
+		}
+		if len(positional) < 2 {
+			fmt.Println(usage)
+			return 1
+		}
+		n, err := r.Restore(positional[0], positional[1], *prefix)
+		fmt.Printf("restored %d entries to %s\n", n, positional[1])
+		if err != nil {
+			fmt.Println(err)
+			return 1
+		}
+	case "prune":
+		if !pruneRepo(r) {
+			return 1
+		}
+	default:
+		fmt.Println(usage)
+		return 1
+	}
+	return 0
+}
+
+// Audit 查询审计日志，例如 filesync audit --since 24h --path /data/a
+func Audit(args []string) int {
+	flags := flag.NewFlagSet("audit", flag.ContinueOnError)
+	since := flags.String("since", "", "only entries after this time: RFC3339, 2006-01-02 or a duration like 24h")
+	path := flags.String("path", "", "only entries whose path starts with this prefix")
+	file := flags.String("file", config.InstanceConfig.Server.Auditlog, "audit journal file")
+	asJSON := flags.Bool("json", false, "print entries as JSON lines")
+	if err := flags.Parse(args); err != nil {
+		return 1
+	}
+	filter := &net.AuditFilter{Path: *path}
+	if *since != "" {
+		t, err := net.ParseSince(*since)
+		if err != nil {
+			fmt.Println(err)
+			return 1
+		}
+		filter.Since = t
+	}
+	if *file == "" {
+		fmt.Println("no audit journal configured")
+		return 1
+	}
+	journal, err := os.Open(*file)
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	defer journal.Close()
+	encoder := json.NewEncoder(os.Stdout)
+	err = net.QueryAudit(journal, filter, func(entry *net.AuditEntry) {
+		if *asJSON {
+			encoder.Encode(entry)
+		} else {
+			entry.Print(os.Stdout)
+		}
+	})
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	return 0
+}
+
+// 全局变量，用于存储 recover() 返回的值
+var panicValue interface{}
+
+// 全局变量，用于存储 panic 发生时的堆栈信息
+var panicStack []byte
+
+// 全局函数，用于恢复 panic 并记录相关信息
+func globalRecover() {
+	if r := recover(); r != nil {
+		// 保存 panic 的值和堆栈信息
+		panicValue = r
+		panicStack = make([]byte, 1024*1024) // 分配足够的空间来保存堆栈信息
+		n := runtime.Stack(panicStack, false)
+		panicStack = panicStack[:n]
+		fmt.Println("Recovered from panic:", r, panicStack)
+		logger.Error("Recovered from panic: %v %s", r, panicStack)
+	}
+	logger.Close()
+}
+
+// 运行中的 daemon，收到 SIGHUP 时重新应用限速
+var daemon atomic.Pointer[net.Server]
+
+func procSignal() {
+	// Set up channel on which to send signal notifications.
+	// We must use a buffered channel or risk missing the signal
+	// if we're not ready to receive when the signal is sent.
+	c := make(chan os.Signal, 1)
+
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+
+	for s := range c {
+		if s == syscall.SIGHUP {
+			// 重新加载配置，daemon 的限速立即生效
+			if conf, err := config.Reload(); err == nil {
+				if server := daemon.Load(); server != nil {
+					server.SetLimitConfig(conf.Limit)
+				}
+			}
+			continue
+		}
+		fmt.Println("Got signal:", s)
+		logger.Info("filesync exited by signal: %v", s)
+		logger.Close()
+		os.Exit(1)
+	}
+}
+
+func main() {
+	config.Load()
+	defer globalRecover()
+	go procSignal()
+	args := os.Args[1:]
+	if len(args) > 0 {
+		switch args[0] {
+		case "makecache":
+			// 执行makecache操作
+			newScanner().MakeSrcInfo()
+		case "compare":
+			// 执行compare操作
+			syncOper := makeSyncOper(newScanner())
+			CompareDiffFiles(syncOper)
+			closeSyncOper(syncOper)
+		case "sync":
+			// 执行sync操作
+			DoSync()
+		case "verify":
+			// 校验结果通过退出码返回，供定时任务判断
+			code := Verify()
+			logger.Close()
+			os.Exit(code)
+		case "retry":
+			code := Retry(args[1:])
+			logger.Close()
+			os.Exit(code)
+		case "versions":
+			code := Versions(args[1:])
+			logger.Close()
+			os.Exit(code)
+		case "repo":
+			code := Repo(args[1:])
+			logger.Close()
+			os.Exit(code)
+		case "snapshots":
+			code := Snapshots(args[1:])
+			logger.Close()
+			os.Exit(code)
+		case "audit":
+			code := Audit(args[1:])
+			logger.Close()
+			os.Exit(code)
+		case "daemon":
+			server, err := net.NewServer(config.InstanceConfig, sync.Local)
+			if err == nil {
+				daemon.Store(server)
+				server.Serve()
+			}
+		default:
+			fmt.Println("usage: filesync makecache | compare | sync | retry [manifest] | verify | versions <path> [--restore id] | snapshots [--prune] | repo list|restore|prune | audit [--since time] [--path prefix] | daemon")
+		}
+	} else {
+		fmt.Println("usage: filesync makecache | compare | sync | retry [manifest] | verify | versions <path> [--restore id] | snapshots [--prune] | repo list|restore|prune | audit [--since time] [--path prefix] | daemon")
+	}
+	// 程序正常退出
+	logger.Info("filesync exited")
+}
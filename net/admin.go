@@ -0,0 +1,322 @@
+package net
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	gosync "sync"
+	"sync/atomic"
+	"time"
+
+	"stacktrace.top/filesync/config"
+	"stacktrace.top/filesync/logger"
+)
+
+// 保留的最近任务记录数量
+const maxJobHistory = 100
+
+// ClientInfo 是一个已登录会话的状态，会话结束后作为任务记录保留
+type ClientInfo struct {
+	ID      uint64
+	Account string
+	Addr    string
+	Start   time.Time
+	End     *time.Time `json:",omitempty"`
+	Files   int64
+	Bytes   int64
+	Errors  int64
+	// 各流正在接收的文件
+	Current []string `json:",omitempty"`
+
+	session *Session
+	current map[uint32]string
+}
+
+// clientRegistry 记录当前连接的客户端和最近结束的任务
+type clientRegistry struct {
+	mu      gosync.Mutex
+	nextID  uint64
+	clients map[uint64]*ClientInfo
+	history []ClientInfo
+}
+
+func newClientRegistry() *clientRegistry {
+	return &clientRegistry{clients: make(map[uint64]*ClientInfo)}
+}
+
+func (r *clientRegistry) add(session *Session, account string) *ClientInfo {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.nextID++
+	client := &ClientInfo{
+		ID:      r.nextID,
+		Account: account,
+		Addr:    session.RemoteAddr().String(),
+		Start:   time.Now(),
+		session: session,
+		current: make(map[uint32]string),
+	}
+	r.clients[client.ID] = client
+	return client
+}
+
+func (r *clientRegistry) remove(client *ClientInfo) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.clients, client.ID)
+	end := time.Now()
+	client.End = &end
+	r.history = append(r.history, client.snapshot())
+	if len(r.history) > maxJobHistory {
+		r.history = r.history[len(r.history)-maxJobHistory:]
+	}
+}
+
+// setCurrent 记录流正在接收的文件，为空表示空闲
+func (r *clientRegistry) setCurrent(client *ClientInfo, stream uint32, dstPath string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if dstPath == "" {
+		delete(client.current, stream)
+	} else {
+		client.current[stream] = dstPath
+	}
+}
+
+func (r *clientRegistry) record(client *ClientInfo, size int64, ok bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if ok {
+		client.Files++
+		client.Bytes += size
+	} else {
+		client.Errors++
+	}
+}
+
+// snapshot 复制客户端状态，调用方需持有锁
+func (client *ClientInfo) snapshot() ClientInfo {
+	c := *client
+	c.Current = make([]string, 0, len(client.current))
+	for _, p := range client.current {
+		c.Current = append(c.Current, p)
+	}
+	c.session = nil
+	c.current = nil
+	return c
+}
+
+func (r *clientRegistry) list() []ClientInfo {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	list := make([]ClientInfo, 0, len(r.clients))
+	for id := uint64(1); id <= r.nextID; id++ {
+		if client, ok := r.clients[id]; ok {
+			list = append(list, client.snapshot())
+		}
+	}
+	return list
+}
+
+func (r *clientRegistry) jobs() []ClientInfo {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	// 最近的在前
+	jobs := make([]ClientInfo, 0, len(r.history))
+	for i := len(r.history) - 1; i >= 0; i-- {
+		jobs = append(jobs, r.history[i])
+	}
+	return jobs
+}
+
+func (r *clientRegistry) disconnect(id uint64) bool {
+	r.mu.Lock()
+	client, ok := r.clients[id]
+	r.mu.Unlock()
+	if ok {
+		client.session.Close()
+	}
+	return ok
+}
+
+// rescanState 记录最近一次重建目标缓存的结果
+type rescanState struct {
+	Running  bool
+	Start    time.Time
+	Duration string `json:",omitempty"`
+	Entries  int
+}
+
+// rescanner 记录一个服务端的目标缓存重建状态，同一时间只运行一次
+type rescanner struct {
+	mu      gosync.Mutex
+	state   rescanState
+	running int32
+}
+
+func (srv *Server) startRescan() bool {
+	r := &srv.rescan
+	if !atomic.CompareAndSwapInt32(&r.running, 0, 1) {
+		return false
+	}
+	r.mu.Lock()
+	r.state = rescanState{Running: true, Start: time.Now()}
+	r.mu.Unlock()
+	go func() {
+		defer atomic.StoreInt32(&r.running, 0)
+		logger.Info("rescan %v requested by admin api", srv.conf.Sync.Dstpath)
+		entries := srv.scanner.Clone().MakeDstInfo()
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		r.state.Running = false
+		r.state.Entries = entries
+		r.state.Duration = time.Since(r.state.Start).Round(time.Millisecond).String()
+		logger.Info("rescan finished. entries: %v, elapsed: %v", entries, r.state.Duration)
+	}()
+	return true
+}
+
+func (srv *Server) rescanStatus() rescanState {
+	srv.rescan.mu.Lock()
+	defer srv.rescan.mu.Unlock()
+	return srv.rescan.state
+}
+
+// redactedConfig 返回当前配置，口令和 token 替换为占位符
+func (srv *Server) redactedConfig() config.Config {
+	conf := srv.conf
+	conf.Limit = srv.limits.limitConfig()
+	return conf.Redacted()
+}
+
+func writeJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, code int, msg string) {
+	writeJSON(w, code, map[string]string{"error": msg})
+}
+
+// adminAuth 校验 Authorization: Bearer <admintoken>
+func (srv *Server) adminAuth(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !tokenEqual(token, srv.conf.Server.Admintoken) {
+			logger.Error("admin api unauthorized. client: %v, path: %v", r.RemoteAddr, r.URL.Path)
+			writeError(w, http.StatusUnauthorized, "unauthorized")
+			return
+		}
+		next(w, r)
+	}
+}
+
+func (srv *Server) handleClients(w http.ResponseWriter, r *http.Request) {
+	// GET /api/clients 或 POST /api/clients/{id}/disconnect
+	rest := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/clients"), "/")
+	if rest == "" {
+		if r.Method != http.MethodGet {
+			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		writeJSON(w, http.StatusOK, srv.clients.list())
+		return
+	}
+	parts := strings.Split(rest, "/")
+	if len(parts) != 2 || parts[1] != "disconnect" {
+		writeError(w, http.StatusNotFound, "not found")
+		return
+	}
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	id, err := strconv.ParseUint(parts[0], 10, 64)
+	if err != nil || !srv.clients.disconnect(id) {
+		writeError(w, http.StatusNotFound, "client not found")
+		return
+	}
+	logger.Info("client %v disconnected by admin api", id)
+	writeJSON(w, http.StatusOK, map[string]uint64{"disconnected": id})
+}
+
+func (srv *Server) handleJobs(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	writeJSON(w, http.StatusOK, srv.clients.jobs())
+}
+
+func (srv *Server) handleRescan(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, srv.rescanStatus())
+	case http.MethodPost:
+		if !srv.startRescan() {
+			writeError(w, http.StatusConflict, "rescan already running")
+			return
+		}
+		writeJSON(w, http.StatusAccepted, srv.rescanStatus())
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+func (srv *Server) handleConfig(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	writeJSON(w, http.StatusOK, srv.redactedConfig())
+}
+
+// handleLimit 查看或临时调整限速，单位 KB/s，下一次计划刷新或 SIGHUP 时恢复配置值
+func (srv *Server) handleLimit(w http.ResponseWriter, r *http.Request) {
+	type limit struct {
+		Global  int64
+		Perconn int64
+	}
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut, http.MethodPost:
+		req := &limit{}
+		if err := json.NewDecoder(r.Body).Decode(req); err != nil || req.Global < 0 || req.Perconn < 0 {
+			writeError(w, http.StatusBadRequest, "invalid limit")
+			return
+		}
+		srv.limits.set(req.Global, req.Perconn)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	global, perConn := srv.limits.current()
+	writeJSON(w, http.StatusOK, &limit{Global: global, Perconn: perConn})
+}
+
+// startAdminServer 配置了监听地址时启动管理 API，必须同时配置 admintoken
+func (srv *Server) startAdminServer() {
+	addr := srv.conf.Server.Adminaddr
+	if addr == "" {
+		return
+	}
+	if srv.conf.Server.Admintoken == "" {
+		logger.Error("admin api disabled: admintoken is not set")
+		return
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/clients", srv.adminAuth(srv.handleClients))
+	mux.HandleFunc("/api/clients/", srv.adminAuth(srv.handleClients))
+	mux.HandleFunc("/api/jobs", srv.adminAuth(srv.handleJobs))
+	mux.HandleFunc("/api/rescan", srv.adminAuth(srv.handleRescan))
+	mux.HandleFunc("/api/config", srv.adminAuth(srv.handleConfig))
+	mux.HandleFunc("/api/limit", srv.adminAuth(srv.handleLimit))
+	go func() {
+		logger.Info("admin api listening on %v", addr)
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			logger.Error("start admin api failed. addr: %v, err: %v", addr, err)
+		}
+	}()
+}
@@ -0,0 +1,159 @@
+package net
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	gosync "sync"
+	"time"
+
+	"stacktrace.top/filesync/logger"
+)
+
+const (
+	AUDIT_WRITE      = "write"
+	AUDIT_MKDIR      = "mkdir"
+	AUDIT_RMSNAPSHOT = "rmsnapshot"
+	// 从上一个快照硬链接到新快照的条目
+	AUDIT_LINK = "link"
+	// 客户端通过远程存储操作改名和删除的条目，用于网络模式的加密仓库
+	AUDIT_RENAME = "rename"
+	AUDIT_REMOVE = "remove"
+)
+
+// AuditEntry 是审计日志中的一行，记录目标端的一次变更
+type AuditEntry struct {
+	Time    time.Time
+	Client  string
+	Account string
+	Op      string
+	Path    string
+	Size    int64
+	// 文件内容的 SHA-256，十六进制
+	Hash string `json:",omitempty"`
+	// 非空表示变更失败
+	Error string `json:",omitempty"`
+}
+
+// auditJournal 以 JSON Lines 追加写入审计日志，每秒刷盘一次
+type auditJournal struct {
+	mu    gosync.Mutex
+	file  *os.File
+	dirty bool
+}
+
+// openAuditJournal 打开审计日志文件，path 为空时不记录，返回 nil
+func openAuditJournal(path string) (*auditJournal, error) {
+	if path == "" {
+		return nil, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0640)
+	if err != nil {
+		return nil, err
+	}
+	audit := &auditJournal{file: file}
+	go audit.syncLoop()
+	logger.Info("audit journal: %v", path)
+	return audit, nil
+}
+
+func (j *auditJournal) record(entry *AuditEntry) {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		logger.Error("marshal audit entry failed. err: %v", err)
+		return
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	// 一次写入整行，O_APPEND 保证行不会交错
+	if _, err := j.file.Write(append(data, '\n')); err != nil {
+		logger.Error("write audit journal failed. err: %v", err)
+		return
+	}
+	j.dirty = true
+}
+
+func (j *auditJournal) syncLoop() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for range ticker.C {
+		j.mu.Lock()
+		if j.dirty {
+			if err := j.file.Sync(); err != nil {
+				logger.Error("sync audit journal failed. err: %v", err)
+			}
+			j.dirty = false
+		}
+		j.mu.Unlock()
+	}
+}
+
+// AuditFilter 查询条件，零值表示不过滤
+type AuditFilter struct {
+	Since time.Time
+	// 路径前缀
+	Path string
+}
+
+func (f *AuditFilter) match(entry *AuditEntry) bool {
+	if !f.Since.IsZero() && entry.Time.Before(f.Since) {
+		return false
+	}
+	if f.Path != "" && !strings.HasPrefix(filepath.ToSlash(entry.Path), filepath.ToSlash(f.Path)) {
+		return false
+	}
+	return true
+}
+
+// QueryAudit 逐行读取审计日志，对满足条件的记录调用 fn，无法解析的行跳过
+func QueryAudit(r io.Reader, filter *AuditFilter, fn func(entry *AuditEntry)) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := scanner.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+		entry := &AuditEntry{}
+		if err := json.Unmarshal(line, entry); err != nil {
+			logger.Error("invalid audit entry at line %v: %v", lineNo, err)
+			continue
+		}
+		if filter.match(entry) {
+			fn(entry)
+		}
+	}
+	return scanner.Err()
+}
+
+// ParseSince 支持 RFC3339、日期(2006-01-02) 和相对时长(如 24h)
+func ParseSince(s string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	if t, err := time.ParseInLocation("2006-01-02", s, time.Local); err == nil {
+		return t, nil
+	}
+	if d, err := time.ParseDuration(s); err == nil {
+		return time.Now().Add(-d), nil
+	}
+	return time.Time{}, fmt.Errorf("invalid time: %v", s)
+}
+
+func (entry *AuditEntry) Print(w io.Writer) {
+	fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\t%s\t%s", entry.Time.Local().Format("2006-01-02 15:04:05"),
+		entry.Client, entry.Account, entry.Op, entry.Size, entry.Hash, entry.Path)
+	if entry.Error != "" {
+		fmt.Fprintf(w, "\terror: %s", entry.Error)
+	}
+	fmt.Fprintln(w)
+}
@@ -0,0 +1,206 @@
+package net
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"stacktrace.top/filesync/config"
+	"stacktrace.top/filesync/logger"
+	"stacktrace.top/filesync/sync"
+)
+
+// 小文件打包发送，服务端逐个落盘后统一应答
+const MSG_BATCH = 8
+
+const (
+	defaultBatchThreshold = 64 * 1024
+	defaultBatchSize      = 4 * 1024 * 1024
+	maxBatchEntries       = 4096
+	// 单批编码后的负载上限，路径较长时也不会超过帧大小
+	maxBatchPayload = MaxFrameSize
+)
+
+type BatchEntry struct {
+	DstPath  string
+	FileInfo *sync.SyncFileInfo
+	Data     []byte
+	// 文件内容的 SHA-256，目录为空
+	Sum []byte
+}
+
+type SyncBatchMsg struct {
+	Entries []*BatchEntry
+}
+
+// batchLimits 返回小文件阈值与单批总大小，阈值为负数时关闭打包
+func batchLimits(conf config.ClientConfig) (int64, int64) {
+	threshold := int64(conf.Batchthreshold)
+	size := int64(conf.Batchsize)
+	if size <= 0 || size > maxDataChunk {
+		size = defaultBatchSize
+	}
+	if threshold == 0 {
+		threshold = defaultBatchThreshold
+	}
+	if threshold > size {
+		threshold = size
+	}
+	return threshold, size
+}
+
+// batchEntrySize 返回条目编码后的长度：路径、文件信息、数据和 SHA-256，变长字段各带 4 字节长度
+func batchEntrySize(dstPath string, info *sync.SyncFileInfo) int64 {
+	size := int64(4 + len(filepath.ToSlash(dstPath)))
+	size += int64(1 + 4 + len(info.Name) + 8 + 8 + 4 + 1 + 4 + len(info.Hash))
+	size += 4 + 4
+	if !info.IsDir {
+		size += info.Size + sha256.Size
+	}
+	return size
+}
+
+func (msg *SyncBatchMsg) marshal() []byte {
+	e := &encoder{}
+	e.uint32(uint32(len(msg.Entries)))
+	for _, entry := range msg.Entries {
+		e.string(filepath.ToSlash(entry.DstPath))
+		e.fileInfo(entry.FileInfo)
+		e.bytes(entry.Data)
+		e.bytes(entry.Sum)
+	}
+	return e.buf.Bytes()
+}
+
+func (msg *SyncBatchMsg) unmarshal(data []byte) error {
+	d := &decoder{data: data}
+	count := d.uint32()
+	if count > maxBatchEntries {
+		return fmt.Errorf("too many batch entries: %d", count)
+	}
+	msg.Entries = make([]*BatchEntry, 0, count)
+	for i := uint32(0); i < count && d.err == nil; i++ {
+		entry := &BatchEntry{
+			DstPath:  filepath.FromSlash(strings.ReplaceAll(d.string(), "\\", "/")),
+			FileInfo: d.fileInfo(),
+			Data:     d.bytes(),
+			Sum:      d.bytes(),
+		}
+		if d.err == nil && entry.FileInfo == nil {
+			return errors.New("batch entry without file info")
+		}
+		msg.Entries = append(msg.Entries, entry)
+	}
+	return d.finish()
+}
+
+// SyncBatch 读取一批小文件并一次性发送，返回每个失败条目的错误
+func (sc *SyncClient) SyncBatch(batch []*SyncInfo) (map[string]error, error) {
+	failed := make(map[string]error)
+	msg := &SyncBatchMsg{}
+	for _, sInfo := range batch {
+		srcFilePath := filepath.Join(sc.scanner.Config.Srcpath, sInfo.FilePath)
+		entry := &BatchEntry{
+			DstPath:  filepath.Join(sc.scanner.Config.Dstpath, sInfo.FilePath),
+			FileInfo: sInfo.FileInfo,
+		}
+		if !sInfo.FileInfo.IsDir && sInfo.FileInfo.Size > 0 {
+			data, err := os.ReadFile(srcFilePath)
+			if err != nil {
+				logger.Error("read file failed. file: %v, err: %v", srcFilePath, err)
+				failed[sInfo.FilePath] = err
+				continue
+			}
+			if int64(len(data)) != sInfo.FileInfo.Size {
+				failed[sInfo.FilePath] = fmt.Errorf("file size changed: %v", srcFilePath)
+				continue
+			}
+			entry.Data = data
+		}
+		if !sInfo.FileInfo.IsDir {
+			sum := sha256.Sum256(entry.Data)
+			entry.Sum = sum[:]
+		}
+		msg.Entries = append(msg.Entries, entry)
+	}
+	if len(msg.Entries) == 0 {
+		return failed, nil
+	}
+	var err error
+	if sc.compress {
+		err = writeCompressedFrame(sc.conn, MSG_BATCH, msg.marshal(), sc.conf.Compresslevel, sc.stats)
+	} else {
+		payload := msg.marshal()
+		sc.stats.add(len(payload), len(payload))
+		err = sc.conn.WriteFrame(MSG_BATCH, 0, payload)
+	}
+	if err != nil {
+		return failed, newStreamError(err)
+	}
+	resMsg, err := ReadForSyncRespMsg(sc.conn)
+	if err != nil {
+		return failed, newStreamError(err)
+	}
+	if resMsg.MsgType != MSG_BATCH {
+		return failed, newStreamError(fmt.Errorf("unexpected response type: %v", resMsg.MsgType))
+	}
+	if resMsg.ResCode != RES_SUCCESS {
+		return failed, fmt.Errorf("%w. sync batch failed. res: %v, err: %v", sync.ErrRemoteFailed, resMsg.ResCode, resMsg.Err)
+	}
+	// 服务端按目标路径返回失败条目
+	for _, sInfo := range batch {
+		dstFilePath := filepath.ToSlash(filepath.Join(sc.scanner.Config.Dstpath, sInfo.FilePath))
+		if errMsg, ok := resMsg.Failed[dstFilePath]; ok {
+			failed[sInfo.FilePath] = fmt.Errorf("%w: %v", sync.ErrRemoteFailed, errMsg)
+		}
+	}
+	return failed, nil
+}
+
+func (syncServer *SyncServer) syncBatch(payload []byte) {
+	resMsg := &SyncRespMsg{
+		MsgType: MSG_BATCH,
+		ResCode: RES_SUCCESS,
+	}
+	msg := &SyncBatchMsg{}
+	if err := msg.unmarshal(payload); err != nil {
+		logger.Error("parse batch msg failed. err: %v", err)
+		syncServer.Stop()
+		return
+	}
+	logger.Info("begin sync batch: %v files", len(msg.Entries))
+	syncServer.setCurrent(fmt.Sprintf("batch of %v files", len(msg.Entries)))
+	defer syncServer.setCurrent("")
+	for _, entry := range msg.Entries {
+		syncServer.srv.metrics.bytesRead(syncServer.account, int64(len(entry.Data)))
+		if err := applyBatchEntry(syncServer.fs, entry); err != nil {
+			syncServer.recordWrite(entry.DstPath, entry.FileInfo, nil, err.Error())
+			logger.Error("sync batch entry: %v failed.err: %v", entry.DstPath, err)
+			if resMsg.Failed == nil {
+				resMsg.Failed = make(map[string]string)
+			}
+			resMsg.Failed[filepath.ToSlash(entry.DstPath)] = err.Error()
+		} else {
+			syncServer.recordWrite(entry.DstPath, entry.FileInfo, entry.Sum, "")
+		}
+	}
+	syncServer.response(resMsg)
+}
+
+func applyBatchEntry(fsys sync.FS, entry *BatchEntry) error {
+	info := entry.FileInfo
+	if !info.IsDir {
+		if int64(len(entry.Data)) != info.Size {
+			return fmt.Errorf("size mismatch. expect %v, got %v", info.Size, len(entry.Data))
+		}
+		sum := sha256.Sum256(entry.Data)
+		if !bytes.Equal(sum[:], entry.Sum) {
+			return ErrChecksumMismatch
+		}
+	}
+	return sync.WriteEntry(fsys, entry.DstPath, info, entry.Data)
+}
@@ -1,150 +1,289 @@
-package net
-
-import (
-	"encoding/binary"
-	"encoding/json"
-	"net"
-	"path/filepath"
-	"strings"
-
-	"stacktrace.top/filesync/logger"
-	"stacktrace.top/filesync/sync"
-)
-
-const (
-	MSG_TOKEN     = 0
-	MSG_MAKECACHE = 1
-	MSG_SYNC      = 2
-	MSG_FILEPART  = 3
-)
-
-const (
-	RES_SUCCESS = 0
-)
-
-type SyncCmdMsg struct {
-	MsgType  uint32
-	Token    string
-	DstDir   string
-	SyncInfo *sync.SyncFileInfo
-}
-
-type SyncRespMsg struct {
-	MsgType   uint32
-	ResCode   int
-	Err       error
-	OffSet    int64
-	PartSize  int64
-	FileInfos map[string]*sync.SyncFileInfo
-}
-
-func ReadForSyncMsg(conn *net.TCPConn) (*SyncCmdMsg, error) {
-	// 读取消息长度
-	var msgLen uint32
-	err := binary.Read(conn, binary.BigEndian, &msgLen)
-	if err != nil {
-		logger.Error("read msg len failed. conn: %v err: %v", conn, err)
-		return nil, err
-	}
-	// 读取消息内容
-	msgBytes := make([]byte, msgLen)
-	readLen := 0
-	for readLen < int(msgLen) {
-		n, err := conn.Read(msgBytes)
-		if err != nil {
-			logger.Error("read msg failed. err: %v", err)
-			return nil, err
-		}
-		readLen += n
-	}
-
-	// 解析消息
-	msg := &SyncCmdMsg{}
-	err = json.Unmarshal(msgBytes, msg)
-	if err != nil {
-		logger.Error("parse msg failed. err: %v", err)
-		return nil, err
-	}
-	if msg.DstDir != "" {
-		msg.DstDir = filepath.FromSlash(strings.ReplaceAll(msg.DstDir, "\\", "/"))
-	}
-	return msg, nil
-}
-
-func WriteForSyncMsg(conn *net.TCPConn, msg *SyncCmdMsg) error {
-	// 序列化消息
-	msgBytes, err := json.Marshal(msg)
-	if err != nil {
-		logger.Error("marshal msg failed. err: %v", err)
-		return err
-	}
-	// 写入消息长度
-	err = binary.Write(conn, binary.BigEndian, uint32(len(msgBytes)))
-	if err != nil {
-		logger.Error("write msg len failed. err: %v", err)
-		return err
-	}
-	// 写入消息内容
-	_, err = conn.Write(msgBytes)
-	if err != nil {
-		logger.Error("write msg failed. err: %v", err)
-		return err
-	}
-	return nil
-}
-
-func ReadForSyncRespMsg(conn *net.TCPConn) (*SyncRespMsg, error) {
-	// 读取消息长度
-	var msgLen uint32
-	err := binary.Read(conn, binary.BigEndian, &msgLen)
-	if err != nil {
-		logger.Error("read msg len failed. err: %v", err)
-		return nil, err
-	}
-	// logger.Info("get msg len: %v", msgLen)
-	// 读取消息内容
-	msgBytes := make([]byte, msgLen)
-	readLen := 0
-	for readLen < int(msgLen) {
-		n, err := conn.Read(msgBytes[readLen:])
-		if err != nil {
-			logger.Error("read msg failed. err: %v", err)
-			return nil, err
-		}
-		// logger.Info("read msg len: %v", n)
-		readLen += n
-	}
-
-	// 解析消息
-	respMsg := &SyncRespMsg{}
-	err = json.Unmarshal(msgBytes, respMsg)
-	if err != nil {
-		logger.Error("parse msg failed. err: %v", err)
-		return nil, err
-	}
-	return respMsg, nil
-}
-
-func WriteForSyncRespMsg(conn *net.TCPConn, respMsg *SyncRespMsg) error {
-	// 序列化消息
-	msgBytes, err := json.Marshal(respMsg)
-	if err != nil {
-		logger.Error("marshal msg failed. err: %v", err)
-		return err
-	}
-	// logger.Info("write msg len: %v", len(msgBytes))
-	// 写入消息长度
-	err = binary.Write(conn, binary.BigEndian, uint32(len(msgBytes)))
-	if err != nil {
-		logger.Error("write msg len failed. err: %v", err)
-		return err
-	}
-	// 写入消息内容
-	_, err = conn.Write(msgBytes)
-	if err != nil {
-		logger.Error("write msg failed. err: %v", err)
-		return err
-	}
-	// logger.Info("writed msg len: %v", n)
-	return nil
-}
+package net
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"path/filepath"
+	"strings"
+
+	"stacktrace.top/filesync/logger"
+	"stacktrace.top/filesync/sync"
+)
+
+const (
+	MSG_TOKEN     = 0
+	MSG_MAKECACHE = 1
+	MSG_SYNC      = 2
+	// 客户端发送的文件内容，负载带偏移
+	MSG_FILEPART = 3
+	// 目录列表分批下发，最后以 MSG_MAKECACHE 应答结束
+	MSG_FILELIST = 4
+	// 文件内容发送完毕，负载为整个文件的 SHA-256
+	MSG_FILEDONE = 9
+)
+
+const (
+	RES_SUCCESS  = 0
+	RES_FAILED   = 1
+	RES_CHECKSUM = 2
+	// 远程存储操作的目标不存在或已存在，客户端还原为 fs.ErrNotExist 和 fs.ErrExist
+	RES_NOTEXIST = 3
+	RES_EXIST    = 4
+)
+
+var ErrChunkChecksum = errors.New("chunk checksum mismatch")
+var ErrChecksumMismatch = sync.ErrChecksumMismatch
+
+// streamError 表示流上的传输或协议错误，流的状态已不可信，之后的任务要换新流。
+// 服务端对单个文件返回的失败应答不属于此类，流可以继续使用
+type streamError struct {
+	err error
+}
+
+func (e *streamError) Error() string { return e.err.Error() }
+func (e *streamError) Unwrap() error { return e.err }
+
+func newStreamError(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &streamError{err: err}
+}
+
+func isStreamError(err error) bool {
+	var se *streamError
+	return errors.As(err, &se)
+}
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+type SyncCmdMsg struct {
+	MsgType  uint32
+	Token    string
+	DstDir   string
+	SyncInfo *sync.SyncFileInfo
+	// 客户端是否希望启用压缩
+	Compress bool
+	// 目录列表是否需要带上文件内容的哈希
+	WithHash bool
+}
+
+type SyncRespMsg struct {
+	MsgType   uint32
+	ResCode   int
+	Err       string
+	OffSet    int64
+	PartSize  int64
+	FileInfos map[string]*sync.SyncFileInfo
+	// 握手应答中表示协商后是否启用压缩
+	Compress bool
+	// 批量同步中失败的条目，目标路径到错误信息
+	Failed map[string]string
+}
+
+func (msg *SyncCmdMsg) marshal() []byte {
+	e := &encoder{}
+	e.string(msg.Token)
+	e.string(filepath.ToSlash(msg.DstDir))
+	e.fileInfo(msg.SyncInfo)
+	e.bool(msg.Compress)
+	e.bool(msg.WithHash)
+	return e.buf.Bytes()
+}
+
+func (msg *SyncCmdMsg) unmarshal(data []byte) error {
+	d := &decoder{data: data}
+	msg.Token = d.string()
+	msg.DstDir = d.string()
+	msg.SyncInfo = d.fileInfo()
+	msg.Compress = d.bool()
+	msg.WithHash = d.bool()
+	return d.finish()
+}
+
+func (respMsg *SyncRespMsg) marshal() []byte {
+	e := &encoder{}
+	e.int64(int64(respMsg.ResCode))
+	e.string(respMsg.Err)
+	e.int64(respMsg.OffSet)
+	e.int64(respMsg.PartSize)
+	e.uint32(uint32(len(respMsg.FileInfos)))
+	for k, v := range respMsg.FileInfos {
+		e.string(filepath.ToSlash(k))
+		e.fileInfo(v)
+	}
+	e.bool(respMsg.Compress)
+	e.uint32(uint32(len(respMsg.Failed)))
+	for k, v := range respMsg.Failed {
+		e.string(k)
+		e.string(v)
+	}
+	return e.buf.Bytes()
+}
+
+func (respMsg *SyncRespMsg) unmarshal(data []byte) error {
+	d := &decoder{data: data}
+	respMsg.ResCode = int(d.int64())
+	respMsg.Err = d.string()
+	respMsg.OffSet = d.int64()
+	respMsg.PartSize = d.int64()
+	count := d.uint32()
+	if count > 0 {
+		// 每个条目至少占用 5 字节，避免恶意计数导致的大内存分配
+		if int(count) > len(d.data)/5 {
+			return fmt.Errorf("invalid file info count: %d", count)
+		}
+		respMsg.FileInfos = make(map[string]*sync.SyncFileInfo, count)
+		for i := uint32(0); i < count && d.err == nil; i++ {
+			k := d.string()
+			respMsg.FileInfos[k] = d.fileInfo()
+		}
+	}
+	respMsg.Compress = d.bool()
+	count = d.uint32()
+	if count > 0 {
+		if int(count) > len(d.data)/8 {
+			return fmt.Errorf("invalid failed entry count: %d", count)
+		}
+		respMsg.Failed = make(map[string]string, count)
+		for i := uint32(0); i < count && d.err == nil; i++ {
+			k := d.string()
+			respMsg.Failed[k] = d.string()
+		}
+	}
+	return d.finish()
+}
+
+func ReadForSyncMsg(fc FrameConn) (*SyncCmdMsg, error) {
+	frame, err := fc.ReadFrame()
+	if err != nil {
+		if err != io.EOF {
+			logger.Error("read msg failed. err: %v", err)
+		}
+		return nil, err
+	}
+	return parseSyncMsg(frame)
+}
+
+func parseSyncMsg(frame *Frame) (*SyncCmdMsg, error) {
+	if frame.Type == MSG_FILEPART || frame.Type == MSG_BATCH || frame.Type == MSG_FILEDONE || frame.Type == MSG_SNAPSHOT || frame.Type == MSG_FS {
+		return nil, fmt.Errorf("unexpected frame type: %d", frame.Type)
+	}
+	// 解析消息
+	msg := &SyncCmdMsg{MsgType: uint32(frame.Type)}
+	err := msg.unmarshal(frame.Payload)
+	if err != nil {
+		logger.Error("parse msg failed. err: %v", err)
+		return nil, err
+	}
+	if msg.DstDir != "" {
+		msg.DstDir = filepath.FromSlash(strings.ReplaceAll(msg.DstDir, "\\", "/"))
+	}
+	return msg, nil
+}
+
+func WriteForSyncMsg(fc FrameConn, msg *SyncCmdMsg) error {
+	err := fc.WriteFrame(uint8(msg.MsgType), 0, msg.marshal())
+	if err != nil {
+		logger.Error("write msg failed. err: %v", err)
+		return err
+	}
+	return nil
+}
+
+func ReadForSyncRespMsg(fc FrameConn) (*SyncRespMsg, error) {
+	frame, err := fc.ReadFrame()
+	if err != nil {
+		logger.Error("read msg failed. err: %v", err)
+		return nil, err
+	}
+	if frame.Type == MSG_FILEPART {
+		return nil, fmt.Errorf("unexpected file part frame")
+	}
+	// 解析消息
+	respMsg := &SyncRespMsg{MsgType: uint32(frame.Type)}
+	err = respMsg.unmarshal(frame.Payload)
+	if err != nil {
+		logger.Error("parse msg failed. err: %v", err)
+		return nil, err
+	}
+	return respMsg, nil
+}
+
+func WriteForSyncRespMsg(fc FrameConn, respMsg *SyncRespMsg) error {
+	return writeSyncRespMsg(fc, respMsg, false, 0, nil)
+}
+
+// writeSyncRespMsg 在 compress 为 true 时按 level 压缩消息负载
+func writeSyncRespMsg(fc FrameConn, respMsg *SyncRespMsg, compress bool, level int, stats *CompressStats) error {
+	var err error
+	if compress {
+		err = writeCompressedFrame(fc, uint8(respMsg.MsgType), respMsg.marshal(), level, stats)
+	} else {
+		err = fc.WriteFrame(uint8(respMsg.MsgType), 0, respMsg.marshal())
+	}
+	if err != nil {
+		logger.Error("write msg failed. err: %v", err)
+		return err
+	}
+	return nil
+}
+
+// writeFilePart 发送一段文件内容，负载为 8 字节偏移、4 字节 CRC32C 加数据
+func writeFilePart(fc FrameConn, offset int64, data []byte, compress bool, level int, stats *CompressStats) error {
+	payload := make([]byte, 12+len(data))
+	binary.BigEndian.PutUint64(payload, uint64(offset))
+	binary.BigEndian.PutUint32(payload[8:], crc32.Checksum(data, crcTable))
+	copy(payload[12:], data)
+	if compress {
+		return writeCompressedFrame(fc, MSG_FILEPART, payload, level, stats)
+	}
+	if stats != nil {
+		stats.add(len(payload), len(payload))
+	}
+	return fc.WriteFrame(MSG_FILEPART, 0, payload)
+}
+
+// readFilePart 读取一段文件内容，校验失败时仍返回偏移和数据，由调用方决定是否继续接收
+func readFilePart(fc FrameConn) (int64, []byte, error) {
+	frame, err := fc.ReadFrame()
+	if err != nil {
+		return 0, nil, err
+	}
+	return parseFilePart(frame)
+}
+
+func parseFilePart(frame *Frame) (int64, []byte, error) {
+	if frame.Type != MSG_FILEPART || len(frame.Payload) < 12 {
+		return 0, nil, fmt.Errorf("expect file part frame, got type %d", frame.Type)
+	}
+	offset := int64(binary.BigEndian.Uint64(frame.Payload))
+	data := frame.Payload[12:]
+	if crc32.Checksum(data, crcTable) != binary.BigEndian.Uint32(frame.Payload[8:]) {
+		return offset, data, ErrChunkChecksum
+	}
+	return offset, data, nil
+}
+
+func writeFileDone(fc FrameConn, sum []byte) error {
+	return fc.WriteFrame(MSG_FILEDONE, 0, sum)
+}
+
+func readFileDone(fc FrameConn) ([]byte, error) {
+	frame, err := fc.ReadFrame()
+	if err != nil {
+		return nil, err
+	}
+	return parseFileDone(frame)
+}
+
+func parseFileDone(frame *Frame) ([]byte, error) {
+	if frame.Type != MSG_FILEDONE || len(frame.Payload) != sha256.Size {
+		return nil, fmt.Errorf("expect file done frame, got type %d", frame.Type)
+	}
+	return frame.Payload, nil
+}
@@ -0,0 +1,104 @@
+package net
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+)
+
+// 帧标志位: 负载经过 gzip 压缩
+const frameCompressed = 0x01
+
+// 已经是压缩格式的文件，再压缩几乎没有收益
+var defaultSkipExts = []string{
+	".gz", ".tgz", ".zip", ".7z", ".rar", ".bz2", ".xz", ".zst", ".lz4",
+	".jpg", ".jpeg", ".png", ".gif", ".webp", ".heic",
+	".mp3", ".aac", ".flac", ".ogg", ".mp4", ".mkv", ".avi", ".mov", ".webm",
+	".docx", ".xlsx", ".pptx", ".apk", ".jar",
+}
+
+// CompressStats 记录压缩前后的字节数
+type CompressStats struct {
+	Raw  int64
+	Wire int64
+}
+
+func (s *CompressStats) add(raw int, wire int) {
+	atomic.AddInt64(&s.Raw, int64(raw))
+	atomic.AddInt64(&s.Wire, int64(wire))
+}
+
+func (s *CompressStats) Load() (raw int64, wire int64) {
+	return atomic.LoadInt64(&s.Raw), atomic.LoadInt64(&s.Wire)
+}
+
+// shouldCompress 按扩展名判断文件是否值得压缩，skipExts 为空时使用默认列表
+func shouldCompress(path string, skipExts []string) bool {
+	ext := strings.ToLower(filepath.Ext(path))
+	if len(skipExts) == 0 {
+		skipExts = defaultSkipExts
+	}
+	for _, skip := range skipExts {
+		if ext == strings.ToLower(skip) {
+			return false
+		}
+	}
+	return true
+}
+
+func compressLevel(level int) int {
+	if level == 0 || level < gzip.HuffmanOnly || level > gzip.BestCompression {
+		return gzip.DefaultCompression
+	}
+	return level
+}
+
+func compressPayload(payload []byte, level int) ([]byte, error) {
+	var buf bytes.Buffer
+	zw, err := gzip.NewWriterLevel(&buf, compressLevel(level))
+	if err != nil {
+		return nil, err
+	}
+	if _, err := zw.Write(payload); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func decompressPayload(payload []byte) ([]byte, error) {
+	zr, err := gzip.NewReader(bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	// 解压后同样受帧大小限制，防止压缩炸弹
+	data, err := io.ReadAll(io.LimitReader(zr, MaxFrameSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > MaxFrameSize {
+		return nil, ErrFrameTooLarge
+	}
+	return data, nil
+}
+
+// writeCompressedFrame 压缩后更小时以压缩形式发送，否则发送原始负载
+func writeCompressedFrame(fc FrameConn, frameType uint8, payload []byte, level int, stats *CompressStats) error {
+	wire := payload
+	flags := uint8(0)
+	compressed, err := compressPayload(payload, level)
+	if err == nil && len(compressed) < len(payload) {
+		wire = compressed
+		flags = frameCompressed
+	}
+	if stats != nil {
+		stats.add(len(payload), len(wire))
+	}
+	return fc.WriteFrame(frameType, flags, wire)
+}
@@ -0,0 +1,243 @@
+package net
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"time"
+
+	"stacktrace.top/filesync/sync"
+)
+
+// 帧头: magic(2) + 类型(1) + 标志(1) + 流ID(4) + 负载长度(4)
+const (
+	frameMagic      = 0x4653
+	frameHeaderSize = 12
+	// 单帧负载上限，防止对端给出恶意长度导致大内存分配
+	MaxFrameSize = 8 * 1024 * 1024
+	// 单个数据帧携带的文件内容上限
+	maxDataChunk = 4 * 1024 * 1024
+	// 目录列表每帧携带的条目数
+	fileListBatch = 512
+)
+
+var ErrFrameTooLarge = errors.New("frame too large")
+var ErrBadMagic = errors.New("bad frame magic")
+
+type Frame struct {
+	Type    uint8
+	Flags   uint8
+	Stream  uint32
+	Payload []byte
+}
+
+// FrameConn 是按帧读写的连接，多路复用会话中的流实现了该接口
+type FrameConn interface {
+	ReadFrame() (*Frame, error)
+	WriteFrame(frameType uint8, flags uint8, payload []byte) error
+}
+
+func WriteFrame(w io.Writer, frame *Frame) error {
+	if len(frame.Payload) > MaxFrameSize {
+		return ErrFrameTooLarge
+	}
+	buf := make([]byte, frameHeaderSize+len(frame.Payload))
+	binary.BigEndian.PutUint16(buf[0:2], frameMagic)
+	buf[2] = frame.Type
+	buf[3] = frame.Flags
+	binary.BigEndian.PutUint32(buf[4:8], frame.Stream)
+	binary.BigEndian.PutUint32(buf[8:12], uint32(len(frame.Payload)))
+	copy(buf[frameHeaderSize:], frame.Payload)
+	_, err := w.Write(buf)
+	return err
+}
+
+func ReadFrame(r io.Reader) (*Frame, error) {
+	var header [frameHeaderSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+	if binary.BigEndian.Uint16(header[0:2]) != frameMagic {
+		return nil, ErrBadMagic
+	}
+	length := binary.BigEndian.Uint32(header[8:12])
+	if length > MaxFrameSize {
+		return nil, ErrFrameTooLarge
+	}
+	frame := &Frame{
+		Type:    header[2],
+		Flags:   header[3],
+		Stream:  binary.BigEndian.Uint32(header[4:8]),
+		Payload: make([]byte, length),
+	}
+	if _, err := io.ReadFull(r, frame.Payload); err != nil {
+		return nil, err
+	}
+	return frame, nil
+}
+
+// decompress 解压带压缩标志的帧负载
+func (frame *Frame) decompress() error {
+	if frame.Flags&frameCompressed == 0 {
+		return nil
+	}
+	payload, err := decompressPayload(frame.Payload)
+	if err != nil {
+		return err
+	}
+	frame.Payload = payload
+	frame.Flags &^= frameCompressed
+	return nil
+}
+
+// encoder 按大端序把消息字段编码为二进制
+type encoder struct {
+	buf bytes.Buffer
+}
+
+func (e *encoder) uint8(v uint8) {
+	e.buf.WriteByte(v)
+}
+
+func (e *encoder) uint32(v uint32) {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], v)
+	e.buf.Write(b[:])
+}
+
+func (e *encoder) int64(v int64) {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], uint64(v))
+	e.buf.Write(b[:])
+}
+
+func (e *encoder) bool(v bool) {
+	if v {
+		e.uint8(1)
+	} else {
+		e.uint8(0)
+	}
+}
+
+func (e *encoder) bytes(v []byte) {
+	e.uint32(uint32(len(v)))
+	e.buf.Write(v)
+}
+
+func (e *encoder) string(v string) {
+	e.bytes([]byte(v))
+}
+
+func (e *encoder) time(v time.Time) {
+	e.int64(v.UnixNano())
+}
+
+func (e *encoder) fileInfo(info *sync.SyncFileInfo) {
+	if info == nil {
+		e.bool(false)
+		return
+	}
+	e.bool(true)
+	e.string(info.Name)
+	e.int64(info.Size)
+	e.time(info.ModTime)
+	e.uint32(uint32(info.Mode))
+	e.bool(info.IsDir)
+	e.string(info.Hash)
+}
+
+// decoder 与 encoder 对应，出错后后续读取均返回零值，最后统一检查 err
+type decoder struct {
+	data []byte
+	err  error
+}
+
+func (d *decoder) next(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if n < 0 || n > len(d.data) {
+		d.err = io.ErrUnexpectedEOF
+		return nil
+	}
+	b := d.data[:n]
+	d.data = d.data[n:]
+	return b
+}
+
+func (d *decoder) uint8() uint8 {
+	b := d.next(1)
+	if b == nil {
+		return 0
+	}
+	return b[0]
+}
+
+func (d *decoder) uint32() uint32 {
+	b := d.next(4)
+	if b == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint32(b)
+}
+
+func (d *decoder) int64() int64 {
+	b := d.next(8)
+	if b == nil {
+		return 0
+	}
+	return int64(binary.BigEndian.Uint64(b))
+}
+
+func (d *decoder) bool() bool {
+	return d.uint8() != 0
+}
+
+func (d *decoder) bytes() []byte {
+	n := d.uint32()
+	if n > math.MaxInt32 {
+		d.err = ErrFrameTooLarge
+		return nil
+	}
+	b := d.next(int(n))
+	if b == nil {
+		return nil
+	}
+	return append([]byte(nil), b...)
+}
+
+func (d *decoder) string() string {
+	return string(d.bytes())
+}
+
+func (d *decoder) time() time.Time {
+	return time.Unix(0, d.int64())
+}
+
+func (d *decoder) fileInfo() *sync.SyncFileInfo {
+	if !d.bool() {
+		return nil
+	}
+	return &sync.SyncFileInfo{
+		Name:    d.string(),
+		Size:    d.int64(),
+		ModTime: d.time(),
+		Mode:    os.FileMode(d.uint32()),
+		IsDir:   d.bool(),
+		Hash:    d.string(),
+	}
+}
+
+func (d *decoder) finish() error {
+	if d.err != nil {
+		return d.err
+	}
+	if len(d.data) != 0 {
+		return fmt.Errorf("%d trailing bytes in payload", len(d.data))
+	}
+	return nil
+}
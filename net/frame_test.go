@@ -0,0 +1,273 @@
+package net
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"stacktrace.top/filesync/sync"
+)
+
+func testInfo(name string) *sync.SyncFileInfo {
+	return &sync.SyncFileInfo{Name: name, Size: 1234, ModTime: time.Unix(1600000000, 123456789), Mode: 0640, Hash: "abcdef"}
+}
+
+func sameInfo(a *sync.SyncFileInfo, b *sync.SyncFileInfo) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.Name == b.Name && a.Size == b.Size && a.ModTime.Equal(b.ModTime) && a.Mode == b.Mode && a.IsDir == b.IsDir && a.Hash == b.Hash
+}
+
+func sameInfos(a map[string]*sync.SyncFileInfo, b map[string]*sync.SyncFileInfo) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if !sameInfo(v, b[k]) {
+			return false
+		}
+	}
+	return true
+}
+
+func TestFrameRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	frames := []*Frame{
+		{Type: MSG_SYNC, Flags: frameCompressed, Stream: 7, Payload: []byte("payload")},
+		{Type: MSG_CLOSE, Stream: 1<<32 - 1},
+		{Type: MSG_FILEPART, Payload: make([]byte, MaxFrameSize)},
+	}
+	for _, frame := range frames {
+		if err := WriteFrame(&buf, frame); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, want := range frames {
+		got, err := ReadFrame(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Type != want.Type || got.Flags != want.Flags || got.Stream != want.Stream || !bytes.Equal(got.Payload, want.Payload) {
+			t.Fatalf("frame type %v differs", want.Type)
+		}
+	}
+	if _, err := ReadFrame(&buf); err != io.EOF {
+		t.Fatalf("end: %v", err)
+	}
+}
+
+func TestMessageRoundTrip(t *testing.T) {
+	cmd := &SyncCmdMsg{Token: "token", DstDir: filepath.Join("a", "b"), SyncInfo: testInfo("f"), Compress: true, WithHash: true}
+	gotCmd := &SyncCmdMsg{}
+	if err := gotCmd.unmarshal(cmd.marshal()); err != nil {
+		t.Fatal(err)
+	}
+	if gotCmd.Token != cmd.Token || gotCmd.DstDir != cmd.DstDir || !sameInfo(gotCmd.SyncInfo, cmd.SyncInfo) || !gotCmd.Compress || !gotCmd.WithHash {
+		t.Fatalf("cmd: %+v", gotCmd)
+	}
+
+	dir := testInfo("d")
+	dir.IsDir = true
+	resp := &SyncRespMsg{
+		ResCode:   RES_CHECKSUM,
+		Err:       "err",
+		OffSet:    -1,
+		PartSize:  1 << 40,
+		FileInfos: map[string]*sync.SyncFileInfo{"f": testInfo("f"), filepath.Join("d", "e"): dir, "nil": nil},
+		Compress:  true,
+		Failed:    map[string]string{"x": "failed"},
+	}
+	gotResp := &SyncRespMsg{}
+	if err := gotResp.unmarshal(resp.marshal()); err != nil {
+		t.Fatal(err)
+	}
+	if gotResp.ResCode != resp.ResCode || gotResp.Err != resp.Err || gotResp.OffSet != resp.OffSet || gotResp.PartSize != resp.PartSize ||
+		!sameInfos(gotResp.FileInfos, map[string]*sync.SyncFileInfo{"f": testInfo("f"), "d/e": dir, "nil": nil}) ||
+		!gotResp.Compress || gotResp.Failed["x"] != "failed" || len(gotResp.Failed) != 1 {
+		t.Fatalf("resp: %+v", gotResp)
+	}
+
+	batch := &SyncBatchMsg{Entries: []*BatchEntry{
+		{DstPath: filepath.Join("dst", "f"), FileInfo: testInfo("f"), Data: []byte("data"), Sum: []byte("sum")},
+		{DstPath: "dir", FileInfo: dir},
+	}}
+	gotBatch := &SyncBatchMsg{}
+	if err := gotBatch.unmarshal(batch.marshal()); err != nil {
+		t.Fatal(err)
+	}
+	if len(gotBatch.Entries) != 2 {
+		t.Fatalf("batch: %v entries", len(gotBatch.Entries))
+	}
+	for i, want := range batch.Entries {
+		got := gotBatch.Entries[i]
+		if got.DstPath != want.DstPath || !sameInfo(got.FileInfo, want.FileInfo) || !bytes.Equal(got.Data, want.Data) || !bytes.Equal(got.Sum, want.Sum) {
+			t.Fatalf("batch entry %v: %+v", i, got)
+		}
+	}
+
+	snapshot := &SyncSnapshotMsg{Op: SNAPSHOT_LINK, Dir: "/s/new", From: "/s/old", Entries: map[string]*sync.SyncFileInfo{"f": testInfo("f")}}
+	gotSnapshot := &SyncSnapshotMsg{}
+	if err := gotSnapshot.unmarshal(snapshot.marshal()); err != nil {
+		t.Fatal(err)
+	}
+	if gotSnapshot.Op != snapshot.Op || gotSnapshot.Dir != filepath.FromSlash(snapshot.Dir) || gotSnapshot.From != filepath.FromSlash(snapshot.From) ||
+		!sameInfos(gotSnapshot.Entries, snapshot.Entries) {
+		t.Fatalf("snapshot: %+v", gotSnapshot)
+	}
+
+	fsMsg := &SyncFSMsg{Op: FS_WRITE, Path: "/repo/a", NewPath: "/repo/b", Mode: 0600, ModTime: time.Unix(1, 2), Size: -1}
+	gotFS := &SyncFSMsg{}
+	if err := gotFS.unmarshal(fsMsg.marshal()); err != nil {
+		t.Fatal(err)
+	}
+	if gotFS.Op != fsMsg.Op || gotFS.Path != filepath.FromSlash(fsMsg.Path) || gotFS.NewPath != filepath.FromSlash(fsMsg.NewPath) ||
+		gotFS.Mode != fsMsg.Mode || !gotFS.ModTime.Equal(fsMsg.ModTime) || gotFS.Size != fsMsg.Size {
+		t.Fatalf("fs: %+v", gotFS)
+	}
+}
+
+func TestFilePartRoundTrip(t *testing.T) {
+	conn := newPipeConn()
+	data := bytes.Repeat([]byte("abc"), 1000)
+	go func() {
+		writeFilePart(conn, 42, data, false, 0, nil)
+		writeFilePart(conn, 0, data, true, 0, nil)
+		writeFileDone(conn, make([]byte, 32))
+	}()
+	for _, want := range []int64{42, 0} {
+		offset, got, err := readFilePart(conn)
+		if err != nil || offset != want || !bytes.Equal(got, data) {
+			t.Fatalf("part: %v %v %v", offset, len(got), err)
+		}
+	}
+	if sum, err := readFileDone(conn); err != nil || len(sum) != 32 {
+		t.Fatalf("done: %v %v", sum, err)
+	}
+}
+
+// pipeConn 把写入的帧交给之后的读取，读取时与会话的流一样解压负载
+type pipeConn struct {
+	frames chan *Frame
+}
+
+func newPipeConn() *pipeConn {
+	return &pipeConn{frames: make(chan *Frame, 16)}
+}
+
+func (c *pipeConn) ReadFrame() (*Frame, error) {
+	frame := <-c.frames
+	return frame, frame.decompress()
+}
+
+func (c *pipeConn) WriteFrame(frameType uint8, flags uint8, payload []byte) error {
+	c.frames <- &Frame{Type: frameType, Flags: flags, Payload: payload}
+	return nil
+}
+
+func TestMalformedFrames(t *testing.T) {
+	if err := WriteFrame(io.Discard, &Frame{Payload: make([]byte, MaxFrameSize+1)}); err != ErrFrameTooLarge {
+		t.Fatalf("write oversized: %v", err)
+	}
+
+	header := func(magic uint16, length uint32) []byte {
+		b := make([]byte, frameHeaderSize)
+		binary.BigEndian.PutUint16(b, magic)
+		binary.BigEndian.PutUint32(b[8:], length)
+		return b
+	}
+	cases := []struct {
+		name string
+		data []byte
+		err  error
+	}{
+		{"bad magic", header(0x1234, 0), ErrBadMagic},
+		{"oversized length", header(frameMagic, MaxFrameSize+1), ErrFrameTooLarge},
+		{"truncated header", header(frameMagic, 0)[:5], io.ErrUnexpectedEOF},
+		{"truncated payload", append(header(frameMagic, 10), 1, 2, 3), io.ErrUnexpectedEOF},
+	}
+	for _, c := range cases {
+		if _, err := ReadFrame(bytes.NewReader(c.data)); err != c.err {
+			t.Errorf("%v: %v", c.name, err)
+		}
+	}
+}
+
+func TestMalformedPayloads(t *testing.T) {
+	full := (&SyncRespMsg{FileInfos: map[string]*sync.SyncFileInfo{"f": testInfo("f")}}).marshal()
+	// 截断的负载在任何位置都返回错误
+	for i := 0; i < len(full); i++ {
+		if err := (&SyncRespMsg{}).unmarshal(full[:i]); err == nil {
+			t.Fatalf("truncated at %v accepted", i)
+		}
+	}
+	if err := (&SyncRespMsg{}).unmarshal(append(full, 0)); err == nil {
+		t.Fatal("trailing byte accepted")
+	}
+
+	count := func(prefix []byte, n uint32) []byte {
+		return binary.BigEndian.AppendUint32(prefix, n)
+	}
+	resp := &encoder{}
+	resp.int64(0)
+	resp.string("")
+	resp.int64(0)
+	resp.int64(0)
+	if err := (&SyncRespMsg{}).unmarshal(count(resp.buf.Bytes(), 1<<31)); err == nil {
+		t.Fatal("oversized file info count accepted")
+	}
+	if err := (&SyncBatchMsg{}).unmarshal(count(nil, maxBatchEntries+1)); err == nil {
+		t.Fatal("oversized batch count accepted")
+	}
+	if err := (&SyncSnapshotMsg{}).unmarshal(count([]byte{0, 0, 0, 0, 0, 0, 0, 0, 0}, maxBatchEntries+1)); err == nil {
+		t.Fatal("oversized snapshot count accepted")
+	}
+	// 字符串长度超过剩余数据
+	if err := (&SyncCmdMsg{}).unmarshal(count(nil, 1<<30)); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("oversized string: %v", err)
+	}
+	if err := (&SyncCmdMsg{}).unmarshal(count(nil, 1<<31)); err != ErrFrameTooLarge {
+		t.Fatalf("string length over MaxInt32: %v", err)
+	}
+
+	// 分片的 CRC 不符
+	part := &Frame{Type: MSG_FILEPART, Payload: make([]byte, 13)}
+	if _, _, err := parseFilePart(part); err != ErrChunkChecksum {
+		t.Fatalf("chunk crc: %v", err)
+	}
+	if _, _, err := parseFilePart(&Frame{Type: MSG_FILEPART, Payload: make([]byte, 11)}); err == nil {
+		t.Fatal("short file part accepted")
+	}
+	if _, err := parseFileDone(&Frame{Type: MSG_FILEDONE, Payload: make([]byte, 31)}); err == nil {
+		t.Fatal("short file done accepted")
+	}
+}
+
+// 解压后超过帧大小上限的负载被拒绝
+func TestGzipBomb(t *testing.T) {
+	bomb, err := compressPayload(make([]byte, MaxFrameSize+1), 9)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bomb) > MaxFrameSize/100 {
+		t.Fatalf("bomb is %v bytes", len(bomb))
+	}
+	frame := &Frame{Type: MSG_FILEPART, Flags: frameCompressed, Payload: bomb}
+	if err := frame.decompress(); err != ErrFrameTooLarge {
+		t.Fatalf("decompress: %v", err)
+	}
+	// 恰好达到上限的负载可以解压
+	ok, _ := compressPayload(make([]byte, MaxFrameSize), 9)
+	frame = &Frame{Type: MSG_FILEPART, Flags: frameCompressed, Payload: ok}
+	if err := frame.decompress(); err != nil || len(frame.Payload) != MaxFrameSize {
+		t.Fatalf("decompress limit: %v", err)
+	}
+	frame = &Frame{Type: MSG_FILEPART, Flags: frameCompressed, Payload: []byte("not gzip")}
+	if err := frame.decompress(); err == nil {
+		t.Fatal("invalid gzip accepted")
+	}
+}
@@ -0,0 +1,224 @@
+package net
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	gosync "sync"
+	"sync/atomic"
+	"time"
+
+	"stacktrace.top/filesync/logger"
+)
+
+// 使用 Server.Token 登录的账号名
+const defaultAccount = "default"
+
+// makecache 扫描耗时的直方图分桶，单位秒
+var scanBuckets = []float64{0.1, 0.5, 1, 5, 10, 30, 60, 300}
+
+type accountMetrics struct {
+	connections   int64
+	bytesReceived int64
+	filesWritten  int64
+	writeErrors   int64
+	lastActivity  time.Time
+}
+
+// serverMetrics 汇总 daemon 的运行指标，以 Prometheus 文本格式输出
+type serverMetrics struct {
+	activeConns   int64
+	totalConns    int64
+	authFailures  int64
+	bytesReceived int64
+	filesWritten  int64
+	writeErrors   int64
+
+	mu           gosync.Mutex
+	lastWrite    time.Time
+	scanCount    int64
+	scanSum      float64
+	scanBuckets  []int64
+	lastScan     float64
+	accountStats map[string]*accountMetrics
+}
+
+func newServerMetrics() *serverMetrics {
+	return &serverMetrics{
+		scanBuckets:  make([]int64, len(scanBuckets)),
+		accountStats: make(map[string]*accountMetrics),
+	}
+}
+
+// authenticate 校验 token，返回对应的账号名
+func (srv *Server) authenticate(token string) (string, bool) {
+	if tokenEqual(token, srv.conf.Server.Token) {
+		return defaultAccount, true
+	}
+	for name, accountToken := range srv.conf.Server.Accounts {
+		if accountToken != "" && tokenEqual(token, accountToken) {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+func tokenEqual(a string, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+// account 返回账号的统计项，调用方需持有锁
+func (m *serverMetrics) account(name string) *accountMetrics {
+	a, ok := m.accountStats[name]
+	if !ok {
+		a = &accountMetrics{}
+		m.accountStats[name] = a
+	}
+	return a
+}
+
+func (m *serverMetrics) connOpened() {
+	atomic.AddInt64(&m.activeConns, 1)
+	atomic.AddInt64(&m.totalConns, 1)
+}
+
+func (m *serverMetrics) connClosed() {
+	atomic.AddInt64(&m.activeConns, -1)
+}
+
+func (m *serverMetrics) authFailed() {
+	atomic.AddInt64(&m.authFailures, 1)
+}
+
+func (m *serverMetrics) loggedIn(account string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	a := m.account(account)
+	a.connections++
+	a.lastActivity = time.Now()
+}
+
+// bytesRead 记录从连接上读到的文件内容字节数，包括之后写入失败、校验失败和重传的数据
+func (m *serverMetrics) bytesRead(account string, n int64) {
+	atomic.AddInt64(&m.bytesReceived, n)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	a := m.account(account)
+	a.bytesReceived += n
+	a.lastActivity = time.Now()
+}
+
+// fileWritten 记录一个文件写入完成
+func (m *serverMetrics) fileWritten(account string) {
+	atomic.AddInt64(&m.filesWritten, 1)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	m.lastWrite = now
+	a := m.account(account)
+	a.filesWritten++
+	a.lastActivity = now
+}
+
+func (m *serverMetrics) writeFailed(account string) {
+	atomic.AddInt64(&m.writeErrors, 1)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	a := m.account(account)
+	a.writeErrors++
+	a.lastActivity = time.Now()
+}
+
+func (m *serverMetrics) scanDone(elapsed time.Duration) {
+	seconds := elapsed.Seconds()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.scanCount++
+	m.scanSum += seconds
+	m.lastScan = seconds
+	for i, bound := range scanBuckets {
+		if seconds <= bound {
+			m.scanBuckets[i]++
+		}
+	}
+}
+
+func unixSeconds(t time.Time) float64 {
+	if t.IsZero() {
+		return 0
+	}
+	return float64(t.UnixNano()) / 1e9
+}
+
+// escapeLabel 按 Prometheus 文本格式转义标签值
+func escapeLabel(v string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(v)
+}
+
+func (m *serverMetrics) writeTo(w io.Writer) {
+	metric := func(name, kind, help string, value any) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %v\n", name, help, name, kind, name, value)
+	}
+	metric("filesync_active_connections", "gauge", "Client sessions currently connected.", atomic.LoadInt64(&m.activeConns))
+	metric("filesync_connections_total", "counter", "Client sessions accepted.", atomic.LoadInt64(&m.totalConns))
+	metric("filesync_auth_failures_total", "counter", "Handshakes rejected because of an invalid token.", atomic.LoadInt64(&m.authFailures))
+	metric("filesync_bytes_received_total", "counter", "File content bytes received from clients, including failed and retried transfers.", atomic.LoadInt64(&m.bytesReceived))
+	metric("filesync_files_written_total", "counter", "Files written to disk.", atomic.LoadInt64(&m.filesWritten))
+	metric("filesync_write_errors_total", "counter", "Files or directories that failed to be written.", atomic.LoadInt64(&m.writeErrors))
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	metric("filesync_last_write_timestamp_seconds", "gauge", "Unix time of the last file written, 0 if none.", unixSeconds(m.lastWrite))
+	metric("filesync_makecache_last_duration_seconds", "gauge", "Duration of the last makecache directory scan.", m.lastScan)
+
+	name := "filesync_makecache_duration_seconds"
+	fmt.Fprintf(w, "# HELP %s Duration of makecache directory scans.\n# TYPE %s histogram\n", name, name)
+	for i, bound := range scanBuckets {
+		fmt.Fprintf(w, "%s_bucket{le=\"%v\"} %d\n", name, bound, m.scanBuckets[i])
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n%s_sum %v\n%s_count %d\n", name, m.scanCount, name, m.scanSum, name, m.scanCount)
+
+	names := make([]string, 0, len(m.accountStats))
+	for account := range m.accountStats {
+		names = append(names, account)
+	}
+	sort.Strings(names)
+	accountMetric := func(name, kind, help string, value func(a *accountMetrics) any) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+		for _, account := range names {
+			fmt.Fprintf(w, "%s{account=\"%s\"} %v\n", name, escapeLabel(account), value(m.accountStats[account]))
+		}
+	}
+	accountMetric("filesync_account_connections_total", "counter", "Authenticated sessions per account.",
+		func(a *accountMetrics) any { return a.connections })
+	accountMetric("filesync_account_bytes_received_total", "counter", "File content bytes received per account, including failed and retried transfers.",
+		func(a *accountMetrics) any { return a.bytesReceived })
+	accountMetric("filesync_account_files_written_total", "counter", "Files written per account.",
+		func(a *accountMetrics) any { return a.filesWritten })
+	accountMetric("filesync_account_write_errors_total", "counter", "Write failures per account.",
+		func(a *accountMetrics) any { return a.writeErrors })
+	accountMetric("filesync_account_last_activity_timestamp_seconds", "gauge", "Unix time of the last activity per account.",
+		func(a *accountMetrics) any { return unixSeconds(a.lastActivity) })
+}
+
+// startMetricsServer 配置了监听地址时启动指标 HTTP 服务
+func (srv *Server) startMetricsServer() {
+	addr := srv.conf.Server.Metricsaddr
+	if addr == "" {
+		return
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		srv.metrics.writeTo(w)
+	})
+	go func() {
+		logger.Info("metrics server listening on %v", addr)
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			logger.Error("start metrics server failed. addr: %v, err: %v", addr, err)
+		}
+	}()
+}
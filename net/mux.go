@@ -0,0 +1,435 @@
+package net
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+)
+
+const (
+	// 流控窗口更新，负载为 4 字节的增量
+	MSG_WINDOW = 6
+	// 关闭流
+	MSG_CLOSE = 7
+	// 新建流，保证对端按 ID 递增的顺序看到新流
+	MSG_OPEN = 5
+)
+
+// 每个流初始的发送窗口，流上的所有帧按负载长度占用窗口，对端读取后归还
+const streamWindow = 8 * 1024 * 1024
+
+// 等待 Accept 的新流上限，超过时直接关闭新流，不阻塞读循环
+const acceptBacklog = 64
+
+// 一个会话中同时打开的流上限
+const maxSessionStreams = 1024
+
+// 流上未读取的帧数上限，空负载的帧不占窗口，单独限制数量
+const maxQueuedFrames = 65536
+
+var ErrSessionClosed = errors.New("session closed")
+var ErrStreamClosed = errors.New("stream closed")
+
+// ErrWindowExceeded 表示对端发送的数据超过了流控窗口，会话随即关闭
+var ErrWindowExceeded = errors.New("peer exceeded stream window")
+
+// ErrUnauthenticated 表示对端在握手完成前发送了握手以外的帧
+var ErrUnauthenticated = errors.New("frame before authentication")
+
+var errControlOverflow = errors.New("control frame queue overflow")
+
+// Session 在一条 TCP 连接上承载多个逻辑流。
+// 流 0 用于握手，客户端发起的流使用奇数 ID。
+type Session struct {
+	conn    net.Conn
+	client  bool
+	writeMu sync.Mutex
+
+	mu      sync.Mutex
+	streams map[uint32]*Stream
+	nextID  uint32
+	maxID   uint32
+	err     error
+
+	accept chan *Stream
+	// 读循环产生的控制帧由写协程发送，读循环不会因写入阻塞
+	control chan *Frame
+	// 服务端在握手成功前只接受流 0 上的一个 MSG_TOKEN 帧
+	authed    bool
+	tokenSeen bool
+	done      chan struct{}
+	closeOnce sync.Once
+	// 所属实例的限速和单连接限速
+	limits  *rateLimits
+	limiter *RateLimiter
+}
+
+func newSession(conn net.Conn, client bool, limits *rateLimits) *Session {
+	session := &Session{
+		conn:    conn,
+		client:  client,
+		streams: make(map[uint32]*Stream),
+		nextID:  1,
+		accept:  make(chan *Stream, acceptBacklog),
+		control: make(chan *Frame, acceptBacklog),
+		done:    make(chan struct{}),
+		limits:  limits,
+		limiter: newRateLimiter(&limits.perConn),
+	}
+	session.streams[0] = newStream(session, 0)
+	go session.readLoop()
+	go session.controlLoop()
+	return session
+}
+
+// authenticated 在服务端握手成功后调用，之后才接受其他帧和新流
+func (session *Session) authenticated() {
+	session.mu.Lock()
+	defer session.mu.Unlock()
+	session.authed = true
+}
+
+// checkAuth 检查服务端握手前收到的帧，只允许流 0 上的一个 MSG_TOKEN
+func (session *Session) checkAuth(frame *Frame) error {
+	session.mu.Lock()
+	defer session.mu.Unlock()
+	if session.client || session.authed {
+		return nil
+	}
+	if frame.Stream != 0 || frame.Type != MSG_TOKEN || session.tokenSeen {
+		return ErrUnauthenticated
+	}
+	session.tokenSeen = true
+	return nil
+}
+
+func (session *Session) controlLoop() {
+	for {
+		select {
+		case frame := <-session.control:
+			if session.writeFrame(frame) != nil {
+				return
+			}
+		case <-session.done:
+			return
+		}
+	}
+}
+
+// sendControl 把控制帧交给写协程，队列满说明对端持续发起请求却不读取，关闭会话
+func (session *Session) sendControl(frame *Frame) {
+	select {
+	case session.control <- frame:
+	default:
+		session.shutdown(errControlOverflow)
+	}
+}
+
+// ControlStream 返回用于握手的流 0
+func (session *Session) ControlStream() *Stream {
+	session.mu.Lock()
+	defer session.mu.Unlock()
+	return session.streams[0]
+}
+
+// OpenStream 分配 ID 并发送 MSG_OPEN，两者在写锁内完成，
+// 避免多个协程同时建流时较大的 ID 先到达对端、较小 ID 的流被当作迟到帧丢弃
+func (session *Session) OpenStream() (*Stream, error) {
+	session.writeMu.Lock()
+	defer session.writeMu.Unlock()
+	session.mu.Lock()
+	if session.err != nil {
+		err := session.err
+		session.mu.Unlock()
+		return nil, err
+	}
+	stream := newStream(session, session.nextID)
+	session.streams[stream.id] = stream
+	session.nextID += 2
+	session.mu.Unlock()
+	if err := WriteFrame(session.conn, &Frame{Type: MSG_OPEN, Stream: stream.id}); err != nil {
+		session.shutdown(err)
+		return nil, err
+	}
+	return stream, nil
+}
+
+// Accept 等待对端新建的流
+func (session *Session) Accept() (*Stream, error) {
+	select {
+	case stream := <-session.accept:
+		return stream, nil
+	case <-session.done:
+		return nil, session.Err()
+	}
+}
+
+func (session *Session) Err() error {
+	session.mu.Lock()
+	defer session.mu.Unlock()
+	return session.err
+}
+
+func (session *Session) RemoteAddr() net.Addr {
+	return session.conn.RemoteAddr()
+}
+
+func (session *Session) Close() error {
+	session.shutdown(ErrSessionClosed)
+	return nil
+}
+
+func (session *Session) shutdown(err error) {
+	session.closeOnce.Do(func() {
+		session.mu.Lock()
+		session.err = err
+		streams := session.streams
+		session.streams = make(map[uint32]*Stream)
+		session.mu.Unlock()
+		close(session.done)
+		session.conn.Close()
+		for _, stream := range streams {
+			stream.remoteClose(err)
+		}
+	})
+}
+
+// throttle 对数据帧同时应用全局与单连接限速
+func (session *Session) throttle(n int) {
+	session.limits.refresh()
+	session.limits.limiter.WaitN(n)
+	session.limiter.WaitN(n)
+}
+
+func (session *Session) writeFrame(frame *Frame) error {
+	session.writeMu.Lock()
+	defer session.writeMu.Unlock()
+	if err := session.Err(); err != nil {
+		return err
+	}
+	err := WriteFrame(session.conn, frame)
+	if err != nil {
+		session.shutdown(err)
+	}
+	return err
+}
+
+func (session *Session) getStream(id uint32) *Stream {
+	session.mu.Lock()
+	defer session.mu.Unlock()
+	return session.streams[id]
+}
+
+func (session *Session) removeStream(id uint32) {
+	session.mu.Lock()
+	defer session.mu.Unlock()
+	delete(session.streams, id)
+}
+
+// acceptStream 为对端新发起的流建立本地状态，重复或非法的 ID 返回 nil。
+// 等待 Accept 的流已满或打开的流过多时关闭新流，对端在该流上读到 EOF 后按失败重试
+func (session *Session) acceptStream(id uint32) *Stream {
+	session.mu.Lock()
+	if session.client || id%2 == 0 || id <= session.maxID || session.err != nil {
+		session.mu.Unlock()
+		return nil
+	}
+	session.maxID = id
+	if len(session.streams) >= maxSessionStreams {
+		session.mu.Unlock()
+		session.sendControl(&Frame{Type: MSG_CLOSE, Stream: id})
+		return nil
+	}
+	stream := newStream(session, id)
+	session.streams[id] = stream
+	session.mu.Unlock()
+	select {
+	case session.accept <- stream:
+		return stream
+	default:
+		session.removeStream(id)
+		session.sendControl(&Frame{Type: MSG_CLOSE, Stream: id})
+		return nil
+	}
+}
+
+func (session *Session) readLoop() {
+	for {
+		frame, err := ReadFrame(session.conn)
+		if err != nil {
+			session.shutdown(err)
+			return
+		}
+		if err := session.checkAuth(frame); err != nil {
+			session.shutdown(err)
+			return
+		}
+		stream := session.getStream(frame.Stream)
+		switch frame.Type {
+		case MSG_WINDOW:
+			if stream != nil && len(frame.Payload) == 4 {
+				stream.addWindow(int64(binary.BigEndian.Uint32(frame.Payload)))
+			}
+		case MSG_CLOSE:
+			if stream != nil {
+				session.removeStream(stream.id)
+				stream.remoteClose(io.EOF)
+			}
+		case MSG_OPEN:
+			if stream == nil {
+				session.acceptStream(frame.Stream)
+			}
+		default:
+			// 未打开或已关闭的流的帧直接丢弃
+			if stream != nil {
+				if err := stream.push(frame); err != nil {
+					session.shutdown(err)
+					return
+				}
+			}
+		}
+	}
+}
+
+// Stream 是会话中的一个逻辑流，按帧读写
+type Stream struct {
+	id      uint32
+	session *Session
+
+	mu    sync.Mutex
+	cond  *sync.Cond
+	queue []*Frame
+	// 队列中帧的负载字节数，不超过给对端的窗口
+	queued int64
+	window int64
+	closed bool
+	err    error
+}
+
+func newStream(session *Session, id uint32) *Stream {
+	stream := &Stream{
+		id:      id,
+		session: session,
+		window:  streamWindow,
+	}
+	stream.cond = sync.NewCond(&stream.mu)
+	return stream
+}
+
+func (stream *Stream) ID() uint32 {
+	return stream.id
+}
+
+func (stream *Stream) Session() *Session {
+	return stream.session
+}
+
+// push 把收到的帧放入队列，对端超过窗口时返回 ErrWindowExceeded
+func (stream *Stream) push(frame *Frame) error {
+	stream.mu.Lock()
+	defer stream.mu.Unlock()
+	if stream.closed {
+		return nil
+	}
+	size := int64(len(frame.Payload))
+	if stream.queued+size > streamWindow || len(stream.queue) >= maxQueuedFrames {
+		return ErrWindowExceeded
+	}
+	stream.queued += size
+	stream.queue = append(stream.queue, frame)
+	stream.cond.Broadcast()
+	return nil
+}
+
+func (stream *Stream) addWindow(n int64) {
+	stream.mu.Lock()
+	defer stream.mu.Unlock()
+	stream.window += n
+	stream.cond.Broadcast()
+}
+
+func (stream *Stream) remoteClose(err error) {
+	stream.mu.Lock()
+	defer stream.mu.Unlock()
+	if !stream.closed {
+		stream.closed = true
+		stream.err = err
+	}
+	stream.cond.Broadcast()
+}
+
+func (stream *Stream) ReadFrame() (*Frame, error) {
+	stream.mu.Lock()
+	for len(stream.queue) == 0 && !stream.closed {
+		stream.cond.Wait()
+	}
+	if len(stream.queue) == 0 {
+		err := stream.err
+		stream.mu.Unlock()
+		return nil, err
+	}
+	frame := stream.queue[0]
+	stream.queue[0] = nil
+	stream.queue = stream.queue[1:]
+	stream.queued -= int64(len(frame.Payload))
+	stream.mu.Unlock()
+
+	if isDataFrame(frame.Type) {
+		stream.session.throttle(len(frame.Payload))
+	}
+	if len(frame.Payload) > 0 {
+		// 数据已被取走，归还发送窗口
+		credit := make([]byte, 4)
+		binary.BigEndian.PutUint32(credit, uint32(len(frame.Payload)))
+		stream.session.writeFrame(&Frame{Type: MSG_WINDOW, Stream: stream.id, Payload: credit})
+	}
+	if err := frame.decompress(); err != nil {
+		return nil, err
+	}
+	return frame, nil
+}
+
+func (stream *Stream) WriteFrame(frameType uint8, flags uint8, payload []byte) error {
+	if len(payload) > 0 {
+		// 等待对端归还足够的窗口
+		stream.mu.Lock()
+		for stream.window < int64(len(payload)) && !stream.closed {
+			stream.cond.Wait()
+		}
+		if stream.closed {
+			err := stream.err
+			stream.mu.Unlock()
+			return err
+		}
+		stream.window -= int64(len(payload))
+		stream.mu.Unlock()
+	}
+	if isDataFrame(frameType) {
+		stream.session.throttle(len(payload))
+	}
+	return stream.session.writeFrame(&Frame{
+		Type:    frameType,
+		Flags:   flags,
+		Stream:  stream.id,
+		Payload: payload,
+	})
+}
+
+// Close 关闭本端并通知对端，未读取的帧被丢弃
+func (stream *Stream) Close() error {
+	stream.mu.Lock()
+	if stream.closed && stream.err == ErrStreamClosed {
+		stream.mu.Unlock()
+		return nil
+	}
+	stream.closed = true
+	stream.err = ErrStreamClosed
+	stream.queue = nil
+	stream.queued = 0
+	stream.cond.Broadcast()
+	stream.mu.Unlock()
+	stream.session.removeStream(stream.id)
+	return stream.session.writeFrame(&Frame{Type: MSG_CLOSE, Stream: stream.id})
+}
@@ -0,0 +1,180 @@
+package net
+
+import (
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"stacktrace.top/filesync/config"
+)
+
+// newTestSession 返回服务端会话和直接读写帧的对端连接
+func newTestSession(t *testing.T) (*Session, net.Conn) {
+	t.Helper()
+	local, peer := net.Pipe()
+	session := newSession(local, false, newRateLimits(config.LimitConfig{}))
+	t.Cleanup(func() {
+		session.Close()
+		peer.Close()
+	})
+	return session, peer
+}
+
+func sessionErr(t *testing.T, session *Session) error {
+	t.Helper()
+	select {
+	case <-session.done:
+		return session.Err()
+	case <-time.After(5 * time.Second):
+		t.Fatal("session still open")
+		return nil
+	}
+}
+
+// 握手完成前对端只能发送流 0 上的一个 MSG_TOKEN
+func TestMuxRejectsBeforeAuth(t *testing.T) {
+	cases := []*Frame{
+		{Type: MSG_OPEN, Stream: 1},
+		{Type: MSG_SYNC, Stream: 0, Payload: []byte{1}},
+		{Type: MSG_TOKEN, Stream: 1},
+	}
+	for _, frame := range cases {
+		session, peer := newTestSession(t)
+		go WriteFrame(peer, frame)
+		if err := sessionErr(t, session); !errors.Is(err, ErrUnauthenticated) {
+			t.Fatalf("frame type %v stream %v: %v", frame.Type, frame.Stream, err)
+		}
+	}
+
+	// 第二个 token 帧同样被拒绝
+	session, peer := newTestSession(t)
+	go func() {
+		WriteFrame(peer, &Frame{Type: MSG_TOKEN, Stream: 0, Payload: []byte("a")})
+		WriteFrame(peer, &Frame{Type: MSG_TOKEN, Stream: 0, Payload: []byte("b")})
+	}()
+	if err := sessionErr(t, session); !errors.Is(err, ErrUnauthenticated) {
+		t.Fatalf("second token: %v", err)
+	}
+}
+
+// 对端不等待窗口归还继续发送时关闭会话
+func TestMuxWindowExceeded(t *testing.T) {
+	session, peer := newTestSession(t)
+	session.authenticated()
+	go func() {
+		WriteFrame(peer, &Frame{Type: MSG_OPEN, Stream: 1})
+		chunk := make([]byte, streamWindow/2)
+		WriteFrame(peer, &Frame{Type: MSG_FILEPART, Stream: 1, Payload: chunk})
+		WriteFrame(peer, &Frame{Type: MSG_FILEPART, Stream: 1, Payload: chunk})
+		WriteFrame(peer, &Frame{Type: MSG_FILEPART, Stream: 1, Payload: []byte{1}})
+	}()
+	if _, err := session.Accept(); err != nil {
+		t.Fatal(err)
+	}
+	if err := sessionErr(t, session); !errors.Is(err, ErrWindowExceeded) {
+		t.Fatalf("window: %v", err)
+	}
+}
+
+// 等待 Accept 的流已满时，拒绝新流的应答不阻塞读循环，即使对端暂时不读取
+func TestMuxBacklogFullDoesNotBlock(t *testing.T) {
+	session, peer := newTestSession(t)
+	session.authenticated()
+	const streams = acceptBacklog + 10
+	written := make(chan error, 1)
+	go func() {
+		for i := 0; i < streams; i++ {
+			if err := WriteFrame(peer, &Frame{Type: MSG_OPEN, Stream: uint32(2*i + 1)}); err != nil {
+				written <- err
+				return
+			}
+		}
+		written <- WriteFrame(peer, &Frame{Type: MSG_SYNC, Stream: 1, Payload: []byte("hello")})
+	}()
+	select {
+	case err := <-written:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("read loop blocked")
+	}
+
+	// 对端开始读取后收到被拒绝流的 MSG_CLOSE
+	closed := make(chan uint32, streams)
+	go func() {
+		for {
+			frame, err := ReadFrame(peer)
+			if err != nil {
+				return
+			}
+			if frame.Type == MSG_CLOSE {
+				closed <- frame.Stream
+			}
+		}
+	}()
+	stream, err := session.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	frame, err := stream.ReadFrame()
+	if err != nil || string(frame.Payload) != "hello" {
+		t.Fatalf("read: %v %v", frame, err)
+	}
+	for i := 0; i < streams-acceptBacklog; i++ {
+		select {
+		case id := <-closed:
+			if id < 2*acceptBacklog+1 {
+				t.Fatalf("accepted stream %v closed", id)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("got %v close frames", i)
+		}
+	}
+}
+
+// 对端发送的帧在窗口内时正常传输，大于窗口的数据分多次等待归还
+func TestMuxFlowControl(t *testing.T) {
+	local, remote := net.Pipe()
+	limits := newRateLimits(config.LimitConfig{})
+	server := newSession(local, false, limits)
+	client := newSession(remote, true, limits)
+	server.authenticated()
+	defer server.Close()
+	defer client.Close()
+
+	stream, err := client.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	const total = 3 * streamWindow
+	go func() {
+		chunk := make([]byte, maxDataChunk)
+		for sent := 0; sent < total; sent += len(chunk) {
+			if err := stream.WriteFrame(MSG_FILEPART, 0, chunk); err != nil {
+				return
+			}
+		}
+		stream.Close()
+	}()
+	accepted, err := server.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	received := 0
+	for {
+		frame, err := accepted.ReadFrame()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		received += len(frame.Payload)
+	}
+	if received != total || server.Err() != nil {
+		t.Fatalf("received %v of %v, session err %v", received, total, server.Err())
+	}
+}
@@ -1,400 +1,816 @@
-package net
-
-import (
-	"errors"
-	"fmt"
-	"net"
-	"os"
-	"path/filepath"
-	"time"
-
-	"stacktrace.top/filesync/config"
-	"stacktrace.top/filesync/logger"
-	"stacktrace.top/filesync/sync"
-)
-
-type SyncInfo struct {
-	FilePath string
-	FileInfo *sync.SyncFileInfo
-}
-
-type SyncServer struct {
-	conn    *net.TCPConn
-	running bool
-}
-
-type SyncClient struct {
-	conn     *net.TCPConn
-	infoChan chan *SyncInfo
-}
-
-func (syncServer *SyncServer) Stop() {
-	syncServer.running = false
-	syncServer.conn.Close()
-}
-
-func (syncServer *SyncServer) Loop() {
-	defer syncServer.Stop()
-	syncServer.running = true
-	syncServer.conn.SetReadDeadline(time.Now().Add(time.Second * 10))
-	msg, err := ReadForSyncMsg(syncServer.conn)
-	if err != nil {
-		logger.Error("read token msg error: %v", err)
-		return
-	}
-	if msg.MsgType != MSG_TOKEN {
-		logger.Error("first msg is not token")
-		return
-	}
-	if msg.Token != config.InstanceConfig.Server.Token {
-		logger.Error("token is invalid")
-		return
-	}
-	resMsg := &SyncRespMsg{
-		MsgType:   msg.MsgType,
-		ResCode:   RES_SUCCESS,
-		Err:       nil,
-		FileInfos: nil,
-	}
-	syncServer.response(resMsg)
-	syncServer.conn.SetReadDeadline(time.Now().AddDate(10, 0, 0))
-	for syncServer.running {
-		msg, err = ReadForSyncMsg(syncServer.conn)
-		if netErr, ok := err.(net.Error); ok {
-			if !netErr.Timeout() {
-				syncServer.Stop()
-				break
-			}
-		} else if err != nil {
-			logger.Error("read msg error: %v", err)
-			syncServer.Stop()
-			break
-		}
-		syncServer.ProcMsg(msg)
-	}
-}
-
-func (syncServer *SyncServer) ProcMsg(msg *SyncCmdMsg) {
-	switch msg.MsgType {
-	case MSG_MAKECACHE:
-		syncServer.makeCache(msg)
-	case MSG_SYNC:
-		syncServer.sync(msg)
-	default:
-		logger.Error("unknown msg type: %d", msg.MsgType)
-	}
-}
-
-func (syncServer *SyncServer) response(resMsg *SyncRespMsg) {
-	err := WriteForSyncRespMsg(syncServer.conn, resMsg)
-	if netErr, ok := err.(net.Error); ok {
-		if !netErr.Timeout() {
-			syncServer.Stop()
-		}
-	}
-}
-
-func (syncServer *SyncServer) makeCache(msg *SyncCmdMsg) {
-	resMsg := &SyncRespMsg{
-		MsgType:   msg.MsgType,
-		ResCode:   RES_SUCCESS,
-		Err:       nil,
-		FileInfos: nil,
-	}
-	if msg.DstDir == "" {
-		resMsg.ResCode = 1
-		resMsg.Err = errors.New("no dst dir provide")
-	} else {
-		logger.Info("make cache for %s", msg.DstDir)
-		cacheMap := sync.MakeDirInfo(msg.DstDir)
-		resMsg.FileInfos = cacheMap
-	}
-	syncServer.response(resMsg)
-}
-
-func (syncServer *SyncServer) sync(msg *SyncCmdMsg) {
-	resMsg := &SyncRespMsg{
-		MsgType:   msg.MsgType,
-		ResCode:   RES_SUCCESS,
-		Err:       nil,
-		FileInfos: nil,
-	}
-	logger.Info("begin sync file: %v, %v", msg.DstDir, msg.SyncInfo)
-	if msg.DstDir == "" || msg.SyncInfo == nil {
-		resMsg.ResCode = 1
-		resMsg.Err = errors.New("no dst dir or syncFileInfo provide")
-	} else {
-		if msg.SyncInfo.IsDir {
-			err := os.MkdirAll(msg.DstDir, msg.SyncInfo.Mode)
-			if err != nil {
-				logger.Error("create dir: %v failed.err: %v", msg.DstDir, err)
-			}
-		} else {
-			totalSize := msg.SyncInfo.Size
-			bufSize := config.InstanceConfig.Server.Blocksize
-			if totalSize < int64(config.InstanceConfig.Server.Blocksize) {
-				bufSize = int(totalSize)
-			}
-			revBuffer := make([]byte, bufSize)
-			path := filepath.Dir(msg.DstDir)
-			os.MkdirAll(path, os.ModePerm)
-			file, err := os.OpenFile(msg.DstDir, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, msg.SyncInfo.Mode)
-			if err != nil {
-				logger.Error("open file failed. file: %v, err: %v", msg.DstDir, err)
-				resMsg.ResCode = 1
-				resMsg.Err = errors.New("open file failed")
-				syncServer.response(resMsg)
-				return
-			}
-			defer file.Close()
-			offset := int64(0)
-			for offset < totalSize {
-				fileResMsg := &SyncRespMsg{
-					MsgType:  MSG_FILEPART,
-					OffSet:   offset,
-					PartSize: int64(bufSize),
-				}
-				syncServer.response(fileResMsg)
-				readLen := 0
-				for readLen < bufSize {
-					n, err := syncServer.conn.Read(revBuffer)
-					if err != nil && offset+int64(n) < totalSize {
-						logger.Error("read file content failed. err: %v", err)
-						syncServer.Stop()
-						return
-					}
-					if offset+int64(n) > totalSize {
-						n = int(totalSize - offset)
-					}
-					file.Write(revBuffer[:n])
-					offset += int64(n)
-					if offset >= totalSize {
-						break
-					}
-					readLen += n
-				}
-			}
-		}
-		err := os.Chtimes(msg.DstDir, msg.SyncInfo.ModTime, msg.SyncInfo.ModTime)
-		if err != nil {
-			logger.Error("change file: %v time failed.err: %v", msg.DstDir, err)
-		}
-	}
-	syncServer.response(resMsg)
-}
-
-func StartServer() error {
-	addr := &net.TCPAddr{
-		IP:   net.ParseIP("0.0.0.0"),
-		Port: config.InstanceConfig.Server.Port,
-	}
-	server, err := net.ListenTCP("tcp", addr)
-	if err != nil {
-		logger.Error("start server failed. port: %v, err: %v", config.InstanceConfig.Server.Port, err)
-		return err
-	}
-	for {
-		conn, err := server.AcceptTCP()
-		if err != nil {
-			logger.Error("accept conn from server failed, err: %v", config.InstanceConfig.Server.Port, err)
-			return err
-		}
-		syncServer := &SyncServer{
-			conn: conn,
-		}
-		go syncServer.Loop()
-	}
-}
-
-func StartClient() (*SyncClient, error) {
-	addr := &net.TCPAddr{
-		IP:   net.ParseIP(config.InstanceConfig.Client.Serverip),
-		Port: config.InstanceConfig.Client.Serverport,
-	}
-	conn, err := net.DialTCP("tcp", nil, addr)
-	if err != nil {
-		logger.Error("connect server failed. err: %v", err)
-		return nil, err
-	}
-	syncClient := &SyncClient{
-		conn: conn,
-	}
-	err = syncClient.SendToken()
-	if err != nil {
-		return nil, err
-	}
-	return syncClient, nil
-}
-
-func (sc *SyncClient) SendToken() error {
-	return SendToken(sc.conn)
-}
-
-func (sc *SyncClient) Stop() {
-	sc.conn.Close()
-}
-
-func SendToken(conn *net.TCPConn) error {
-	msg := &SyncCmdMsg{
-		MsgType: MSG_TOKEN,
-		Token:   config.InstanceConfig.Client.Token,
-	}
-	err := WriteForSyncMsg(conn, msg)
-	if err != nil {
-		logger.Error("send token failed. err: %v", err)
-		return err
-	}
-	resMsg, err := ReadForSyncRespMsg(conn)
-	if err != nil {
-		logger.Error("read token response failed. err: %v", err)
-		return err
-	}
-	if resMsg.MsgType != MSG_TOKEN || resMsg.ResCode != RES_SUCCESS {
-		logger.Error("Token msg error: %v", resMsg)
-		return errors.New("token msg error")
-	}
-	return nil
-}
-
-func (sc *SyncClient) CompareDiffFiles() (map[string]*sync.SyncFileInfo, error) {
-	msg := &SyncCmdMsg{
-		MsgType: MSG_MAKECACHE,
-		DstDir:  config.InstanceConfig.Sync.Dstpath,
-	}
-	err := WriteForSyncMsg(sc.conn, msg)
-	if err != nil {
-		logger.Error("send compare info failed. err: %v", err)
-		return nil, err
-	}
-	resMsg, err := ReadForSyncRespMsg(sc.conn)
-	if err != nil {
-		logger.Error("read compare response failed. err: %v", err)
-		return nil, err
-	}
-	if resMsg.MsgType != MSG_MAKECACHE || resMsg.ResCode != RES_SUCCESS {
-		logger.Error("resmsg is invalid, %v %v", resMsg.MsgType, resMsg.ResCode)
-		return nil, errors.New("resmsg is invalid")
-	}
-	for k, v := range resMsg.FileInfos {
-		sync.DstSyncFileMap[filepath.FromSlash(k)] = v
-	}
-	sync.LoadSrcCache()
-	return sync.Compare(), nil
-}
-
-func (sc *SyncClient) SyncFiles(diffFiles map[string]*sync.SyncFileInfo) {
-	sc.infoChan = make(chan *SyncInfo, config.InstanceConfig.Client.Threads)
-	resChan := make(chan int, len(diffFiles))
-	go func() {
-		for i := 0; i < config.InstanceConfig.Client.Threads; i++ {
-			go func() {
-				scFile, err := StartClient()
-				if err != nil {
-					logger.Error("start client failed. err: %v", err)
-					return
-				}
-				for sInfo := range sc.infoChan {
-					srcFilePath := filepath.Join(config.InstanceConfig.Sync.Srcpath, sInfo.FilePath)
-					dstFilePath := filepath.Join(config.InstanceConfig.Sync.Dstpath, sInfo.FilePath)
-					err := scFile.SyncFile(srcFilePath, dstFilePath, sInfo.FileInfo)
-					resChan <- 1
-					if err != nil {
-						logger.Error("sync file failed. err: %v", err)
-						scFile.Stop()
-						scFile, err = StartClient()
-						if err != nil {
-							logger.Error("start client failed. err: %v", err)
-							return
-						}
-					}
-
-				}
-			}()
-		}
-	}()
-	for fp, fi := range diffFiles {
-		// 同步文件
-		sInfo := &SyncInfo{
-			FilePath: fp,
-			FileInfo: fi,
-		}
-		sc.infoChan <- sInfo
-	}
-	sum := 0
-	go func() {
-		for sum < len(diffFiles) {
-			logger.Info("%v files has been synced", sum)
-			time.Sleep(time.Second * 5)
-		}
-	}()
-	for n := range resChan {
-		sum += n
-		if sum >= len(diffFiles) {
-			break
-		}
-	}
-	logger.Info("sync file finished")
-}
-
-func (sc *SyncClient) SyncFile(srcFilePath string, dstFilePath string, fileInfo *sync.SyncFileInfo) error {
-	msg := &SyncCmdMsg{
-		MsgType:  MSG_SYNC,
-		DstDir:   dstFilePath,
-		SyncInfo: fileInfo,
-	}
-	// logger.Info("begin sync file: %v", fileInfo)
-
-	err := WriteForSyncMsg(sc.conn, msg)
-	if err != nil {
-		return err
-	}
-	if fileInfo.Size == 0 && !fileInfo.IsDir {
-		// logger.Info("zero file: %v", srcFilePath)
-		return nil
-	}
-	// if fileInfo.IsDir {
-	// 	return nil
-	// }
-	file, err := os.Open(srcFilePath)
-	if err != nil {
-		logger.Error("open file failed. file: %v, err: %v", srcFilePath, err)
-		return err
-	}
-	defer file.Close()
-	for {
-		// 等待分片请求
-		resMsg, err := ReadForSyncRespMsg(sc.conn)
-		if err != nil {
-			return err
-		}
-		// logger.Info("sync file for: %v", resMsg)
-		if resMsg.MsgType == MSG_FILEPART {
-			bufLen := resMsg.PartSize
-			if bufLen+resMsg.OffSet > fileInfo.Size {
-				bufLen = fileInfo.Size - resMsg.OffSet
-			}
-			// 发送分片
-			buf := make([]byte, bufLen)
-			size, err := file.ReadAt(buf, resMsg.OffSet)
-			if err != nil {
-				logger.Error("read file failed. file: %v, err: %v", srcFilePath, err)
-				logger.Info("sync file for: %v", resMsg)
-				return err
-			}
-			writeLen := 0
-			for writeLen < size {
-				n, err := sc.conn.Write(buf[writeLen:size])
-				writeLen += n
-				if err != nil {
-					logger.Error("write file failed. file: %v, err: %v", srcFilePath, err)
-					break
-				}
-			}
-		} else if resMsg.MsgType == MSG_SYNC && resMsg.ResCode != RES_SUCCESS {
-			return fmt.Errorf("sync file failed. file: %v, res: %v", srcFilePath, resMsg.ResCode)
-		} else {
-			break
-		}
-	}
-	return nil
-}
+package net
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	gosync "sync"
+	"time"
+
+	"stacktrace.top/filesync/config"
+	"stacktrace.top/filesync/logger"
+	"stacktrace.top/filesync/sync"
+)
+
+type SyncInfo struct {
+	FilePath string
+	FileInfo *sync.SyncFileInfo
+	// 非空时表示一批打包发送的小文件
+	Batch []*SyncInfo
+	// 已重试的次数
+	Attempt int
+}
+
+// SyncServer 处理会话中的一个流
+type SyncServer struct {
+	srv      *Server
+	conn     *Stream
+	running  bool
+	compress bool
+	// 登录使用的账号，用于按账号统计
+	account string
+	client  *ClientInfo
+	// 目标目录所在的存储
+	fs sync.FS
+	// 扫描目标目录使用的排除规则，每个流独立
+	scanner *sync.Scanner
+}
+
+// Server 是一个 daemon 实例，持有配置、目标存储以及指标、审计日志、客户端列表和限速，
+// 同一进程中的多个实例互不影响
+type Server struct {
+	conf config.Config
+	// 读写目标目录使用的存储，开启备份时替换文件前保留旧版本
+	fs      *sync.BackupFS
+	scanner *sync.Scanner
+	metrics *serverMetrics
+	audit   *auditJournal
+	clients *clientRegistry
+	limits  *rateLimits
+	rescan  rescanner
+}
+
+// NewServer 按配置创建服务端，fsys 为目标目录所在的存储，打开审计日志失败时返回错误
+func NewServer(conf config.Config, fsys sync.FS) (*Server, error) {
+	scanner, err := sync.NewScanner(conf.Sync)
+	if err != nil {
+		logger.Error("load exclude rules failed. err: %v", err)
+		return nil, err
+	}
+	audit, err := openAuditJournal(conf.Server.Auditlog)
+	if err != nil {
+		logger.Error("open audit journal failed. err: %v", err)
+		return nil, err
+	}
+	return &Server{
+		conf:    conf,
+		fs:      sync.WithBackup(fsys, conf.Backup),
+		scanner: scanner,
+		metrics: newServerMetrics(),
+		audit:   audit,
+		clients: newClientRegistry(),
+		limits:  newRateLimits(conf.Limit),
+	}, nil
+}
+
+// SetLimitConfig 替换限速配置，用于重新加载配置文件
+func (srv *Server) SetLimitConfig(conf config.LimitConfig) {
+	srv.limits.setConfig(conf)
+}
+
+// SyncClient 持有会话中的一个流，SyncFiles 在同一会话上为每个工作协程打开独立的流
+type SyncClient struct {
+	// 同步使用的配置和文件信息
+	scanner *sync.Scanner
+	// 连接、压缩和打包设置
+	conf config.ClientConfig
+	// 本客户端所有连接共享的限速
+	limits   *rateLimits
+	session  *Session
+	conn     *Stream
+	infoChan chan *SyncInfo
+	compress bool
+	stats    *CompressStats
+	// 工作协程编号和进度统计，按已发送的文件片更新进度
+	worker   int
+	progress *sync.Stats
+}
+
+func (syncServer *SyncServer) Stop() {
+	syncServer.running = false
+	syncServer.conn.Close()
+}
+
+// serveSession 在流 0 上完成握手，之后为客户端打开的每个流启动一个 SyncServer
+func (srv *Server) serveSession(conn *net.TCPConn) {
+	session := newSession(conn, false, srv.limits)
+	defer session.Close()
+	srv.metrics.connOpened()
+	defer srv.metrics.connClosed()
+	// 握手超时则关闭会话
+	timer := time.AfterFunc(time.Second*10, func() {
+		session.Close()
+	})
+	control := session.ControlStream()
+	msg, err := ReadForSyncMsg(control)
+	if err != nil {
+		logger.Error("read token msg error: %v", err)
+		return
+	}
+	if msg.MsgType != MSG_TOKEN {
+		logger.Error("first msg is not token")
+		return
+	}
+	account, ok := srv.authenticate(msg.Token)
+	if !ok {
+		srv.metrics.authFailed()
+		logger.Error("token is invalid. client: %v", session.RemoteAddr())
+		return
+	}
+	session.authenticated()
+	if !timer.Stop() {
+		return
+	}
+	// 双方都开启时才启用压缩
+	compress := msg.Compress && srv.conf.Server.Compression
+	resMsg := &SyncRespMsg{
+		MsgType:   msg.MsgType,
+		ResCode:   RES_SUCCESS,
+		FileInfos: nil,
+		Compress:  compress,
+	}
+	if err := WriteForSyncRespMsg(control, resMsg); err != nil {
+		return
+	}
+	srv.metrics.loggedIn(account)
+	client := srv.clients.add(session, account)
+	defer srv.clients.remove(client)
+	for {
+		stream, err := session.Accept()
+		if err != nil {
+			logger.Info("client disconnected: %v", session.RemoteAddr())
+			return
+		}
+		syncServer := &SyncServer{
+			srv:      srv,
+			conn:     stream,
+			compress: compress,
+			account:  account,
+			client:   client,
+			fs:       srv.fs,
+			scanner:  srv.scanner.Clone(),
+		}
+		go syncServer.Loop()
+	}
+}
+
+func (syncServer *SyncServer) Loop() {
+	defer syncServer.Stop()
+	syncServer.running = true
+	for syncServer.running {
+		frame, err := syncServer.conn.ReadFrame()
+		if err == io.EOF || err == ErrSessionClosed {
+			break
+		} else if err != nil {
+			logger.Error("read msg error: %v", err)
+			break
+		}
+		if frame.Type == MSG_BATCH {
+			syncServer.syncBatch(frame.Payload)
+			continue
+		}
+		if frame.Type == MSG_SNAPSHOT {
+			syncServer.snapshot(frame.Payload)
+			continue
+		}
+		if frame.Type == MSG_FS {
+			syncServer.remoteFS(frame.Payload)
+			continue
+		}
+		msg, err := parseSyncMsg(frame)
+		if err != nil {
+			logger.Error("read msg error: %v", err)
+			break
+		}
+		syncServer.ProcMsg(msg)
+	}
+}
+
+func (syncServer *SyncServer) ProcMsg(msg *SyncCmdMsg) {
+	switch msg.MsgType {
+	case MSG_MAKECACHE:
+		syncServer.makeCache(msg)
+	case MSG_SYNC:
+		syncServer.sync(msg)
+	default:
+		logger.Error("unknown msg type: %d", msg.MsgType)
+	}
+}
+
+// setCurrent 记录当前流正在接收的文件，供管理 API 展示
+func (syncServer *SyncServer) setCurrent(dstPath string) {
+	syncServer.srv.clients.setCurrent(syncServer.client, syncServer.conn.ID(), dstPath)
+}
+
+// recordWrite 记录一个文件或目录的写入结果到指标、客户端状态和审计日志，errMsg 为空表示成功
+func (syncServer *SyncServer) recordWrite(dstPath string, info *sync.SyncFileInfo, sum []byte, errMsg string) {
+	srv := syncServer.srv
+	ok := errMsg == ""
+	if !ok {
+		srv.metrics.writeFailed(syncServer.account)
+		srv.clients.record(syncServer.client, 0, false)
+	} else if !info.IsDir {
+		srv.metrics.fileWritten(syncServer.account)
+		srv.clients.record(syncServer.client, info.Size, true)
+	}
+	if srv.audit != nil {
+		entry := &AuditEntry{
+			Time:    time.Now(),
+			Client:  syncServer.client.Addr,
+			Account: syncServer.account,
+			Op:      AUDIT_WRITE,
+			Path:    dstPath,
+			Size:    info.Size,
+			Hash:    hex.EncodeToString(sum),
+			Error:   errMsg,
+		}
+		if info.IsDir {
+			entry.Op = AUDIT_MKDIR
+			entry.Size = 0
+		}
+		srv.audit.record(entry)
+	}
+}
+
+func (syncServer *SyncServer) response(resMsg *SyncRespMsg) {
+	err := WriteForSyncRespMsg(syncServer.conn, resMsg)
+	if err != nil {
+		syncServer.Stop()
+	}
+}
+
+func (syncServer *SyncServer) makeCache(msg *SyncCmdMsg) {
+	resMsg := &SyncRespMsg{
+		MsgType:   msg.MsgType,
+		ResCode:   RES_SUCCESS,
+		FileInfos: nil,
+	}
+	if msg.DstDir == "" {
+		resMsg.ResCode = RES_FAILED
+		resMsg.Err = "no dst dir provide"
+	} else {
+		logger.Info("make cache for %s", msg.DstDir)
+		start := time.Now()
+		// 目录列表分批下发，避免整棵目录树放在一条消息中
+		batch := make(map[string]*sync.SyncFileInfo)
+		stats := &CompressStats{}
+		flush := func() error {
+			err := writeSyncRespMsg(syncServer.conn, &SyncRespMsg{
+				MsgType:   MSG_FILELIST,
+				ResCode:   RES_SUCCESS,
+				FileInfos: batch,
+			}, syncServer.compress, syncServer.srv.conf.Server.Compresslevel, stats)
+			batch = make(map[string]*sync.SyncFileInfo)
+			return err
+		}
+		// 发送失败时连接已不可用，停止遍历
+		var sendErr error
+		err := syncServer.scanner.Walk(syncServer.fs, msg.DstDir, msg.WithHash, func(relPath string, info *sync.SyncFileInfo) error {
+			batch[relPath] = info
+			if len(batch) >= fileListBatch {
+				sendErr = flush()
+				return sendErr
+			}
+			return nil
+		})
+		if sendErr == nil && len(batch) > 0 {
+			sendErr = flush()
+		}
+		if sendErr != nil {
+			logger.Error("send file list for %s failed. err: %v", msg.DstDir, sendErr)
+			syncServer.Stop()
+			return
+		}
+		// 校验时需要完整的哈希，扫描出错要告知客户端
+		if err != nil && msg.WithHash {
+			resMsg.ResCode = RES_FAILED
+			resMsg.Err = err.Error()
+		}
+		syncServer.srv.metrics.scanDone(time.Since(start))
+		if syncServer.compress {
+			raw, wire := stats.Load()
+			logger.Info("file list for %s sent. raw: %v bytes, compressed: %v bytes", msg.DstDir, raw, wire)
+		}
+	}
+	syncServer.response(resMsg)
+}
+
+func (syncServer *SyncServer) sync(msg *SyncCmdMsg) {
+	resMsg := &SyncRespMsg{
+		MsgType:   msg.MsgType,
+		ResCode:   RES_SUCCESS,
+		FileInfos: nil,
+	}
+	logger.Info("begin sync file: %v, %v", msg.DstDir, msg.SyncInfo)
+	syncServer.setCurrent(msg.DstDir)
+	defer syncServer.setCurrent("")
+	if msg.DstDir == "" || msg.SyncInfo == nil {
+		resMsg.ResCode = RES_FAILED
+		resMsg.Err = "no dst dir or syncFileInfo provide"
+	} else {
+		if msg.SyncInfo.IsDir {
+			err := syncServer.fs.MkdirAll(msg.DstDir, msg.SyncInfo.Mode)
+			if err != nil {
+				syncServer.recordWrite(msg.DstDir, msg.SyncInfo, nil, err.Error())
+				logger.Error("create dir: %v failed.err: %v", msg.DstDir, err)
+				resMsg.ResCode = RES_FAILED
+				resMsg.Err = err.Error()
+			} else {
+				syncServer.recordWrite(msg.DstDir, msg.SyncInfo, nil, "")
+			}
+		} else {
+			// 客户端不等待应答直接推送文件内容，失败时也要读完数据
+			resCode, resErr, sum, err := syncServer.receiveFile(msg.DstDir, msg.SyncInfo)
+			if err != nil {
+				logger.Error("read file content failed. err: %v", err)
+				syncServer.Stop()
+				return
+			}
+			if resCode != RES_SUCCESS {
+				syncServer.recordWrite(msg.DstDir, msg.SyncInfo, nil, resErr)
+				resMsg.ResCode = resCode
+				resMsg.Err = resErr
+				syncServer.response(resMsg)
+				return
+			}
+			syncServer.recordWrite(msg.DstDir, msg.SyncInfo, sum, "")
+		}
+		err := syncServer.fs.Chtimes(msg.DstDir, msg.SyncInfo.ModTime, msg.SyncInfo.ModTime)
+		if err != nil {
+			logger.Error("change file: %v time failed.err: %v", msg.DstDir, err)
+		}
+	}
+	syncServer.response(resMsg)
+}
+
+// Serve 监听 Server.Port 并处理连接，同时启动配置了的指标、管理 API 和备份清理
+func (srv *Server) Serve() error {
+	addr := &net.TCPAddr{
+		IP:   net.ParseIP("0.0.0.0"),
+		Port: srv.conf.Server.Port,
+	}
+	listener, err := net.ListenTCP("tcp", addr)
+	if err != nil {
+		logger.Error("start server failed. port: %v, err: %v", srv.conf.Server.Port, err)
+		return err
+	}
+	srv.startMetricsServer()
+	srv.startAdminServer()
+	srv.startBackupPruner()
+	for {
+		conn, err := listener.AcceptTCP()
+		if err != nil {
+			logger.Error("accept conn from server failed, err: %v", srv.conf.Server.Port, err)
+			return err
+		}
+		go srv.serveSession(conn)
+	}
+}
+
+// startBackupPruner 开启备份时启动后立即清理一次过期版本，之后每天清理
+func (srv *Server) startBackupPruner() {
+	if srv.conf.Backup.Dir == "" {
+		return
+	}
+	go func() {
+		for {
+			if removed := srv.fs.Prune(); removed > 0 {
+				logger.Info("pruned %v expired backup versions", removed)
+			}
+			time.Sleep(24 * time.Hour)
+		}
+	}()
+}
+
+// dialSession 建立连接并在流 0 上完成握手，返回协商后的压缩选项
+func dialSession(conf config.ClientConfig, limits *rateLimits) (*Session, bool, error) {
+	addr := &net.TCPAddr{
+		IP:   net.ParseIP(conf.Serverip),
+		Port: conf.Serverport,
+	}
+	conn, err := net.DialTCP("tcp", nil, addr)
+	if err != nil {
+		logger.Error("connect server failed. err: %v", err)
+		return nil, false, err
+	}
+	session := newSession(conn, true, limits)
+	compress, err := sendToken(session.ControlStream(), conf)
+	if err != nil {
+		session.Close()
+		return nil, false, err
+	}
+	return session, compress, nil
+}
+
+// DialClient 按 conf 连接 daemon，限速只作用于这个客户端的连接
+func DialClient(scanner *sync.Scanner, conf config.ClientConfig, limit config.LimitConfig) (*SyncClient, error) {
+	limits := newRateLimits(limit)
+	session, compress, err := dialSession(conf, limits)
+	if err != nil {
+		return nil, err
+	}
+	stream, err := session.OpenStream()
+	if err != nil {
+		session.Close()
+		return nil, err
+	}
+	syncClient := &SyncClient{
+		scanner:  scanner,
+		conf:     conf,
+		limits:   limits,
+		session:  session,
+		conn:     stream,
+		compress: compress,
+		stats:    &CompressStats{},
+	}
+	return syncClient, nil
+}
+
+func sendToken(control *Stream, conf config.ClientConfig) (bool, error) {
+	msg := &SyncCmdMsg{
+		MsgType:  MSG_TOKEN,
+		Token:    conf.Token,
+		Compress: conf.Compression,
+	}
+	err := WriteForSyncMsg(control, msg)
+	if err != nil {
+		logger.Error("send token failed. err: %v", err)
+		return false, err
+	}
+	resMsg, err := ReadForSyncRespMsg(control)
+	if err != nil {
+		logger.Error("read token response failed. err: %v", err)
+		return false, err
+	}
+	if resMsg.MsgType != MSG_TOKEN || resMsg.ResCode != RES_SUCCESS {
+		logger.Error("Token msg error: %v", resMsg)
+		return false, errors.New("token msg error")
+	}
+	return resMsg.Compress, nil
+}
+
+// Stop 关闭客户端使用的流
+func (sc *SyncClient) Stop() {
+	sc.conn.Close()
+}
+
+// Close 关闭整个会话
+func (sc *SyncClient) Close() {
+	sc.session.Close()
+}
+
+// sessionPool 管理 SyncFiles 使用的若干条连接，连接断开时重新建立
+type sessionPool struct {
+	client   *SyncClient
+	mu       gosync.Mutex
+	sessions []*Session
+	stats    *CompressStats
+	compress bool
+	progress *sync.Stats
+}
+
+func (pool *sessionPool) openStream(idx int) (*SyncClient, error) {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	worker := idx
+	idx = idx % len(pool.sessions)
+	session := pool.sessions[idx]
+	if session == nil || session.Err() != nil {
+		newSession, compress, err := dialSession(pool.client.conf, pool.client.limits)
+		if err != nil {
+			return nil, err
+		}
+		pool.sessions[idx] = newSession
+		pool.compress = compress
+		session = newSession
+	}
+	stream, err := session.OpenStream()
+	if err != nil {
+		return nil, err
+	}
+	return &SyncClient{
+		scanner:  pool.client.scanner,
+		conf:     pool.client.conf,
+		limits:   pool.client.limits,
+		session:  session,
+		conn:     stream,
+		compress: pool.compress,
+		stats:    pool.stats,
+		worker:   worker,
+		progress: pool.progress,
+	}, nil
+}
+
+// close 关闭池中新建的连接，客户端自身的会话由 SyncClient.Close 关闭，之后还可以继续使用
+func (pool *sessionPool) close() {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	for _, session := range pool.sessions {
+		if session != nil && session != pool.client.session {
+			session.Close()
+		}
+	}
+}
+
+func (sc *SyncClient) CompareDiffFiles() (map[string]*sync.SyncFileInfo, error) {
+	dstInfos, err := sc.FetchDirInfo(sc.scanner.Config.Dstpath, false)
+	if err != nil {
+		return nil, err
+	}
+	sc.scanner.SetDst(dstInfos)
+	sc.scanner.LoadSrcCache()
+	return sc.scanner.Compare(), nil
+}
+
+// FetchDirInfo 请求服务端扫描目录并接收分批下发的文件列表
+func (sc *SyncClient) FetchDirInfo(dstDir string, withHash bool) (map[string]*sync.SyncFileInfo, error) {
+	msg := &SyncCmdMsg{
+		MsgType:  MSG_MAKECACHE,
+		DstDir:   dstDir,
+		WithHash: withHash,
+	}
+	err := WriteForSyncMsg(sc.conn, msg)
+	if err != nil {
+		logger.Error("send compare info failed. err: %v", err)
+		return nil, err
+	}
+	dirInfos := make(map[string]*sync.SyncFileInfo)
+	for {
+		resMsg, err := ReadForSyncRespMsg(sc.conn)
+		if err != nil {
+			logger.Error("read compare response failed. err: %v", err)
+			return nil, err
+		}
+		if resMsg.MsgType == MSG_FILELIST {
+			for k, v := range resMsg.FileInfos {
+				dirInfos[filepath.FromSlash(k)] = v
+			}
+			continue
+		}
+		if resMsg.MsgType != MSG_MAKECACHE || resMsg.ResCode != RES_SUCCESS {
+			logger.Error("resmsg is invalid, %v %v %v", resMsg.MsgType, resMsg.ResCode, resMsg.Err)
+			return nil, errors.New("resmsg is invalid")
+		}
+		return dirInfos, nil
+	}
+}
+
+func (sc *SyncClient) SyncFiles(diffFiles map[string]*sync.SyncFileInfo, stats *sync.Stats) {
+	threads := sc.conf.Threads
+	if threads <= 0 {
+		threads = 1
+	}
+	conns := sc.conf.Conns
+	if conns <= 0 {
+		conns = 1
+	}
+	// 第一条连接复用当前会话，所有工作协程以流的形式共享这些连接
+	pool := &sessionPool{
+		client:   sc,
+		sessions: make([]*Session, conns),
+		stats:    sc.stats,
+		compress: sc.compress,
+		progress: stats,
+	}
+	pool.sessions[0] = sc.session
+	defer pool.close()
+	sc.infoChan = make(chan *SyncInfo, threads)
+	policy := sc.scanner.RetryPolicy()
+	// 按文件计数，文件得到最终结果(成功或重试用尽)时减一
+	var pending gosync.WaitGroup
+	finish := func(sInfo *SyncInfo, elapsed time.Duration, err error) {
+		if err != nil && sInfo.Attempt < policy.Retries {
+			sInfo.Attempt++
+			delay := policy.Delay(sInfo.Attempt)
+			logger.Error("sync file: %v failed, retry %v/%v in %v. err: %v", sInfo.FilePath, sInfo.Attempt, policy.Retries, delay, err)
+			stats.FileRetry()
+			// 重试的文件单独发送，不再打包
+			retry := &SyncInfo{FilePath: sInfo.FilePath, FileInfo: sInfo.FileInfo, Attempt: sInfo.Attempt}
+			time.AfterFunc(delay, func() {
+				sc.infoChan <- retry
+			})
+			return
+		}
+		if err != nil {
+			logger.Error("sync file: %v failed permanently. err: %v", sInfo.FilePath, err)
+		}
+		stats.FileDone(sInfo.FilePath, sInfo.FileInfo, elapsed, err)
+		pending.Done()
+	}
+	var workers gosync.WaitGroup
+	for i := 0; i < threads; i++ {
+		workers.Add(1)
+		go func(idx int) {
+			defer workers.Done()
+			var scFile *SyncClient
+			for sInfo := range sc.infoChan {
+				if scFile == nil {
+					var err error
+					scFile, err = pool.openStream(idx)
+					if err != nil {
+						// 连接失败时任务按失败处理进入重试，工作协程继续运行
+						logger.Error("start client failed. err: %v", err)
+						for _, item := range sInfo.items() {
+							finish(item, 0, err)
+						}
+						continue
+					}
+				}
+				if err := scFile.runJob(sInfo, stats, finish); err != nil {
+					// 流的状态已不可信，下一个任务换新流
+					scFile.Stop()
+					scFile = nil
+				}
+			}
+			if scFile != nil {
+				scFile.Stop()
+			}
+		}(i)
+	}
+	pending.Add(len(diffFiles))
+	// 小文件和目录按批次打包，其余文件单独传输
+	threshold, batchSize := batchLimits(sc.conf)
+	var batch []*SyncInfo
+	// 批次的文件数据大小和编码后的负载大小，负载以 4 字节的条目数开头
+	batchBytes, batchEncoded := int64(0), int64(4)
+	for fp, fi := range diffFiles {
+		// 同步文件
+		sInfo := &SyncInfo{
+			FilePath: fp,
+			FileInfo: fi,
+		}
+		if threshold < 0 || (!fi.IsDir && fi.Size > threshold) {
+			sc.infoChan <- sInfo
+			continue
+		}
+		entrySize := batchEntrySize(filepath.Join(sc.scanner.Config.Dstpath, fp), fi)
+		if len(batch) >= maxBatchEntries || (!fi.IsDir && batchBytes+fi.Size > batchSize) ||
+			(len(batch) > 0 && batchEncoded+entrySize > maxBatchPayload) {
+			sc.infoChan <- &SyncInfo{Batch: batch}
+			batch = nil
+			batchBytes, batchEncoded = 0, 4
+		}
+		batch = append(batch, sInfo)
+		batchEncoded += entrySize
+		if !fi.IsDir {
+			batchBytes += fi.Size
+		}
+	}
+	if len(batch) > 0 {
+		sc.infoChan <- &SyncInfo{Batch: batch}
+	}
+	// 所有文件都有最终结果后不会再有重试入队，可以关闭通道
+	pending.Wait()
+	close(sc.infoChan)
+	workers.Wait()
+	if sc.compress {
+		raw, wire := sc.stats.Load()
+		logger.Info("file data sent. raw: %v bytes, compressed: %v bytes", raw, wire)
+	}
+	logger.Info("sync file finished")
+}
+
+// items 返回任务包含的文件
+func (sInfo *SyncInfo) items() []*SyncInfo {
+	if sInfo.Batch != nil {
+		return sInfo.Batch
+	}
+	return []*SyncInfo{sInfo}
+}
+
+// runJob 同步一个文件或一批小文件，每个文件的结果交给 finish；返回 error 表示当前流已不可用，
+// 服务端对文件的失败应答只交给 finish 重试，流继续使用
+func (sc *SyncClient) runJob(sInfo *SyncInfo, stats *sync.Stats, finish func(*SyncInfo, time.Duration, error)) error {
+	var err error
+	if sInfo.Batch == nil {
+		err = sc.syncTracked(sInfo, stats, finish)
+	} else {
+		err = sc.runBatch(sInfo, stats, finish)
+	}
+	if isStreamError(err) {
+		return err
+	}
+	return nil
+}
+
+func (sc *SyncClient) runBatch(sInfo *SyncInfo, stats *sync.Stats, finish func(*SyncInfo, time.Duration, error)) error {
+	batchBytes := int64(0)
+	for _, item := range sInfo.Batch {
+		if !item.FileInfo.IsDir {
+			batchBytes += item.FileInfo.Size
+		}
+	}
+	stats.WorkerStart(sc.worker, fmt.Sprintf("batch of %v files", len(sInfo.Batch)), batchBytes)
+	start := time.Now()
+	failed, err := sc.SyncBatch(sInfo.Batch)
+	stats.WorkerIdle(sc.worker)
+	// 批次耗时平摊到每个文件
+	elapsed := time.Since(start) / time.Duration(len(sInfo.Batch))
+	for _, item := range sInfo.Batch {
+		if err != nil {
+			finish(item, elapsed, err)
+		} else {
+			// 批次中失败的条目进入重试队列单独发送
+			finish(item, elapsed, failed[item.FilePath])
+		}
+	}
+	return err
+}
+
+// syncTracked 同步单个文件并记录进度
+func (sc *SyncClient) syncTracked(sInfo *SyncInfo, stats *sync.Stats, finish func(*SyncInfo, time.Duration, error)) error {
+	srcFilePath := filepath.Join(sc.scanner.Config.Srcpath, sInfo.FilePath)
+	dstFilePath := filepath.Join(sc.scanner.Config.Dstpath, sInfo.FilePath)
+	stats.WorkerStart(sc.worker, sInfo.FilePath, sInfo.FileInfo.Size)
+	start := time.Now()
+	err := sc.SyncFile(srcFilePath, dstFilePath, sInfo.FileInfo)
+	// 先移除进行中的进度，再计入已完成，避免字节数重复计算
+	stats.WorkerIdle(sc.worker)
+	finish(sInfo, time.Since(start), err)
+	return err
+}
+
+// SyncFile 发送同步请求后直接推送文件内容，由流控窗口限速，最后等待服务端应答。
+// 校验失败等错误由 SyncFiles 按重试策略重新发送
+func (sc *SyncClient) SyncFile(srcFilePath string, dstFilePath string, fileInfo *sync.SyncFileInfo) error {
+	var file *os.File
+	if !fileInfo.IsDir {
+		var err error
+		file, err = os.Open(srcFilePath)
+		if err != nil {
+			logger.Error("open file failed. file: %v, err: %v", srcFilePath, err)
+			return err
+		}
+		defer file.Close()
+	}
+	msg := &SyncCmdMsg{
+		MsgType:  MSG_SYNC,
+		DstDir:   dstFilePath,
+		SyncInfo: fileInfo,
+	}
+	err := WriteForSyncMsg(sc.conn, msg)
+	if err != nil {
+		return newStreamError(err)
+	}
+	// 请求发出后任何读写失败都会让服务端停在接收中途，流不能再用
+	if file != nil {
+		compress := sc.compress && shouldCompress(srcFilePath, sc.conf.Compressskip)
+		hasher := sha256.New()
+		buf := make([]byte, maxDataChunk)
+		offset := int64(0)
+		for offset < fileInfo.Size {
+			chunk := fileInfo.Size - offset
+			if chunk > int64(len(buf)) {
+				chunk = int64(len(buf))
+			}
+			size, err := file.ReadAt(buf[:chunk], offset)
+			if err != nil && size < int(chunk) {
+				logger.Error("read file failed. file: %v, err: %v", srcFilePath, err)
+				return newStreamError(err)
+			}
+			hasher.Write(buf[:size])
+			err = writeFilePart(sc.conn, offset, buf[:size], compress, sc.conf.Compresslevel, sc.stats)
+			if err != nil {
+				logger.Error("write file failed. file: %v, err: %v", srcFilePath, err)
+				return newStreamError(err)
+			}
+			offset += int64(size)
+			if sc.progress != nil {
+				sc.progress.WorkerProgress(sc.worker, offset)
+			}
+		}
+		err = writeFileDone(sc.conn, hasher.Sum(nil))
+		if err != nil {
+			return newStreamError(err)
+		}
+	}
+	resMsg, err := ReadForSyncRespMsg(sc.conn)
+	if err != nil {
+		return newStreamError(err)
+	}
+	if resMsg.MsgType != MSG_SYNC {
+		return newStreamError(fmt.Errorf("unexpected response type: %v", resMsg.MsgType))
+	}
+	if resMsg.ResCode == RES_CHECKSUM {
+		return fmt.Errorf("%w. file: %v, err: %v", ErrChecksumMismatch, srcFilePath, resMsg.Err)
+	}
+	if resMsg.ResCode != RES_SUCCESS {
+		return fmt.Errorf("%w. sync file failed. file: %v, res: %v, err: %v", sync.ErrRemoteFailed, srcFilePath, resMsg.ResCode, resMsg.Err)
+	}
+	return nil
+}
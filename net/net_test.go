@@ -0,0 +1,276 @@
+package net
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	gosync "sync"
+	"testing"
+	"time"
+
+	"stacktrace.top/filesync/config"
+	"stacktrace.top/filesync/sync"
+)
+
+const testToken = "test-token"
+
+// failFS 写入文件名包含 match 的文件时失败
+type failFS struct {
+	sync.FS
+	match string
+	mu    gosync.Mutex
+	count int
+}
+
+func (f *failFS) Create(name string, perm os.FileMode) (sync.File, error) {
+	if strings.Contains(name, f.match) {
+		f.mu.Lock()
+		f.count++
+		f.mu.Unlock()
+		return nil, errors.New("injected failure")
+	}
+	return f.FS.Create(name, perm)
+}
+
+// startServer 在回环地址上启动 daemon，返回端口
+func startServer(t *testing.T, conf config.Config, fsys sync.FS) (*Server, int) {
+	t.Helper()
+	if conf.Server.Token == "" {
+		conf.Server.Token = testToken
+	}
+	srv, err := NewServer(conf, fsys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.AcceptTCP()
+			if err != nil {
+				return
+			}
+			go srv.serveSession(conn)
+		}
+	}()
+	return srv, listener.Addr().(*net.TCPAddr).Port
+}
+
+func clientConfig(port int) config.ClientConfig {
+	return config.ClientConfig{Serverip: "127.0.0.1", Serverport: port, Token: testToken, Threads: 2, Conns: 1}
+}
+
+// dialTest 连接 daemon，scanner 的源目录和目标目录分别为 src 和 dst
+func dialTest(t *testing.T, conf config.ClientConfig, src string, dst string) *SyncClient {
+	t.Helper()
+	scanner, err := sync.NewScanner(config.SyncConfig{Srcpath: src, Dstpath: dst, Retries: -1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sc, err := DialClient(scanner, conf, config.LimitConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(sc.Close)
+	return sc
+}
+
+func writeSrc(t *testing.T, dir string, files map[string]string) map[string]*sync.SyncFileInfo {
+	t.Helper()
+	infos := make(map[string]*sync.SyncFileInfo)
+	for name, data := range files {
+		p := filepath.Join(dir, name)
+		os.MkdirAll(filepath.Dir(p), 0755)
+		if err := os.WriteFile(p, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		info, _ := os.Stat(p)
+		infos[name] = &sync.SyncFileInfo{Name: info.Name(), Size: info.Size(), ModTime: info.ModTime(), Mode: info.Mode()}
+	}
+	return infos
+}
+
+// 服务端对单个文件的失败应答不会让流被丢弃，传输错误才会
+func TestFailedFileKeepsStream(t *testing.T) {
+	dst := t.TempDir()
+	bad := &failFS{FS: sync.Local, match: "bad"}
+	_, port := startServer(t, config.Config{}, bad)
+	src := t.TempDir()
+	infos := writeSrc(t, src, map[string]string{"bad.txt": "bad", "good.txt": "good"})
+	sc := dialTest(t, clientConfig(port), src, dst)
+	stats := sync.NewStats(infos, infos)
+	var results []error
+	finish := func(_ *SyncInfo, _ time.Duration, err error) {
+		results = append(results, err)
+	}
+	job := func(name string) *SyncInfo {
+		return &SyncInfo{FilePath: name, FileInfo: infos[name]}
+	}
+
+	err := sc.runJob(job("bad.txt"), stats, finish)
+	if err != nil || len(results) != 1 || !errors.Is(results[0], sync.ErrRemoteFailed) {
+		t.Fatalf("failed file: stream err %v, results %v", err, results)
+	}
+	// 同一个流继续同步下一个文件
+	if err := sc.runJob(job("good.txt"), stats, finish); err != nil || results[1] != nil {
+		t.Fatalf("next file on same stream: %v %v", err, results)
+	}
+	if data, _ := os.ReadFile(filepath.Join(dst, "good.txt")); string(data) != "good" {
+		t.Fatalf("good.txt: %q", data)
+	}
+	// 流关闭后的错误是传输错误
+	sc.Stop()
+	if err := sc.runJob(job("good.txt"), stats, finish); !isStreamError(err) {
+		t.Fatalf("closed stream: %v", err)
+	}
+}
+
+// frameProxy 转发客户端到 daemon 的帧，统计帧类型并可以修改帧，daemon 到客户端原样转发
+type frameProxy struct {
+	mu     gosync.Mutex
+	counts map[uint8]int
+	modify func(*Frame)
+}
+
+func startProxy(t *testing.T, port int, modify func(*Frame)) (*frameProxy, int) {
+	t.Helper()
+	proxy := &frameProxy{counts: make(map[uint8]int), modify: modify}
+	listener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			client, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			server, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
+			if err != nil {
+				client.Close()
+				continue
+			}
+			go func() {
+				io.Copy(client, server)
+				client.Close()
+			}()
+			go func() {
+				defer server.Close()
+				for {
+					frame, err := ReadFrame(client)
+					if err != nil {
+						return
+					}
+					proxy.mu.Lock()
+					proxy.counts[frame.Type]++
+					if proxy.modify != nil {
+						proxy.modify(frame)
+					}
+					proxy.mu.Unlock()
+					if WriteFrame(server, frame) != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+	return proxy, listener.Addr().(*net.TCPAddr).Port
+}
+
+func (proxy *frameProxy) count(frameType uint8) int {
+	proxy.mu.Lock()
+	defer proxy.mu.Unlock()
+	return proxy.counts[frameType]
+}
+
+// corruptPart 修改第一个文件分片的内容，fixCRC 时重新计算分片的 CRC，只有整个文件的 SHA-256 不符
+func corruptPart(fixCRC bool) func(*Frame) {
+	done := false
+	return func(frame *Frame) {
+		if done || frame.Type != MSG_FILEPART || len(frame.Payload) <= 12 {
+			return
+		}
+		done = true
+		frame.Payload[12] ^= 0xff
+		if fixCRC {
+			binary.BigEndian.PutUint32(frame.Payload[8:], crc32.Checksum(frame.Payload[12:], crcTable))
+		}
+	}
+}
+
+// 客户端经回环地址同步到 daemon：小文件和目录打包发送，大文件分片发送并受流控窗口限制
+func TestSyncFilesEndToEnd(t *testing.T) {
+	dst := t.TempDir()
+	_, port := startServer(t, config.Config{}, sync.Local)
+	proxy, proxyPort := startProxy(t, port, nil)
+	src := t.TempDir()
+	files := map[string]string{
+		"large.bin": strings.Repeat("large file content ", 3*streamWindow/19),
+	}
+	for i := 0; i < 20; i++ {
+		files[filepath.Join("small", fmt.Sprintf("f%02d.txt", i))] = fmt.Sprintf("small file %d", i)
+	}
+	infos := writeSrc(t, src, files)
+	infos["small"] = &sync.SyncFileInfo{Name: "small", Mode: os.ModeDir | 0755, ModTime: time.Now(), IsDir: true}
+
+	sc := dialTest(t, clientConfig(proxyPort), src, dst)
+	stats := sync.NewStats(infos, infos)
+	sc.SyncFiles(infos, stats)
+	report := stats.Report()
+	if report.FilesDone != int64(len(infos)) || report.FilesFailed != 0 {
+		t.Fatalf("done %v failed %v: %v", report.FilesDone, report.FilesFailed, report.Failures)
+	}
+	for name, data := range files {
+		if got, _ := os.ReadFile(filepath.Join(dst, name)); string(got) != data {
+			t.Fatalf("%v: %v bytes, want %v", name, len(got), len(data))
+		}
+	}
+	if n := proxy.count(MSG_BATCH); n != 1 {
+		t.Fatalf("%v batch frames", n)
+	}
+	if n := proxy.count(MSG_FILEPART); n < 3*streamWindow/maxDataChunk {
+		t.Fatalf("%v file part frames", n)
+	}
+}
+
+// 分片 CRC 或整个文件的 SHA-256 不符时文件失败，目标文件不变，同一个流继续使用
+func TestSyncFileChecksumMismatch(t *testing.T) {
+	for _, fixCRC := range []bool{false, true} {
+		dst := t.TempDir()
+		_, port := startServer(t, config.Config{}, sync.Local)
+		_, proxyPort := startProxy(t, port, corruptPart(fixCRC))
+		src := t.TempDir()
+		infos := writeSrc(t, src, map[string]string{"a.txt": "content a", "b.txt": "content b"})
+		sc := dialTest(t, clientConfig(proxyPort), src, dst)
+		stats := sync.NewStats(infos, infos)
+		var results []error
+		finish := func(_ *SyncInfo, _ time.Duration, err error) {
+			results = append(results, err)
+		}
+		for _, name := range []string{"a.txt", "b.txt"} {
+			if err := sc.runJob(&SyncInfo{FilePath: name, FileInfo: infos[name]}, stats, finish); err != nil {
+				t.Fatalf("fixCRC %v: stream err %v", fixCRC, err)
+			}
+		}
+		if !errors.Is(results[0], ErrChecksumMismatch) || results[1] != nil {
+			t.Fatalf("fixCRC %v: results %v", fixCRC, results)
+		}
+		if _, err := os.Stat(filepath.Join(dst, "a.txt")); !errors.Is(err, os.ErrNotExist) {
+			t.Fatalf("fixCRC %v: corrupted file written: %v", fixCRC, err)
+		}
+		if data, _ := os.ReadFile(filepath.Join(dst, "b.txt")); string(data) != "content b" {
+			t.Fatalf("fixCRC %v: b.txt %q", fixCRC, data)
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package net
+
+import (
+	gosync "sync"
+	"sync/atomic"
+	"time"
+
+	"stacktrace.top/filesync/config"
+	"stacktrace.top/filesync/logger"
+)
+
+// 按时间段计划刷新限速的间隔
+const limitRefreshInterval = time.Minute
+
+// rateLimits 是一个服务端或客户端实例使用的限速，全局限速由实例的所有连接共享。
+// 生效的限速(字节/秒)为 0 表示不限速，按时间段计划定时刷新，也可以在运行时修改
+type rateLimits struct {
+	global  int64
+	perConn int64
+	// 全局限速的令牌桶
+	limiter *RateLimiter
+
+	mu   gosync.Mutex
+	conf config.LimitConfig
+	// 上次按配置计算出的限速，只有计算结果变化时才覆盖运行时的调整
+	applied [2]int
+	// 下次按计划刷新的时间，UnixNano
+	next int64
+}
+
+func newRateLimits(conf config.LimitConfig) *rateLimits {
+	limits := &rateLimits{conf: conf, applied: [2]int{-1, -1}}
+	limits.limiter = newRateLimiter(&limits.global)
+	limits.apply(time.Now())
+	return limits
+}
+
+// RateLimiter 令牌桶限速，速率从共享变量读取，便于运行时调整所有连接
+type RateLimiter struct {
+	mu     gosync.Mutex
+	rate   *int64
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(rate *int64) *RateLimiter {
+	return &RateLimiter{
+		rate: rate,
+		last: time.Now(),
+	}
+}
+
+// WaitN 取走 n 个令牌，令牌不足时按欠额等待
+func (l *RateLimiter) WaitN(n int) {
+	rate := atomic.LoadInt64(l.rate)
+	if rate <= 0 {
+		return
+	}
+	l.mu.Lock()
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * float64(rate)
+	// 桶容量为一秒的流量
+	if l.tokens > float64(rate) {
+		l.tokens = float64(rate)
+	}
+	l.last = now
+	l.tokens -= float64(n)
+	wait := time.Duration(0)
+	if l.tokens < 0 {
+		wait = time.Duration(-l.tokens / float64(rate) * float64(time.Second))
+	}
+	l.mu.Unlock()
+	if wait > 0 {
+		time.Sleep(wait)
+	}
+}
+
+// set 在运行时调整限速，单位 KB/s，0 表示不限速。下一次计划刷新前有效
+func (limits *rateLimits) set(global int64, perConn int64) {
+	atomic.StoreInt64(&limits.global, global*1024)
+	atomic.StoreInt64(&limits.perConn, perConn*1024)
+	logger.Info("rate limit set. global: %v KB/s, per conn: %v KB/s", global, perConn)
+}
+
+// current 返回当前生效的限速，单位 KB/s
+func (limits *rateLimits) current() (int64, int64) {
+	return atomic.LoadInt64(&limits.global) / 1024, atomic.LoadInt64(&limits.perConn) / 1024
+}
+
+// setConfig 替换限速配置并立即按当前时间段生效，用于重新加载配置
+func (limits *rateLimits) setConfig(conf config.LimitConfig) {
+	limits.mu.Lock()
+	limits.conf = conf
+	limits.mu.Unlock()
+	limits.apply(time.Now())
+}
+
+func (limits *rateLimits) limitConfig() config.LimitConfig {
+	limits.mu.Lock()
+	defer limits.mu.Unlock()
+	return limits.conf
+}
+
+// apply 按配置与当前时间段计算限速
+func (limits *rateLimits) apply(now time.Time) {
+	limits.mu.Lock()
+	defer limits.mu.Unlock()
+	atomic.StoreInt64(&limits.next, now.Add(limitRefreshInterval).UnixNano())
+	global, perConn := limits.conf.Global, limits.conf.Perconn
+	for _, schedule := range limits.conf.Schedule {
+		if inSchedule(now, schedule.Start, schedule.End) {
+			global, perConn = schedule.Global, schedule.Perconn
+			break
+		}
+	}
+	if limits.applied != [2]int{global, perConn} {
+		limits.applied = [2]int{global, perConn}
+		limits.set(int64(global), int64(perConn))
+	}
+}
+
+// refresh 距上次计算超过刷新间隔时按时间段计划重新计算，在发送数据时调用，不需要单独的定时协程
+func (limits *rateLimits) refresh() {
+	now := time.Now()
+	if now.UnixNano() >= atomic.LoadInt64(&limits.next) {
+		limits.apply(now)
+	}
+}
+
+func inSchedule(now time.Time, start string, end string) bool {
+	startTime, err := time.Parse("15:04", start)
+	if err != nil {
+		logger.Error("invalid schedule start: %v", start)
+		return false
+	}
+	endTime, err := time.Parse("15:04", end)
+	if err != nil {
+		logger.Error("invalid schedule end: %v", end)
+		return false
+	}
+	minutes := now.Hour()*60 + now.Minute()
+	startMinutes := startTime.Hour()*60 + startTime.Minute()
+	endMinutes := endTime.Hour()*60 + endTime.Minute()
+	if startMinutes <= endMinutes {
+		return minutes >= startMinutes && minutes < endMinutes
+	}
+	// 跨零点的时间段
+	return minutes >= startMinutes || minutes < endMinutes
+}
+
+func isDataFrame(frameType uint8) bool {
+	return frameType == MSG_FILEPART || frameType == MSG_BATCH
+}
@@ -0,0 +1,104 @@
+package net
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"stacktrace.top/filesync/logger"
+	"stacktrace.top/filesync/sync"
+)
+
+// receiveFile 接收客户端推送的文件内容，逐片校验 CRC32C，结束时校验整个文件的 SHA-256。
+// info.Size 为 -1 时大小未知，读到 MSG_FILEDONE 为止，结束后 info.Size 为收到的大小。
+// 返回应答码和错误信息；返回 error 表示流的状态已不可信，需要断开
+func (syncServer *SyncServer) receiveFile(dstPath string, info *sync.SyncFileInfo) (int, string, []byte, error) {
+	resCode, resErr := RES_SUCCESS, ""
+	fail := func(code int, msg string) {
+		// 只保留第一个错误，之后继续读完客户端推送的数据
+		if resCode == RES_SUCCESS {
+			resCode, resErr = code, msg
+		}
+	}
+	tmpPath := sync.TempPath(dstPath)
+	fsys := syncServer.fs
+	fsys.MkdirAll(filepath.Dir(dstPath), os.ModePerm)
+	file, err := fsys.Create(tmpPath, info.Mode)
+	if err != nil {
+		logger.Error("open file failed. file: %v, err: %v", tmpPath, err)
+		fail(RES_FAILED, "open file failed")
+		file = nil
+	}
+	abort := func(err error) (int, string, []byte, error) {
+		if file != nil {
+			file.Close()
+			fsys.Remove(tmpPath)
+		}
+		return 0, "", nil, err
+	}
+	hasher := sha256.New()
+	offset := int64(0)
+	var sum []byte
+	for sum == nil {
+		frame, err := syncServer.conn.ReadFrame()
+		if err != nil {
+			return abort(err)
+		}
+		if offset == info.Size || (info.Size < 0 && frame.Type == MSG_FILEDONE) {
+			if sum, err = parseFileDone(frame); err != nil {
+				return abort(err)
+			}
+			continue
+		}
+		partOffset, data, err := parseFilePart(frame)
+		if err == ErrChunkChecksum {
+			logger.Error("chunk checksum mismatch. file: %v, offset: %v", dstPath, partOffset)
+			fail(RES_CHECKSUM, fmt.Sprintf("chunk checksum mismatch at offset %v", partOffset))
+		} else if err != nil {
+			return abort(err)
+		}
+		syncServer.srv.metrics.bytesRead(syncServer.account, int64(len(data)))
+		if partOffset != offset || (info.Size >= 0 && offset+int64(len(data)) > info.Size) {
+			return abort(fmt.Errorf("invalid file part. file: %v, offset: %v, size: %v", dstPath, partOffset, len(data)))
+		}
+		if file != nil && resCode == RES_SUCCESS {
+			hasher.Write(data)
+			if _, err := file.Write(data); err != nil {
+				logger.Error("write file failed. file: %v, err: %v", tmpPath, err)
+				fail(RES_FAILED, "write file failed: "+err.Error())
+			}
+		}
+		offset += int64(len(data))
+	}
+	if info.Size < 0 {
+		info.Size = offset
+	}
+	if file == nil {
+		return resCode, resErr, nil, nil
+	}
+	if resCode == RES_SUCCESS {
+		if err := file.Sync(); err != nil {
+			fail(RES_FAILED, "sync file failed: "+err.Error())
+		}
+	}
+	if err := file.Close(); err != nil {
+		fail(RES_FAILED, "close file failed: "+err.Error())
+	}
+	if resCode == RES_SUCCESS && !bytes.Equal(sum, hasher.Sum(nil)) {
+		logger.Error("file checksum mismatch. file: %v", dstPath)
+		fail(RES_CHECKSUM, "file checksum mismatch")
+	}
+	if resCode == RES_SUCCESS {
+		if err := fsys.Rename(tmpPath, dstPath); err != nil {
+			logger.Error("rename file: %v failed.err: %v", tmpPath, err)
+			fail(RES_FAILED, "rename file failed: "+err.Error())
+		}
+	}
+	if resCode != RES_SUCCESS {
+		fsys.Remove(tmpPath)
+		return resCode, resErr, nil, nil
+	}
+	return resCode, resErr, sum, nil
+}
@@ -0,0 +1,680 @@
+package net
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	gosync "sync"
+	"time"
+
+	"stacktrace.top/filesync/logger"
+	"stacktrace.top/filesync/sync"
+)
+
+// 远程存储操作，客户端通过它把 daemon 上的目录当作 sync.FS 使用，用于在本机加密的仓库。
+// 应答使用 SyncRespMsg，读写的文件内容以 MSG_FILEPART 和 MSG_FILEDONE 跟在请求或应答之后
+const MSG_FS = 11
+
+const (
+	// 应答的 FileInfos 只有一个条目
+	FS_STAT = 0
+	// 应答的 FileInfos 以条目名为键，不进入子目录
+	FS_READDIR = 1
+	// 应答的 PartSize 为文件大小，之后发送文件内容
+	FS_READ = 2
+	// 请求之后发送文件内容，以 MSG_FILEDONE 结束，Size 为 -1 表示大小未知，写入临时文件后替换 Path
+	FS_WRITE   = 3
+	FS_RENAME  = 4
+	FS_REMOVE  = 5
+	FS_MKDIR   = 6
+	FS_CHTIMES = 7
+	FS_CHMOD   = 8
+	FS_LINK    = 9
+)
+
+// ErrFSDisabled 表示 daemon 没有配置 reporoot，不接受远程存储操作
+var ErrFSDisabled = errors.New("remote fs is disabled on server")
+
+// ErrPathOutsideRoot 表示远程存储操作的路径不在 daemon 的 reporoot 内
+var ErrPathOutsideRoot = errors.New("path outside repository root")
+
+var fsOpNames = []string{"stat", "readdir", "open", "write", "rename", "remove", "mkdir", "chtimes", "chmod", "link"}
+
+type SyncFSMsg struct {
+	Op   uint8
+	Path string
+	// 改名和硬链接的目标
+	NewPath string
+	Mode    os.FileMode
+	ModTime time.Time
+	Size    int64
+}
+
+func (msg *SyncFSMsg) marshal() []byte {
+	e := &encoder{}
+	e.uint8(msg.Op)
+	e.string(filepath.ToSlash(msg.Path))
+	e.string(filepath.ToSlash(msg.NewPath))
+	e.uint32(uint32(msg.Mode))
+	e.time(msg.ModTime)
+	e.int64(msg.Size)
+	return e.buf.Bytes()
+}
+
+func (msg *SyncFSMsg) unmarshal(data []byte) error {
+	d := &decoder{data: data}
+	fromSlash := func(s string) string {
+		return filepath.FromSlash(strings.ReplaceAll(s, "\\", "/"))
+	}
+	msg.Op = d.uint8()
+	msg.Path = fromSlash(d.string())
+	msg.NewPath = fromSlash(d.string())
+	msg.Mode = os.FileMode(d.uint32())
+	msg.ModTime = d.time()
+	msg.Size = d.int64()
+	return d.finish()
+}
+
+func (msg *SyncFSMsg) opName() string {
+	if int(msg.Op) < len(fsOpNames) {
+		return fsOpNames[msg.Op]
+	}
+	return fmt.Sprintf("op %d", msg.Op)
+}
+
+// remoteFileInfo 把应答中的条目信息作为 os.FileInfo 使用
+type remoteFileInfo struct {
+	info *sync.SyncFileInfo
+}
+
+func (i remoteFileInfo) Name() string       { return i.info.Name }
+func (i remoteFileInfo) Size() int64        { return i.info.Size }
+func (i remoteFileInfo) Mode() os.FileMode  { return i.info.Mode }
+func (i remoteFileInfo) ModTime() time.Time { return i.info.ModTime }
+func (i remoteFileInfo) IsDir() bool        { return i.info.IsDir }
+func (i remoteFileInfo) Sys() any           { return nil }
+
+// RemoteFS 把 daemon 上的目录作为 sync.FS 使用，路径为 daemon 上的完整路径，需位于 daemon 的 reporoot 内。
+// 每个操作占用一个流，并发的操作使用各自的流，用完的流留给之后的操作
+type RemoteFS struct {
+	client *SyncClient
+	mu     gosync.Mutex
+	idle   []*Stream
+}
+
+func NewRemoteFS(sc *SyncClient) *RemoteFS {
+	return &RemoteFS{client: sc}
+}
+
+// Close 关闭客户端的会话
+func (rfs *RemoteFS) Close() error {
+	rfs.client.Close()
+	return nil
+}
+
+func (rfs *RemoteFS) stream() (*Stream, error) {
+	rfs.mu.Lock()
+	defer rfs.mu.Unlock()
+	if n := len(rfs.idle); n > 0 {
+		stream := rfs.idle[n-1]
+		rfs.idle = rfs.idle[:n-1]
+		return stream, nil
+	}
+	return rfs.client.session.OpenStream()
+}
+
+func (rfs *RemoteFS) release(stream *Stream) {
+	rfs.mu.Lock()
+	rfs.idle = append(rfs.idle, stream)
+	rfs.mu.Unlock()
+}
+
+// request 发送请求并等待应答，传输出错时关闭流，目标不存在或已存在时返回对应的 *fs.PathError
+func (rfs *RemoteFS) request(msg *SyncFSMsg) (*SyncRespMsg, error) {
+	stream, err := rfs.stream()
+	if err != nil {
+		return nil, err
+	}
+	resMsg, err := roundTrip(stream, msg)
+	if err != nil {
+		stream.Close()
+		return nil, err
+	}
+	rfs.release(stream)
+	return resMsg, responseErr(msg, resMsg)
+}
+
+func roundTrip(stream *Stream, msg *SyncFSMsg) (*SyncRespMsg, error) {
+	if err := stream.WriteFrame(MSG_FS, 0, msg.marshal()); err != nil {
+		return nil, err
+	}
+	resMsg, err := ReadForSyncRespMsg(stream)
+	if err != nil {
+		return nil, err
+	}
+	if resMsg.MsgType != MSG_FS {
+		return nil, fmt.Errorf("unexpected response type: %v", resMsg.MsgType)
+	}
+	return resMsg, nil
+}
+
+func responseErr(msg *SyncFSMsg, resMsg *SyncRespMsg) error {
+	switch resMsg.ResCode {
+	case RES_SUCCESS:
+		return nil
+	case RES_NOTEXIST:
+		return &fs.PathError{Op: msg.opName(), Path: msg.Path, Err: fs.ErrNotExist}
+	case RES_EXIST:
+		return &fs.PathError{Op: msg.opName(), Path: msg.Path, Err: fs.ErrExist}
+	case RES_CHECKSUM:
+		return fmt.Errorf("%w. %v %v failed. err: %v", ErrChecksumMismatch, msg.opName(), msg.Path, resMsg.Err)
+	default:
+		return fmt.Errorf("%w. %v %v failed. err: %v", sync.ErrRemoteFailed, msg.opName(), msg.Path, resMsg.Err)
+	}
+}
+
+func (rfs *RemoteFS) Stat(name string) (os.FileInfo, error) {
+	resMsg, err := rfs.request(&SyncFSMsg{Op: FS_STAT, Path: name})
+	if err != nil {
+		return nil, err
+	}
+	for _, info := range resMsg.FileInfos {
+		if info != nil {
+			return remoteFileInfo{info}, nil
+		}
+	}
+	return nil, fmt.Errorf("%w. stat %v: empty response", sync.ErrRemoteFailed, name)
+}
+
+func (rfs *RemoteFS) readDir(dir string) ([]os.FileInfo, error) {
+	resMsg, err := rfs.request(&SyncFSMsg{Op: FS_READDIR, Path: dir})
+	if err != nil {
+		return nil, err
+	}
+	infos := make([]os.FileInfo, 0, len(resMsg.FileInfos))
+	for _, info := range resMsg.FileInfos {
+		if info != nil {
+			infos = append(infos, remoteFileInfo{info})
+		}
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name() < infos[j].Name() })
+	return infos, nil
+}
+
+// Walk 与 filepath.Walk 相同，回调返回 SkipDir 的目录不再列出其中的条目
+func (rfs *RemoteFS) Walk(root string, fn filepath.WalkFunc) error {
+	info, err := rfs.Stat(root)
+	if err != nil {
+		err = fn(root, nil, err)
+	} else {
+		err = rfs.walk(root, info, fn)
+	}
+	if err == filepath.SkipDir || err == filepath.SkipAll {
+		return nil
+	}
+	return err
+}
+
+func (rfs *RemoteFS) walk(path string, info os.FileInfo, fn filepath.WalkFunc) error {
+	if err := fn(path, info, nil); err != nil || !info.IsDir() {
+		return err
+	}
+	infos, err := rfs.readDir(path)
+	if err != nil {
+		return fn(path, info, err)
+	}
+	for _, child := range infos {
+		if err := rfs.walk(filepath.Join(path, child.Name()), child, fn); err != nil {
+			if !child.IsDir() || err != filepath.SkipDir {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Open 返回按需接收文件内容的 reader，读到结尾时校验 SHA-256，不一致时返回 ErrChecksumMismatch
+func (rfs *RemoteFS) Open(name string) (io.ReadCloser, error) {
+	msg := &SyncFSMsg{Op: FS_READ, Path: name}
+	stream, err := rfs.stream()
+	if err != nil {
+		return nil, err
+	}
+	resMsg, err := roundTrip(stream, msg)
+	if err == nil && resMsg.ResCode == RES_SUCCESS && resMsg.PartSize < 0 {
+		err = fmt.Errorf("invalid file size: %v", resMsg.PartSize)
+	}
+	if err != nil {
+		stream.Close()
+		return nil, err
+	}
+	if err := responseErr(msg, resMsg); err != nil {
+		rfs.release(stream)
+		return nil, err
+	}
+	return &remoteReader{fs: rfs, stream: stream, name: name, size: resMsg.PartSize, hasher: sha256.New()}, nil
+}
+
+type remoteReader struct {
+	fs     *RemoteFS
+	stream *Stream
+	name   string
+	size   int64
+	offset int64
+	part   []byte
+	hasher hash.Hash
+	err    error
+}
+
+func (r *remoteReader) Read(b []byte) (int, error) {
+	for len(r.part) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		r.err = r.next()
+	}
+	n := copy(b, r.part)
+	r.part = r.part[n:]
+	return n, nil
+}
+
+// next 接收下一段内容，全部收到后校验并归还流，返回 io.EOF
+func (r *remoteReader) next() error {
+	if r.offset == r.size {
+		sum, err := readFileDone(r.stream)
+		if err != nil {
+			return r.abort(err)
+		}
+		r.fs.release(r.stream)
+		r.stream = nil
+		if !bytes.Equal(sum, r.hasher.Sum(nil)) {
+			return fmt.Errorf("%w. file: %v", ErrChecksumMismatch, r.name)
+		}
+		return io.EOF
+	}
+	offset, part, err := readFilePart(r.stream)
+	if err != nil {
+		return r.abort(err)
+	}
+	if offset != r.offset || offset+int64(len(part)) > r.size {
+		return r.abort(fmt.Errorf("invalid file part. file: %v, offset: %v, size: %v", r.name, offset, len(part)))
+	}
+	r.hasher.Write(part)
+	r.offset += int64(len(part))
+	r.part = part
+	return nil
+}
+
+func (r *remoteReader) abort(err error) error {
+	r.stream.Close()
+	r.stream = nil
+	return err
+}
+
+// Close 在没有读完时关闭流，流上剩余的内容无法再使用
+func (r *remoteReader) Close() error {
+	if r.stream != nil {
+		r.abort(nil)
+	}
+	if r.err == nil {
+		r.err = os.ErrClosed
+	}
+	return nil
+}
+
+// Create 返回的文件边写边发送，daemon 写入临时文件，关闭时校验后替换目标文件
+func (rfs *RemoteFS) Create(name string, perm os.FileMode) (sync.File, error) {
+	return &remoteFile{fs: rfs, name: name, perm: perm, hasher: sha256.New()}, nil
+}
+
+type remoteFile struct {
+	fs     *RemoteFS
+	name   string
+	perm   os.FileMode
+	stream *Stream
+	offset int64
+	buf    []byte
+	hasher hash.Hash
+	err    error
+}
+
+// Write 凑满一个数据帧后发送
+func (f *remoteFile) Write(b []byte) (int, error) {
+	n := len(b)
+	for len(b) > 0 {
+		if f.err != nil {
+			return 0, f.err
+		}
+		size := maxDataChunk - len(f.buf)
+		if size > len(b) {
+			size = len(b)
+		}
+		f.buf = append(f.buf, b[:size]...)
+		b = b[size:]
+		if len(f.buf) == maxDataChunk {
+			f.flush()
+		}
+	}
+	return n, f.err
+}
+
+// flush 发送缓存的内容，第一次发送前先发出写请求
+func (f *remoteFile) flush() {
+	if f.err != nil {
+		return
+	}
+	if f.stream == nil {
+		stream, err := f.fs.stream()
+		if err != nil {
+			f.err = err
+			return
+		}
+		f.stream = stream
+		msg := &SyncFSMsg{Op: FS_WRITE, Path: f.name, Mode: f.perm, Size: -1}
+		if err := stream.WriteFrame(MSG_FS, 0, msg.marshal()); err != nil {
+			f.fail(err)
+			return
+		}
+	}
+	if len(f.buf) == 0 {
+		return
+	}
+	// 仓库中的数据已加密，不再压缩
+	if err := writeFilePart(f.stream, f.offset, f.buf, false, 0, nil); err != nil {
+		f.fail(err)
+		return
+	}
+	f.hasher.Write(f.buf)
+	f.offset += int64(len(f.buf))
+	f.buf = f.buf[:0]
+}
+
+func (f *remoteFile) fail(err error) {
+	f.stream.Close()
+	f.stream = nil
+	f.err = err
+}
+
+func (f *remoteFile) Sync() error { return f.err }
+
+// Close 发送剩余内容和 SHA-256，等待 daemon 替换目标文件
+func (f *remoteFile) Close() error {
+	f.flush()
+	if f.err != nil {
+		return f.err
+	}
+	msg := &SyncFSMsg{Op: FS_WRITE, Path: f.name}
+	resMsg, err := func() (*SyncRespMsg, error) {
+		if err := writeFileDone(f.stream, f.hasher.Sum(nil)); err != nil {
+			return nil, err
+		}
+		resMsg, err := ReadForSyncRespMsg(f.stream)
+		if err == nil && resMsg.MsgType != MSG_FS {
+			err = fmt.Errorf("unexpected response type: %v", resMsg.MsgType)
+		}
+		return resMsg, err
+	}()
+	if err != nil {
+		f.fail(err)
+		return err
+	}
+	f.fs.release(f.stream)
+	f.stream = nil
+	f.err = os.ErrClosed
+	return responseErr(msg, resMsg)
+}
+
+func (rfs *RemoteFS) Rename(oldpath string, newpath string) error {
+	_, err := rfs.request(&SyncFSMsg{Op: FS_RENAME, Path: oldpath, NewPath: newpath})
+	return err
+}
+
+func (rfs *RemoteFS) Remove(name string) error {
+	_, err := rfs.request(&SyncFSMsg{Op: FS_REMOVE, Path: name})
+	return err
+}
+
+func (rfs *RemoteFS) MkdirAll(path string, perm os.FileMode) error {
+	_, err := rfs.request(&SyncFSMsg{Op: FS_MKDIR, Path: path, Mode: perm})
+	return err
+}
+
+// Chtimes 只设置修改时间，访问时间与修改时间相同
+func (rfs *RemoteFS) Chtimes(name string, atime time.Time, mtime time.Time) error {
+	_, err := rfs.request(&SyncFSMsg{Op: FS_CHTIMES, Path: name, ModTime: mtime})
+	return err
+}
+
+func (rfs *RemoteFS) Chmod(name string, mode os.FileMode) error {
+	_, err := rfs.request(&SyncFSMsg{Op: FS_CHMOD, Path: name, Mode: mode})
+	return err
+}
+
+func (rfs *RemoteFS) Link(oldname string, newname string) error {
+	_, err := rfs.request(&SyncFSMsg{Op: FS_LINK, Path: oldname, NewPath: newname})
+	return err
+}
+
+// remoteFS 在 daemon 的目标存储上执行客户端的远程存储操作，路径限制在 reporoot 内
+func (syncServer *SyncServer) remoteFS(payload []byte) {
+	msg := &SyncFSMsg{}
+	if err := msg.unmarshal(payload); err != nil {
+		logger.Error("parse fs msg failed. err: %v", err)
+		syncServer.Stop()
+		return
+	}
+	resMsg := &SyncRespMsg{
+		MsgType: MSG_FS,
+		ResCode: RES_SUCCESS,
+	}
+	path, err := syncServer.fsPath(msg.Path)
+	newPath := ""
+	if err == nil && (msg.Op == FS_RENAME || msg.Op == FS_LINK) {
+		newPath, err = syncServer.fsPath(msg.NewPath)
+	}
+	if err != nil {
+		logger.Error("reject fs %v. path: %v, client: %v, err: %v", msg.opName(), msg.Path, syncServer.client.Addr, err)
+		if msg.Op == FS_WRITE {
+			// 客户端已在发送内容，无法继续使用这个流
+			syncServer.Stop()
+			return
+		}
+		resMsg.ResCode = RES_FAILED
+		resMsg.Err = err.Error()
+		syncServer.response(resMsg)
+		return
+	}
+	fsys := syncServer.fs
+	switch msg.Op {
+	case FS_STAT:
+		var info os.FileInfo
+		if info, err = fsys.Stat(path); err == nil {
+			resMsg.FileInfos = map[string]*sync.SyncFileInfo{info.Name(): fsFileInfo(info)}
+		}
+	case FS_READDIR:
+		var infos []os.FileInfo
+		if infos, err = sync.ReadDirFS(fsys, path); err == nil {
+			resMsg.FileInfos = make(map[string]*sync.SyncFileInfo, len(infos))
+			for _, info := range infos {
+				resMsg.FileInfos[info.Name()] = fsFileInfo(info)
+			}
+		}
+	case FS_READ:
+		var info os.FileInfo
+		var file io.ReadCloser
+		if info, err = fsys.Stat(path); err == nil && info.IsDir() {
+			err = fmt.Errorf("%v is a directory", path)
+		}
+		if err == nil {
+			file, err = fsys.Open(path)
+		}
+		if err == nil {
+			resMsg.PartSize = info.Size()
+			syncServer.response(resMsg)
+			syncServer.sendFile(path, file, info.Size())
+			file.Close()
+			return
+		}
+	case FS_WRITE:
+		info := &sync.SyncFileInfo{Name: filepath.Base(path), Size: msg.Size, Mode: msg.Mode, ModTime: time.Now()}
+		resCode, resErr, sum, err := syncServer.receiveFile(path, info)
+		if err != nil {
+			logger.Error("read file content failed. err: %v", err)
+			syncServer.Stop()
+			return
+		}
+		syncServer.recordWrite(path, info, sum, resErr)
+		resMsg.ResCode, resMsg.Err = resCode, resErr
+		syncServer.response(resMsg)
+		return
+	case FS_RENAME:
+		err = fsys.Rename(path, newPath)
+		syncServer.recordFSOp(AUDIT_RENAME, newPath, err)
+	case FS_REMOVE:
+		err = fsys.Remove(path)
+		syncServer.recordFSOp(AUDIT_REMOVE, path, err)
+	case FS_MKDIR:
+		// 仓库保存每个数据块前都会创建目录，只记录新建的目录
+		_, statErr := fsys.Stat(path)
+		err = fsys.MkdirAll(path, msg.Mode)
+		if statErr != nil {
+			syncServer.recordFSOp(AUDIT_MKDIR, path, err)
+		}
+	case FS_CHTIMES:
+		err = fsys.Chtimes(path, msg.ModTime, msg.ModTime)
+	case FS_CHMOD:
+		err = fsys.Chmod(path, msg.Mode)
+	case FS_LINK:
+		err = fsys.Link(path, newPath)
+		syncServer.recordFSOp(AUDIT_LINK, newPath, err)
+	default:
+		err = fmt.Errorf("unknown fs op: %v", msg.Op)
+	}
+	if err != nil {
+		switch {
+		case errors.Is(err, fs.ErrNotExist):
+			resMsg.ResCode = RES_NOTEXIST
+		case errors.Is(err, fs.ErrExist):
+			resMsg.ResCode = RES_EXIST
+		default:
+			resMsg.ResCode = RES_FAILED
+		}
+		resMsg.Err = err.Error()
+	}
+	syncServer.response(resMsg)
+}
+
+// fsPath 检查客户端给出的路径：必须是绝对路径，不含 ..，清理后位于 reporoot 内；
+// 目标存储为本地文件系统时，已存在的部分解析符号链接后也不能离开 reporoot
+func (syncServer *SyncServer) fsPath(name string) (string, error) {
+	root := syncServer.srv.conf.Server.Reporoot
+	if root == "" {
+		return "", ErrFSDisabled
+	}
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return "", err
+	}
+	if !filepath.IsAbs(name) {
+		return "", fmt.Errorf("%w: %v is not absolute", ErrPathOutsideRoot, name)
+	}
+	for _, elem := range strings.Split(filepath.ToSlash(name), "/") {
+		if elem == ".." {
+			return "", fmt.Errorf("%w: %v", ErrPathOutsideRoot, name)
+		}
+	}
+	name = filepath.Clean(name)
+	if !withinRoot(root, name) {
+		return "", fmt.Errorf("%w: %v", ErrPathOutsideRoot, name)
+	}
+	if syncServer.srv.fs.FS != sync.Local {
+		return name, nil
+	}
+	// 从路径本身向上找到第一个已存在的部分，reporoot 不存在时其下也不会有符号链接
+	for p := name; ; p = filepath.Dir(p) {
+		if _, err := os.Lstat(p); err == nil {
+			realRoot, err := filepath.EvalSymlinks(root)
+			if err != nil {
+				return "", err
+			}
+			real, err := filepath.EvalSymlinks(p)
+			if err != nil {
+				return "", err
+			}
+			if !withinRoot(realRoot, real) {
+				return "", fmt.Errorf("%w: %v resolves to %v", ErrPathOutsideRoot, name, real)
+			}
+			return name, nil
+		}
+		if p == root {
+			return name, nil
+		}
+	}
+}
+
+func withinRoot(root string, name string) bool {
+	rel, err := filepath.Rel(root, name)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) && !filepath.IsAbs(rel)
+}
+
+// sendFile 在 FS_READ 的应答之后边读边发送 size 字节的文件内容，读取失败时只能断开流
+func (syncServer *SyncServer) sendFile(name string, file io.Reader, size int64) {
+	hasher := sha256.New()
+	buf := make([]byte, maxDataChunk)
+	for offset := int64(0); offset < size; {
+		n := int64(len(buf))
+		if n > size-offset {
+			n = size - offset
+		}
+		if _, err := io.ReadFull(file, buf[:n]); err != nil {
+			logger.Error("read file failed. file: %v, err: %v", name, err)
+			syncServer.Stop()
+			return
+		}
+		if err := writeFilePart(syncServer.conn, offset, buf[:n], false, 0, nil); err != nil {
+			syncServer.Stop()
+			return
+		}
+		hasher.Write(buf[:n])
+		offset += n
+	}
+	if err := writeFileDone(syncServer.conn, hasher.Sum(nil)); err != nil {
+		syncServer.Stop()
+	}
+}
+
+// recordFSOp 在审计日志中记录远程存储操作改变的路径
+func (syncServer *SyncServer) recordFSOp(op string, path string, err error) {
+	if syncServer.srv.audit == nil {
+		return
+	}
+	entry := &AuditEntry{
+		Time:    time.Now(),
+		Client:  syncServer.client.Addr,
+		Account: syncServer.account,
+		Op:      op,
+		Path:    path,
+	}
+	if err != nil {
+		entry.Error = err.Error()
+	}
+	syncServer.srv.audit.record(entry)
+}
+
+func fsFileInfo(info os.FileInfo) *sync.SyncFileInfo {
+	return &sync.SyncFileInfo{
+		Name:    info.Name(),
+		Size:    info.Size(),
+		ModTime: info.ModTime(),
+		Mode:    info.Mode(),
+		IsDir:   info.IsDir(),
+	}
+}
@@ -0,0 +1,196 @@
+package net
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"stacktrace.top/filesync/config"
+	"stacktrace.top/filesync/sync"
+)
+
+// dialRemoteFS 启动 reporoot 为 root 的 daemon 并返回客户端的 RemoteFS
+func dialRemoteFS(t *testing.T, root string) *RemoteFS {
+	t.Helper()
+	conf := config.Config{}
+	conf.Server.Reporoot = root
+	_, port := startServer(t, conf, sync.Local)
+	return NewRemoteFS(dialTest(t, clientConfig(port), t.TempDir(), t.TempDir()))
+}
+
+func writeRemote(rfs *RemoteFS, name string, data []byte) error {
+	file, err := rfs.Create(name, 0600)
+	if err != nil {
+		return err
+	}
+	// 分多次写入，跨越数据帧的边界
+	for len(data) > 0 {
+		n := len(data)
+		if n > 3<<20 {
+			n = 3 << 20
+		}
+		if _, err := file.Write(data[:n]); err != nil {
+			file.Close()
+			return err
+		}
+		data = data[n:]
+	}
+	return file.Close()
+}
+
+func TestRemoteFSOperations(t *testing.T) {
+	root := t.TempDir()
+	rfs := dialRemoteFS(t, root)
+	dir := filepath.Join(root, "repo", "data")
+	if err := rfs.MkdirAll(dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	content := bytes.Repeat([]byte("0123456789abcdef"), (2*maxDataChunk+100)/16)
+	name := filepath.Join(dir, "chunk")
+	if err := writeRemote(rfs, name, content); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(name); !bytes.Equal(data, content) {
+		t.Fatalf("written %v bytes, want %v", len(data), len(content))
+	}
+	if err := writeRemote(rfs, filepath.Join(dir, "empty"), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := rfs.Stat(name)
+	if err != nil || info.Size() != int64(len(content)) || info.IsDir() {
+		t.Fatalf("stat: %v %v", info, err)
+	}
+	file, err := rfs.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(file)
+	file.Close()
+	if err != nil || !bytes.Equal(data, content) {
+		t.Fatalf("read %v bytes, err %v", len(data), err)
+	}
+
+	// 没有读完就关闭，之后的操作使用新的流
+	file, err = rfs.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := file.Read(make([]byte, 10)); err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	if err := rfs.Chtimes(name, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+	if err := rfs.Chmod(name, 0640); err != nil {
+		t.Fatal(err)
+	}
+	linked := filepath.Join(root, "repo", "linked")
+	if err := rfs.Link(name, linked); err != nil {
+		t.Fatal(err)
+	}
+	renamed := filepath.Join(root, "repo", "renamed")
+	if err := rfs.Rename(name, renamed); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Stat(renamed); err != nil || !info.ModTime().Equal(mtime) || info.Mode().Perm() != 0640 {
+		t.Fatalf("renamed: %v %v", info, err)
+	}
+
+	var walked []string
+	err = rfs.Walk(filepath.Join(root, "repo"), func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(root, path)
+		walked = append(walked, filepath.ToSlash(rel))
+		return nil
+	})
+	if want := "repo repo/data repo/data/empty repo/linked repo/renamed"; err != nil || strings.Join(walked, " ") != want {
+		t.Fatalf("walk: %v %v", walked, err)
+	}
+
+	if err := rfs.Remove(renamed); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rfs.Stat(renamed); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("stat removed: %v", err)
+	}
+	if _, err := rfs.Open(renamed); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("open removed: %v", err)
+	}
+}
+
+// 路径不能通过 ..、reporoot 外的绝对路径或符号链接离开 reporoot
+func TestRemoteFSConfinement(t *testing.T) {
+	root := t.TempDir()
+	outside := t.TempDir()
+	os.WriteFile(filepath.Join(outside, "secret"), []byte("secret"), 0600)
+	if err := os.Symlink(outside, filepath.Join(root, "escape")); err != nil {
+		t.Skip("symlink not supported:", err)
+	}
+	rfs := dialRemoteFS(t, root)
+
+	rejected := func(err error) bool {
+		return errors.Is(err, sync.ErrRemoteFailed) && strings.Contains(err.Error(), ErrPathOutsideRoot.Error())
+	}
+	for _, name := range []string{
+		filepath.Join(outside, "secret"),
+		root + string(filepath.Separator) + ".." + string(filepath.Separator) + filepath.Base(outside),
+		filepath.Join(root, "escape", "secret"),
+		filepath.Join(root, "escape"),
+		"secret",
+	} {
+		if _, err := rfs.Stat(name); !rejected(err) {
+			t.Errorf("stat %v: %v", name, err)
+		}
+		if _, err := rfs.Open(name); !rejected(err) {
+			t.Errorf("open %v: %v", name, err)
+		}
+		if err := rfs.Remove(name); !rejected(err) {
+			t.Errorf("remove %v: %v", name, err)
+		}
+	}
+	inside := filepath.Join(root, "file")
+	if err := writeRemote(rfs, inside, []byte("data")); err != nil {
+		t.Fatal(err)
+	}
+	if err := rfs.Rename(inside, filepath.Join(root, "escape", "moved")); !rejected(err) {
+		t.Errorf("rename: %v", err)
+	}
+	if err := rfs.Link(inside, filepath.Join(outside, "linked")); !rejected(err) {
+		t.Errorf("link: %v", err)
+	}
+	if err := rfs.MkdirAll(filepath.Join(root, "escape", "dir"), 0700); !rejected(err) {
+		t.Errorf("mkdir: %v", err)
+	}
+	// 写入被拒绝时 daemon 断开流，不会在 reporoot 外创建文件
+	if err := writeRemote(rfs, filepath.Join(root, "escape", "new"), []byte("data")); err == nil {
+		t.Error("write through symlink succeeded")
+	}
+	entries, _ := os.ReadDir(outside)
+	if len(entries) != 1 {
+		t.Errorf("outside dir changed: %v", entries)
+	}
+	// 之后的操作不受影响
+	if _, err := rfs.Stat(inside); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRemoteFSDisabled(t *testing.T) {
+	rfs := dialRemoteFS(t, "")
+	_, err := rfs.Stat(t.TempDir())
+	if !errors.Is(err, sync.ErrRemoteFailed) || !strings.Contains(err.Error(), ErrFSDisabled.Error()) {
+		t.Fatalf("stat: %v", err)
+	}
+}
@@ -0,0 +1,243 @@
+package net
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"stacktrace.top/filesync/logger"
+	"stacktrace.top/filesync/sync"
+)
+
+// 快照目录操作，应答使用 SyncRespMsg
+const MSG_SNAPSHOT = 10
+
+const (
+	// 列出 Dir 下的快照，应答的 FileInfos 以快照名为键
+	SNAPSHOT_LIST = 0
+	// 创建 Dir 并把 From 中的条目硬链接过去，应答的 Failed 为失败条目
+	SNAPSHOT_LINK = 1
+	// 删除快照 Dir
+	SNAPSHOT_REMOVE = 2
+)
+
+type SyncSnapshotMsg struct {
+	Op      uint8
+	Dir     string
+	From    string
+	Entries map[string]*sync.SyncFileInfo
+}
+
+func (msg *SyncSnapshotMsg) marshal() []byte {
+	e := &encoder{}
+	e.uint8(msg.Op)
+	e.string(filepath.ToSlash(msg.Dir))
+	e.string(filepath.ToSlash(msg.From))
+	e.uint32(uint32(len(msg.Entries)))
+	for k, v := range msg.Entries {
+		e.string(filepath.ToSlash(k))
+		e.fileInfo(v)
+	}
+	return e.buf.Bytes()
+}
+
+func (msg *SyncSnapshotMsg) unmarshal(data []byte) error {
+	d := &decoder{data: data}
+	fromSlash := func(s string) string {
+		return filepath.FromSlash(strings.ReplaceAll(s, "\\", "/"))
+	}
+	msg.Op = d.uint8()
+	msg.Dir = fromSlash(d.string())
+	msg.From = fromSlash(d.string())
+	count := d.uint32()
+	if count > maxBatchEntries {
+		return fmt.Errorf("too many snapshot entries: %d", count)
+	}
+	msg.Entries = make(map[string]*sync.SyncFileInfo, count)
+	for i := uint32(0); i < count && d.err == nil; i++ {
+		k := fromSlash(d.string())
+		info := d.fileInfo()
+		if d.err == nil && info == nil {
+			return errors.New("snapshot entry without file info")
+		}
+		msg.Entries[k] = info
+	}
+	return d.finish()
+}
+
+// snapshotRequest 发送快照操作并等待应答
+func (sc *SyncClient) snapshotRequest(msg *SyncSnapshotMsg) (*SyncRespMsg, error) {
+	if err := sc.conn.WriteFrame(MSG_SNAPSHOT, 0, msg.marshal()); err != nil {
+		return nil, err
+	}
+	resMsg, err := ReadForSyncRespMsg(sc.conn)
+	if err != nil {
+		return nil, err
+	}
+	if resMsg.MsgType != MSG_SNAPSHOT || resMsg.ResCode != RES_SUCCESS {
+		return nil, fmt.Errorf("%w. snapshot op %v on %v failed. err: %v", sync.ErrRemoteFailed, msg.Op, msg.Dir, resMsg.Err)
+	}
+	return resMsg, nil
+}
+
+func (sc *SyncClient) ListSnapshots(root string) ([]string, error) {
+	resMsg, err := sc.snapshotRequest(&SyncSnapshotMsg{Op: SNAPSHOT_LIST, Dir: root})
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(resMsg.FileInfos))
+	for name := range resMsg.FileInfos {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (sc *SyncClient) SnapshotInfo(dir string) (map[string]*sync.SyncFileInfo, error) {
+	return sc.FetchDirInfo(dir, false)
+}
+
+// LinkSnapshot 按批发送需要链接的条目，避免单条消息过大
+func (sc *SyncClient) LinkSnapshot(from string, to string, entries map[string]*sync.SyncFileInfo) (map[string]error, error) {
+	failed := make(map[string]error)
+	msg := &SyncSnapshotMsg{Op: SNAPSHOT_LINK, Dir: to, From: from, Entries: make(map[string]*sync.SyncFileInfo)}
+	send := func() error {
+		resMsg, err := sc.snapshotRequest(msg)
+		if err != nil {
+			return err
+		}
+		for k, v := range resMsg.Failed {
+			failed[filepath.FromSlash(k)] = fmt.Errorf("%w: %v", sync.ErrRemoteFailed, v)
+		}
+		msg.Entries = make(map[string]*sync.SyncFileInfo)
+		return nil
+	}
+	for k, v := range entries {
+		msg.Entries[k] = v
+		if len(msg.Entries) >= fileListBatch {
+			if err := send(); err != nil {
+				return failed, err
+			}
+		}
+	}
+	// 没有条目时也要发送一次以创建快照目录
+	if len(msg.Entries) > 0 || len(entries) == 0 {
+		if err := send(); err != nil {
+			return failed, err
+		}
+	}
+	return failed, nil
+}
+
+func (sc *SyncClient) RemoveSnapshot(dir string) error {
+	_, err := sc.snapshotRequest(&SyncSnapshotMsg{Op: SNAPSHOT_REMOVE, Dir: dir})
+	return err
+}
+
+func (syncServer *SyncServer) snapshot(payload []byte) {
+	resMsg := &SyncRespMsg{
+		MsgType: MSG_SNAPSHOT,
+		ResCode: RES_SUCCESS,
+	}
+	msg := &SyncSnapshotMsg{}
+	if err := msg.unmarshal(payload); err != nil {
+		logger.Error("parse snapshot msg failed. err: %v", err)
+		syncServer.Stop()
+		return
+	}
+	fail := func(err error) {
+		resMsg.ResCode = RES_FAILED
+		resMsg.Err = err.Error()
+	}
+	switch msg.Op {
+	case SNAPSHOT_LIST:
+		names, err := sync.ListSnapshotDirs(syncServer.fs, msg.Dir)
+		if err != nil {
+			fail(err)
+			break
+		}
+		resMsg.FileInfos = make(map[string]*sync.SyncFileInfo, len(names))
+		for _, name := range names {
+			resMsg.FileInfos[name] = &sync.SyncFileInfo{Name: name, IsDir: true}
+		}
+	case SNAPSHOT_LINK:
+		failed, err := sync.LinkFiles(syncServer.fs, msg.From, msg.Dir, msg.Entries)
+		syncServer.recordLinks(msg, failed, err)
+		if err != nil {
+			fail(err)
+			break
+		}
+		logger.Info("snapshot %v: linked %v entries from %v", msg.Dir, len(msg.Entries)-len(failed), msg.From)
+		for k, v := range failed {
+			if resMsg.Failed == nil {
+				resMsg.Failed = make(map[string]string)
+			}
+			resMsg.Failed[filepath.ToSlash(k)] = v.Error()
+		}
+	case SNAPSHOT_REMOVE:
+		err := sync.RemoveSnapshotDir(syncServer.fs, msg.Dir)
+		if syncServer.srv.audit != nil {
+			entry := &AuditEntry{
+				Time:    time.Now(),
+				Client:  syncServer.client.Addr,
+				Account: syncServer.account,
+				Op:      AUDIT_RMSNAPSHOT,
+				Path:    msg.Dir,
+			}
+			if err != nil {
+				entry.Error = err.Error()
+			}
+			syncServer.srv.audit.record(entry)
+		}
+		if err != nil {
+			fail(err)
+			break
+		}
+		logger.Info("snapshot %v removed", msg.Dir)
+	default:
+		fail(fmt.Errorf("unknown snapshot op: %v", msg.Op))
+	}
+	syncServer.response(resMsg)
+}
+
+// recordLinks 在审计日志中记录快照硬链接的每个条目，与写入和删除快照一致
+func (syncServer *SyncServer) recordLinks(msg *SyncSnapshotMsg, failed map[string]error, err error) {
+	audit := syncServer.srv.audit
+	if audit == nil {
+		return
+	}
+	now := time.Now()
+	if err != nil {
+		audit.record(&AuditEntry{
+			Time:    now,
+			Client:  syncServer.client.Addr,
+			Account: syncServer.account,
+			Op:      AUDIT_LINK,
+			Path:    msg.Dir,
+			Error:   err.Error(),
+		})
+		return
+	}
+	for relPath, info := range msg.Entries {
+		entry := &AuditEntry{
+			Time:    now,
+			Client:  syncServer.client.Addr,
+			Account: syncServer.account,
+			Op:      AUDIT_LINK,
+			Path:    filepath.Join(msg.Dir, relPath),
+			Hash:    info.Hash,
+		}
+		if info.IsDir {
+			entry.Op = AUDIT_MKDIR
+		} else {
+			entry.Size = info.Size
+		}
+		if linkErr, ok := failed[relPath]; ok {
+			entry.Error = linkErr.Error()
+		}
+		audit.record(entry)
+	}
+}
@@ -0,0 +1,91 @@
+package repo
+
+import (
+	"io"
+)
+
+// 按内容切分数据块：插入或删除数据只影响附近的块，其余块的边界和哈希不变
+const (
+	minChunk = 512 * 1024
+	maxChunk = 8 * 1024 * 1024
+	// 平均块大小约 1 MiB
+	chunkMask = 1<<20 - 1
+)
+
+// gear 表由固定种子生成，切分结果在不同版本和机器间保持一致
+var gear [256]uint64
+
+func init() {
+	seed := uint64(0x66696c6573796e63)
+	for i := range gear {
+		// splitmix64
+		seed += 0x9e3779b97f4a7c15
+		z := seed
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		gear[i] = z ^ (z >> 31)
+	}
+}
+
+// Chunker 把数据流切分为内容定义的数据块
+type Chunker struct {
+	r     io.Reader
+	buf   []byte
+	start int
+	end   int
+	eof   bool
+}
+
+func NewChunker(r io.Reader) *Chunker {
+	return &Chunker{r: r, buf: make([]byte, 2*maxChunk)}
+}
+
+// fill 保证缓冲区中至少有 maxChunk 字节，除非已读到结尾
+func (c *Chunker) fill() error {
+	if c.end-c.start >= maxChunk || c.eof {
+		return nil
+	}
+	if c.start > 0 {
+		c.end = copy(c.buf, c.buf[c.start:c.end])
+		c.start = 0
+	}
+	for c.end < len(c.buf) && !c.eof {
+		n, err := c.r.Read(c.buf[c.end:])
+		c.end += n
+		if err == io.EOF {
+			c.eof = true
+		} else if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Next 返回下一个数据块，结束时返回 io.EOF。返回的切片在下次调用前有效
+func (c *Chunker) Next() ([]byte, error) {
+	if err := c.fill(); err != nil {
+		return nil, err
+	}
+	n := c.end - c.start
+	if n == 0 {
+		return nil, io.EOF
+	}
+	if n > maxChunk {
+		n = maxChunk
+	}
+	cut := n
+	if n > minChunk {
+		data := c.buf[c.start : c.start+n]
+		var h uint64
+		for i := minChunk; i < n; i++ {
+			h = (h << 1) + gear[data[i]]
+			if h&chunkMask == 0 {
+				cut = i + 1
+				break
+			}
+		}
+	}
+	chunk := c.buf[c.start : c.start+cut]
+	c.start += cut
+	return chunk, nil
+}
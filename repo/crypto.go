@@ -0,0 +1,149 @@
+package repo
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/pbkdf2"
+
+	"stacktrace.top/filesync/config"
+)
+
+const (
+	kdfName    = "pbkdf2-sha256"
+	cipherName = "aes-256-gcm"
+	// 口令派生密钥的迭代次数，保存在仓库中，之后可以调整
+	kdfIterations = 600000
+	saltSize      = 32
+)
+
+var ErrWrongPassword = errors.New("wrong repository password")
+
+// encryptionMeta 保存在 repo.json 中，主密钥用口令派生的密钥加密
+type encryptionMeta struct {
+	KDF        string
+	Iterations int
+	Salt       []byte
+	Cipher     string
+	Key        []byte
+}
+
+// repoKey 是解密后的主密钥：数据用 AES-256-GCM 加密，数据块 ID 用 HMAC-SHA256 计算，
+// 不泄露明文的哈希
+type repoKey struct {
+	aead   cipher.AEAD
+	macKey []byte
+}
+
+// repoPassword 读取配置的仓库口令，口令文件优先
+func repoPassword(conf config.RepoConfig) (string, error) {
+	if name := conf.Passwordfile; name != "" {
+		data, err := os.ReadFile(name)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimRight(string(data), "\r\n"), nil
+	}
+	return conf.Password, nil
+}
+
+// deriveKey 用 PBKDF2-HMAC-SHA256 从口令派生加密主密钥的密钥
+func deriveKey(password string, meta *encryptionMeta) []byte {
+	return pbkdf2.Key([]byte(password), meta.Salt, meta.Iterations, 32, sha256.New)
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// newRepoKey 由 64 字节主密钥构造，前 32 字节用于加密，后 32 字节用于数据块 ID
+func newRepoKey(master []byte) (*repoKey, error) {
+	aead, err := newAEAD(master[:32])
+	if err != nil {
+		return nil, err
+	}
+	return &repoKey{aead: aead, macKey: master[32:]}, nil
+}
+
+// seal 加密数据，输出为 nonce 加密文，aad 绑定数据的用途，防止被替换
+func seal(aead cipher.AEAD, data []byte, aad []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(data)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, data, aad), nil
+}
+
+func open(aead cipher.AEAD, data []byte, aad []byte) ([]byte, error) {
+	if len(data) < aead.NonceSize() {
+		return nil, errors.New("ciphertext too short")
+	}
+	return aead.Open(nil, data[:aead.NonceSize()], data[aead.NonceSize():], aad)
+}
+
+// newEncryption 生成随机主密钥并用口令加密
+func newEncryption(password string) (*encryptionMeta, *repoKey, error) {
+	meta := &encryptionMeta{
+		KDF:        kdfName,
+		Iterations: kdfIterations,
+		Salt:       make([]byte, saltSize),
+		Cipher:     cipherName,
+	}
+	master := make([]byte, 64)
+	if _, err := rand.Read(meta.Salt); err != nil {
+		return nil, nil, err
+	}
+	if _, err := rand.Read(master); err != nil {
+		return nil, nil, err
+	}
+	aead, err := newAEAD(deriveKey(password, meta))
+	if err != nil {
+		return nil, nil, err
+	}
+	if meta.Key, err = seal(aead, master, []byte(kdfName)); err != nil {
+		return nil, nil, err
+	}
+	key, err := newRepoKey(master)
+	return meta, key, err
+}
+
+// unlock 用口令解出主密钥
+func (meta *encryptionMeta) unlock(password string) (*repoKey, error) {
+	if meta.KDF != kdfName || meta.Cipher != cipherName {
+		return nil, fmt.Errorf("unsupported repository encryption: %v, %v", meta.KDF, meta.Cipher)
+	}
+	if meta.Iterations <= 0 || len(meta.Salt) == 0 {
+		return nil, errors.New("invalid repository encryption parameters")
+	}
+	aead, err := newAEAD(deriveKey(password, meta))
+	if err != nil {
+		return nil, err
+	}
+	master, err := open(aead, meta.Key, []byte(kdfName))
+	if err != nil {
+		return nil, ErrWrongPassword
+	}
+	if len(master) != 64 {
+		return nil, errors.New("invalid repository key")
+	}
+	return newRepoKey(master)
+}
+
+// chunkID 计算数据块 ID，加密仓库使用带密钥的 HMAC
+func (k *repoKey) chunkID(data []byte) string {
+	mac := hmac.New(sha256.New, k.macKey)
+	mac.Write(data)
+	return hex.EncodeToString(mac.Sum(nil))
+}
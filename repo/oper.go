@@ -0,0 +1,158 @@
+package repo
+
+import (
+	"io"
+	"path/filepath"
+	"runtime"
+	gosync "sync"
+	"time"
+
+	"stacktrace.top/filesync/config"
+	"stacktrace.top/filesync/logger"
+	"stacktrace.top/filesync/sync"
+)
+
+// RepoSyncOper 把源目录备份为仓库中的一个新快照，目标路径为仓库目录
+type RepoSyncOper struct {
+	scanner *sync.Scanner
+	repo    *Repository
+	// 上一个快照，没有时为 nil
+	prev *Manifest
+	mu   gosync.Mutex
+	// 本次保存的条目
+	stored map[string]*FileEntry
+}
+
+// NewRepoSyncOper 打开 scanner 配置的目标路径下的仓库，口令来自 conf
+func NewRepoSyncOper(scanner *sync.Scanner, conf config.RepoConfig) (*RepoSyncOper, error) {
+	return NewRepoSyncOperFS(scanner, sync.Local, conf)
+}
+
+// NewRepoSyncOperFS 打开 fsys 中目标路径下的仓库
+func NewRepoSyncOperFS(scanner *sync.Scanner, fsys sync.FS, conf config.RepoConfig) (*RepoSyncOper, error) {
+	r, err := OpenFS(fsys, scanner.Config.Dstpath, conf)
+	if err != nil {
+		return nil, err
+	}
+	o := &RepoSyncOper{scanner: scanner, repo: r, stored: make(map[string]*FileEntry)}
+	names, err := r.Snapshots()
+	if err != nil {
+		return nil, err
+	}
+	if len(names) > 0 {
+		if o.prev, err = r.LoadManifest(names[len(names)-1]); err != nil {
+			return nil, err
+		}
+	}
+	return o, nil
+}
+
+func (o *RepoSyncOper) Repository() *Repository {
+	return o.repo
+}
+
+// Close 关闭仓库所在的存储，如网络模式下与 daemon 的连接
+func (o *RepoSyncOper) Close() error {
+	if c, ok := o.repo.fs.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// CompareDiffFiles 与上一个快照对比
+func (o *RepoSyncOper) CompareDiffFiles() (map[string]*sync.SyncFileInfo, error) {
+	o.scanner.LoadSrcCache()
+	dstFiles := make(map[string]*sync.SyncFileInfo)
+	if o.prev != nil {
+		for k, v := range o.prev.Files {
+			dstFiles[k] = v.SyncFileInfo
+		}
+	}
+	o.scanner.SetDst(dstFiles)
+	return o.scanner.Compare(), nil
+}
+
+func (o *RepoSyncOper) SyncFile(srcFilePath string, dstFilePath string, fileInfo *sync.SyncFileInfo) error {
+	relPath, err := filepath.Rel(o.scanner.Config.Srcpath, srcFilePath)
+	if err != nil {
+		return err
+	}
+	return o.store(relPath, fileInfo, nil)
+}
+
+func (o *RepoSyncOper) store(relPath string, fileInfo *sync.SyncFileInfo, progress func(offset int64)) error {
+	info := *fileInfo
+	entry := &FileEntry{SyncFileInfo: &info}
+	if !fileInfo.IsDir {
+		srcFilePath := filepath.Join(o.scanner.Config.Srcpath, relPath)
+		chunks, hash, written, err := o.repo.StoreFile(srcFilePath, progress)
+		if err != nil {
+			logger.Error("store file: %v failed.err: %v", srcFilePath, err)
+			return err
+		}
+		entry.Chunks = chunks
+		entry.Hash = hash
+		logger.Debug("stored file: %v, chunks: %v, new bytes: %v", relPath, len(chunks), written)
+	}
+	o.mu.Lock()
+	o.stored[relPath] = entry
+	o.mu.Unlock()
+	return nil
+}
+
+// SyncFiles 保存变化的文件，之后写入新快照：未变化的条目沿用上一个快照，源目录已删除的条目不再保留
+func (o *RepoSyncOper) SyncFiles(diffFiles map[string]*sync.SyncFileInfo, stats *sync.Stats) {
+	o.scanner.SyncParallel(diffFiles, stats, runtime.NumCPU(), o.store)
+	stored := len(o.stored)
+	name, err := o.saveSnapshot()
+	if err != nil {
+		logger.Error("save snapshot failed. err: %v", err)
+		return
+	}
+	logger.Info("snapshot %v saved: %v entries stored, %v in total", name, stored, len(o.prev.Files))
+}
+
+// saveSnapshot 合并上一个快照和本次保存的条目，保存后作为新的上一个快照
+func (o *RepoSyncOper) saveSnapshot() (string, error) {
+	srcFiles := o.scanner.Src
+	m := &Manifest{
+		Time:    time.Now(),
+		Srcpath: o.scanner.Config.Srcpath,
+		Files:   make(map[string]*FileEntry),
+	}
+	if o.prev != nil {
+		for k, v := range o.prev.Files {
+			// 没有加载源目录信息时(如重传失败文件)保留全部条目
+			if _, ok := srcFiles[k]; ok || len(srcFiles) == 0 {
+				m.Files[k] = v
+			}
+		}
+	}
+	for k, v := range o.stored {
+		m.Files[k] = v
+	}
+	name, err := o.repo.SaveManifest(m)
+	if err != nil {
+		return "", err
+	}
+	o.prev = m
+	o.stored = make(map[string]*FileEntry)
+	return name, nil
+}
+
+// LatestFileInfos 返回 fsys 中仓库最新快照的文件信息，文件带 SHA-256，用于校验
+func LatestFileInfos(fsys sync.FS, path string, conf config.RepoConfig) (map[string]*sync.SyncFileInfo, error) {
+	r, err := OpenFS(fsys, path, conf)
+	if err != nil {
+		return nil, err
+	}
+	m, err := r.LoadManifest("latest")
+	if err != nil {
+		return nil, err
+	}
+	infos := make(map[string]*sync.SyncFileInfo, len(m.Files))
+	for k, v := range m.Files {
+		infos[k] = v.SyncFileInfo
+	}
+	return infos, nil
+}
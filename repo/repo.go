@@ -0,0 +1,487 @@
+package repo
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"stacktrace.top/filesync/config"
+	"stacktrace.top/filesync/logger"
+	"stacktrace.top/filesync/sync"
+)
+
+// 仓库目录结构：
+//
+//	repo.json                 仓库标识，加密仓库还保存加密后的主密钥
+//	data/<前两位>/<ID>        数据块，以内容哈希命名，加密仓库为内容的 HMAC
+//	snapshots/<时间>.json     快照清单，记录每个文件的信息和数据块列表
+//
+// 加密仓库中数据块和快照清单都加密保存，文件名只出现在清单中
+const (
+	repoVersion  = 1
+	repoFile     = "repo.json"
+	dataDir      = "data"
+	snapshotsDir = "snapshots"
+	tmpSuffix    = ".tmp"
+)
+
+// 清理时只删除超过该时长未被引用的数据块，避免删掉正在进行的备份刚写入或刚复用的块
+const pruneGrace = time.Hour
+
+// 快照清单加密时的附加数据
+var manifestAAD = []byte("manifest")
+
+type repoMeta struct {
+	Version    int
+	Encryption *encryptionMeta `json:",omitempty"`
+}
+
+// FileEntry 是快照中的一个条目，目录没有数据块
+type FileEntry struct {
+	*sync.SyncFileInfo
+	Chunks []string `json:",omitempty"`
+}
+
+// Manifest 是一次快照的清单
+type Manifest struct {
+	Time    time.Time
+	Srcpath string
+	Files   map[string]*FileEntry
+}
+
+type Repository struct {
+	// 仓库所在的存储，网络模式下为 daemon 上的目录，数据在本机加密后才写入
+	fs   sync.FS
+	path string
+	// 未加密时为 nil
+	key *repoKey
+}
+
+// Open 打开本地目录中的仓库
+func Open(path string, conf config.RepoConfig) (*Repository, error) {
+	return OpenFS(sync.Local, path, conf)
+}
+
+// OpenFS 打开 fsys 中的仓库，目录不存在或为空时初始化，conf 配置了口令时初始化为加密仓库
+func OpenFS(fsys sync.FS, path string, conf config.RepoConfig) (*Repository, error) {
+	if path == "" {
+		return nil, errors.New("repository path is empty")
+	}
+	password, err := repoPassword(conf)
+	if err != nil {
+		return nil, fmt.Errorf("read repository password failed: %w", err)
+	}
+	r := &Repository{fs: fsys, path: path}
+	data, err := r.readFile(filepath.Join(path, repoFile))
+	if errors.Is(err, fs.ErrNotExist) {
+		entries, _ := sync.ReadDirFS(fsys, path)
+		if len(entries) > 0 {
+			return nil, fmt.Errorf("%v is not empty and is not a repository", path)
+		}
+		return r, r.init(password)
+	} else if err != nil {
+		return nil, err
+	}
+	meta := &repoMeta{}
+	if err := json.Unmarshal(data, meta); err != nil {
+		return nil, fmt.Errorf("invalid repository %v: %w", path, err)
+	}
+	if meta.Version != repoVersion {
+		return nil, fmt.Errorf("unsupported repository version: %v", meta.Version)
+	}
+	switch {
+	case meta.Encryption != nil && password == "":
+		return nil, fmt.Errorf("repository %v is encrypted, password required", path)
+	case meta.Encryption != nil:
+		if r.key, err = meta.Encryption.unlock(password); err != nil {
+			return nil, err
+		}
+	case password != "":
+		// 避免误以为数据已加密
+		return nil, fmt.Errorf("repository %v is not encrypted, remove the password from config", path)
+	}
+	return r, nil
+}
+
+func (r *Repository) init(password string) error {
+	for _, dir := range []string{dataDir, snapshotsDir} {
+		if err := r.fs.MkdirAll(filepath.Join(r.path, dir), 0755); err != nil {
+			return err
+		}
+	}
+	meta := &repoMeta{Version: repoVersion}
+	if password != "" {
+		var err error
+		if meta.Encryption, r.key, err = newEncryption(password); err != nil {
+			return err
+		}
+	}
+	data, _ := json.Marshal(meta)
+	logger.Info("init repository: %v, encrypted: %v", r.path, r.key != nil)
+	name := filepath.Join(r.path, repoFile)
+	if err := r.writeFile(name+tmpSuffix, data); err != nil {
+		return err
+	}
+	return r.fs.Rename(name+tmpSuffix, name)
+}
+
+func (r *Repository) chunkID(data []byte) string {
+	if r.key != nil {
+		return r.key.chunkID(data)
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// encrypt 在加密仓库中加密数据，未加密的仓库原样返回
+func (r *Repository) encrypt(data []byte, aad []byte) ([]byte, error) {
+	if r.key == nil {
+		return data, nil
+	}
+	return seal(r.key.aead, data, aad)
+}
+
+func (r *Repository) decrypt(data []byte, aad []byte) ([]byte, error) {
+	if r.key == nil {
+		return data, nil
+	}
+	plain, err := open(r.key.aead, data, aad)
+	if err != nil {
+		return nil, fmt.Errorf("%w: decrypt failed", sync.ErrChecksumMismatch)
+	}
+	return plain, nil
+}
+
+func (r *Repository) readFile(name string) ([]byte, error) {
+	file, err := r.fs.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return io.ReadAll(file)
+}
+
+// writeFile 写入临时文件，失败时删除。调用方再改名为正式文件，中断时不会留下不完整的文件
+func (r *Repository) writeFile(tmp string, data []byte) error {
+	file, err := r.fs.Create(tmp, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(data)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		r.fs.Remove(tmp)
+	}
+	return err
+}
+
+func (r *Repository) chunkPath(id string) string {
+	return filepath.Join(r.path, dataDir, id[:2], id)
+}
+
+// SaveChunk 保存数据块并返回其 ID，已存在时只更新修改时间
+func (r *Repository) SaveChunk(data []byte) (string, bool, error) {
+	id := r.chunkID(data)
+	name := r.chunkPath(id)
+	now := time.Now()
+	if err := r.fs.Chtimes(name, now, now); err == nil {
+		return id, false, nil
+	}
+	if err := r.fs.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		return "", false, err
+	}
+	// 数据块 ID 作为附加数据，密文不能被换到其他 ID 下
+	data, err := r.encrypt(data, []byte(id))
+	if err != nil {
+		return "", false, err
+	}
+	// 临时文件名带时间，多个协程同时写入同一个块时互不影响
+	tmp := fmt.Sprintf("%s.%d%s", name, now.UnixNano(), tmpSuffix)
+	if err := r.writeFile(tmp, data); err != nil {
+		return "", false, err
+	}
+	return id, true, r.fs.Rename(tmp, name)
+}
+
+// LoadChunk 读取数据块并校验哈希
+func (r *Repository) LoadChunk(id string) ([]byte, error) {
+	if len(id) != sha256.Size*2 {
+		return nil, fmt.Errorf("invalid chunk id: %v", id)
+	}
+	data, err := r.readFile(r.chunkPath(id))
+	if err != nil {
+		return nil, err
+	}
+	if data, err = r.decrypt(data, []byte(id)); err != nil {
+		return nil, fmt.Errorf("chunk %v: %w", id, err)
+	}
+	if r.chunkID(data) != id {
+		return nil, fmt.Errorf("%w: chunk %v", sync.ErrChecksumMismatch, id)
+	}
+	return data, nil
+}
+
+// StoreFile 切分文件并保存数据块，返回数据块列表、文件的 SHA-256 和新写入的字节数
+func (r *Repository) StoreFile(path string, progress func(offset int64)) ([]string, string, int64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, "", 0, err
+	}
+	defer file.Close()
+	hasher := sha256.New()
+	chunker := NewChunker(io.TeeReader(file, hasher))
+	var chunks []string
+	var offset, written int64
+	for {
+		data, err := chunker.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, "", 0, err
+		}
+		id, created, err := r.SaveChunk(data)
+		if err != nil {
+			return nil, "", 0, err
+		}
+		chunks = append(chunks, id)
+		offset += int64(len(data))
+		if created {
+			written += int64(len(data))
+		}
+		if progress != nil {
+			progress(offset)
+		}
+	}
+	return chunks, hex.EncodeToString(hasher.Sum(nil)), written, nil
+}
+
+// Snapshots 返回按时间升序的快照名称
+func (r *Repository) Snapshots() ([]string, error) {
+	entries, err := sync.ReadDirFS(r.fs, filepath.Join(r.path, snapshotsDir))
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, entry := range entries {
+		name := strings.TrimSuffix(entry.Name(), ".json")
+		if !entry.IsDir() && name != entry.Name() && sync.IsSnapshotName(name) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// LoadManifest 读取快照清单，name 为 latest 时读取最新的快照
+func (r *Repository) LoadManifest(name string) (*Manifest, error) {
+	if name == "latest" {
+		names, err := r.Snapshots()
+		if err != nil {
+			return nil, err
+		}
+		if len(names) == 0 {
+			return nil, errors.New("no snapshot in repository")
+		}
+		name = names[len(names)-1]
+	}
+	if !sync.IsSnapshotName(name) {
+		return nil, fmt.Errorf("invalid snapshot name: %v", name)
+	}
+	data, err := r.readFile(filepath.Join(r.path, snapshotsDir, name+".json"))
+	if err != nil {
+		return nil, err
+	}
+	if data, err = r.decrypt(data, manifestAAD); err != nil {
+		return nil, fmt.Errorf("snapshot %v: %w", name, err)
+	}
+	m := &Manifest{}
+	if err := json.Unmarshal(data, m); err != nil {
+		return nil, fmt.Errorf("invalid snapshot %v: %w", name, err)
+	}
+	files := make(map[string]*FileEntry, len(m.Files))
+	for k, v := range m.Files {
+		if v.SyncFileInfo == nil {
+			return nil, fmt.Errorf("invalid snapshot %v: entry %v without file info", name, k)
+		}
+		files[filepath.FromSlash(k)] = v
+	}
+	m.Files = files
+	return m, nil
+}
+
+// SaveManifest 以清单时间命名保存快照，同一秒内已有快照时顺延
+func (r *Repository) SaveManifest(m *Manifest) (string, error) {
+	files := make(map[string]*FileEntry, len(m.Files))
+	for k, v := range m.Files {
+		files[filepath.ToSlash(k)] = v
+	}
+	data, err := json.Marshal(&Manifest{Time: m.Time, Srcpath: m.Srcpath, Files: files})
+	if err != nil {
+		return "", err
+	}
+	if data, err = r.encrypt(data, manifestAAD); err != nil {
+		return "", err
+	}
+	dir := filepath.Join(r.path, snapshotsDir)
+	tmp := filepath.Join(dir, fmt.Sprintf("%d%s", time.Now().UnixNano(), tmpSuffix))
+	if err := r.writeFile(tmp, data); err != nil {
+		return "", err
+	}
+	defer r.fs.Remove(tmp)
+	t := m.Time
+	for {
+		name := t.Format(sync.SnapshotLayout)
+		// 硬链接在目标已存在时失败，不会覆盖已有快照
+		err := r.fs.Link(tmp, filepath.Join(dir, name+".json"))
+		if err == nil {
+			return name, nil
+		} else if !errors.Is(err, fs.ErrExist) {
+			return "", err
+		}
+		t = t.Add(time.Second)
+	}
+}
+
+// RemoveSnapshot 删除快照清单，数据块由 Prune 清理
+func (r *Repository) RemoveSnapshot(name string) error {
+	if !sync.IsSnapshotName(name) {
+		return fmt.Errorf("invalid snapshot name: %v", name)
+	}
+	return r.fs.Remove(filepath.Join(r.path, snapshotsDir, name+".json"))
+}
+
+// Prune 按 conf 的保留设置删除旧快照，再删除不再被引用的数据块。
+// 返回删除的快照、数据块数量和释放的字节数
+func (r *Repository) Prune(conf config.SnapshotConfig) ([]string, int, int64, error) {
+	keep, days := conf.Keep, conf.Days
+	names, err := r.Snapshots()
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	now := time.Now()
+	var removed []string
+	for i := 0; i < len(names)-1; i++ {
+		t, _ := time.ParseInLocation(sync.SnapshotLayout, names[i], time.Local)
+		if (keep > 0 && len(names)-i > keep) || (days > 0 && now.Sub(t) > time.Duration(days)*24*time.Hour) {
+			if err := r.RemoveSnapshot(names[i]); err != nil {
+				return removed, 0, 0, err
+			}
+			removed = append(removed, names[i])
+		}
+	}
+	// 标记剩余快照引用的数据块，任何清单读取失败都不清理，以免误删
+	names, err = r.Snapshots()
+	if err != nil {
+		return removed, 0, 0, err
+	}
+	used := make(map[string]bool)
+	for _, name := range names {
+		m, err := r.LoadManifest(name)
+		if err != nil {
+			return removed, 0, 0, err
+		}
+		for _, entry := range m.Files {
+			for _, id := range entry.Chunks {
+				used[id] = true
+			}
+		}
+	}
+	count, freed := 0, int64(0)
+	err = r.fs.Walk(filepath.Join(r.path, dataDir), func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		id := info.Name()
+		if used[id] || now.Sub(info.ModTime()) < pruneGrace {
+			return nil
+		}
+		// 中断留下的临时文件同样清理
+		if err := r.fs.Remove(path); err != nil {
+			return err
+		}
+		count++
+		freed += info.Size()
+		return nil
+	})
+	return removed, count, freed, err
+}
+
+// Restore 把快照中路径以 prefix 开头的条目恢复到本机的 target 目录，加密仓库的数据在本机解密
+func (r *Repository) Restore(name string, target string, prefix string) (int, error) {
+	m, err := r.LoadManifest(name)
+	if err != nil {
+		return 0, err
+	}
+	prefix = filepath.Clean(prefix)
+	paths := make([]string, 0, len(m.Files))
+	for relPath := range m.Files {
+		if prefix == "." || relPath == prefix || strings.HasPrefix(relPath, prefix+string(os.PathSeparator)) {
+			paths = append(paths, relPath)
+		}
+	}
+	// 先创建上层目录
+	sort.Strings(paths)
+	restored := 0
+	for _, relPath := range paths {
+		entry := m.Files[relPath]
+		dstPath := filepath.Join(target, relPath)
+		if entry.IsDir {
+			err = os.MkdirAll(dstPath, entry.Mode.Perm())
+		} else {
+			err = r.restoreFile(entry, dstPath)
+		}
+		if err != nil {
+			return restored, fmt.Errorf("restore %v failed: %w", relPath, err)
+		}
+		restored++
+	}
+	return restored, nil
+}
+
+func (r *Repository) restoreFile(entry *FileEntry, dstPath string) error {
+	if err := os.MkdirAll(filepath.Dir(dstPath), os.ModePerm); err != nil {
+		return err
+	}
+	tmp := dstPath + tmpSuffix
+	file, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, entry.Mode.Perm())
+	if err != nil {
+		return err
+	}
+	hasher := sha256.New()
+	for _, id := range entry.Chunks {
+		var data []byte
+		data, err = r.LoadChunk(id)
+		if err != nil {
+			break
+		}
+		hasher.Write(data)
+		if _, err = file.Write(data); err != nil {
+			break
+		}
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil && entry.Hash != "" && hex.EncodeToString(hasher.Sum(nil)) != entry.Hash {
+		err = sync.ErrChecksumMismatch
+	}
+	if err == nil {
+		err = os.Rename(tmp, dstPath)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Chtimes(dstPath, entry.ModTime, entry.ModTime)
+}
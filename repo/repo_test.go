@@ -0,0 +1,104 @@
+package repo
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"stacktrace.top/filesync/config"
+	"stacktrace.top/filesync/sync"
+)
+
+// 仓库放在 MemFS 上，相当于 daemon 上的目录：存储中只能出现密文
+func TestEncryptedStoreOnFS(t *testing.T) {
+	conf := config.RepoConfig{Password: "secret"}
+	store := sync.NewMemFS()
+	r, err := OpenFS(store, "/repo", conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := bytes.Repeat([]byte("plaintext content "), 1000)
+	src := filepath.Join(t.TempDir(), "secret-name.txt")
+	if err := os.WriteFile(src, content, 0600); err != nil {
+		t.Fatal(err)
+	}
+	chunks, hash, _, err := r.StoreFile(src, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mtime := time.Date(2021, 2, 3, 4, 5, 6, 0, time.UTC)
+	info := &sync.SyncFileInfo{Name: "secret-name.txt", Size: int64(len(content)), ModTime: mtime, Mode: 0600, Hash: hash}
+	m := &Manifest{Time: time.Now(), Srcpath: "/src", Files: map[string]*FileEntry{"secret-name.txt": {SyncFileInfo: info, Chunks: chunks}}}
+	if _, err := r.SaveManifest(m); err != nil {
+		t.Fatal(err)
+	}
+
+	store.Walk("/repo", func(path string, fi os.FileInfo, err error) error {
+		if err != nil || fi.IsDir() {
+			return err
+		}
+		file, _ := store.Open(path)
+		data, _ := io.ReadAll(file)
+		if bytes.Contains(data, []byte("plaintext")) || bytes.Contains(data, []byte("secret-name")) {
+			t.Errorf("%v contains plaintext", path)
+		}
+		return nil
+	})
+
+	// 重新打开后在本机解密恢复
+	r, err = OpenFS(store, "/repo", conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	target := t.TempDir()
+	if n, err := r.Restore("latest", target, ""); err != nil || n != 1 {
+		t.Fatalf("restore: %v %v", n, err)
+	}
+	if data, _ := os.ReadFile(filepath.Join(target, "secret-name.txt")); !bytes.Equal(data, content) {
+		t.Fatal("restored content differs")
+	}
+
+	if _, err := OpenFS(store, "/repo", config.RepoConfig{Password: "wrong"}); !errors.Is(err, ErrWrongPassword) {
+		t.Fatalf("wrong password: %v", err)
+	}
+}
+
+// 口令随配置传入，同一进程中可以同时打开加密和不加密的仓库
+func TestRepositoriesWithDifferentConfig(t *testing.T) {
+	dir := t.TempDir()
+	passwordFile := filepath.Join(dir, "password")
+	os.WriteFile(passwordFile, []byte("from-file\n"), 0600)
+	confs := []config.RepoConfig{{}, {Password: "a"}, {Passwordfile: passwordFile}}
+	errs := make(chan error, len(confs))
+	for i, conf := range confs {
+		go func(path string, conf config.RepoConfig) {
+			_, err := Open(path, conf)
+			errs <- err
+		}(filepath.Join(dir, strconv.Itoa(i)), conf)
+	}
+	for range confs {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i, conf := range confs {
+		r, err := Open(filepath.Join(dir, strconv.Itoa(i)), conf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if encrypted := r.key != nil; encrypted != (i > 0) {
+			t.Fatalf("repo %v encrypted: %v", i, encrypted)
+		}
+	}
+	if _, err := Open(filepath.Join(dir, "2"), config.RepoConfig{Password: "from-file"}); err != nil {
+		t.Fatalf("password file: %v", err)
+	}
+	if _, err := Open(filepath.Join(dir, "0"), config.RepoConfig{Password: "a"}); err == nil {
+		t.Fatal("password accepted for plain repository")
+	}
+}
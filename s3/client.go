@@ -0,0 +1,353 @@
+package s3
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"stacktrace.top/filesync/sync"
+)
+
+const (
+	amzDateLayout = "20060102T150405Z"
+	emptySHA256   = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+)
+
+// Client 是使用 SigV4 签名的最小 S3 客户端，兼容 MinIO 等实现
+type Client struct {
+	Endpoint  string
+	Region    string
+	Bucket    string
+	AccessKey string
+	SecretKey string
+	// 使用 endpoint/bucket/key 形式的地址，否则为 bucket.endpoint/key
+	PathStyle  bool
+	HTTPClient *http.Client
+}
+
+// Object 是列表或 HEAD 返回的对象信息
+type Object struct {
+	Key          string
+	Size         int64
+	LastModified time.Time
+	// 用户元数据，键为去掉 x-amz-meta- 前缀的小写名称
+	Meta map[string]string
+}
+
+type s3Error struct {
+	Code    string
+	Message string
+}
+
+// uriEncode 按 SigV4 规则编码，只保留非保留字符，path 为 true 时保留 /
+func uriEncode(s string, path bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if ('A' <= c && c <= 'Z') || ('a' <= c && c <= 'z') || ('0' <= c && c <= '9') ||
+			c == '-' || c == '_' || c == '.' || c == '~' || (path && c == '/') {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// objectURL 返回对象地址，key 为空时为桶地址
+func (c *Client) objectURL(key string, query url.Values) (*url.URL, error) {
+	endpoint := c.Endpoint
+	if endpoint == "" {
+		endpoint = "https://s3." + c.Region + ".amazonaws.com"
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	path := "/" + key
+	if c.PathStyle {
+		path = "/" + c.Bucket + path
+	} else {
+		u.Host = c.Bucket + "." + u.Host
+	}
+	base := strings.TrimSuffix(u.Path, "/")
+	u.Path = base + path
+	u.RawPath = base + uriEncode(path, true)
+	u.RawQuery = canonicalQuery(query)
+	return u, nil
+}
+
+func canonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, k := range keys {
+		values := append([]string(nil), query[k]...)
+		sort.Strings(values)
+		for _, v := range values {
+			parts = append(parts, uriEncode(k, false)+"="+uriEncode(v, false))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// sign 为请求添加 SigV4 签名，签名的头为 host、range、content-type、content-md5 和全部 x-amz-*
+func (c *Client) sign(req *http.Request, payloadHash string) {
+	c.signAt(req, payloadHash, time.Now().UTC())
+}
+
+func (c *Client) signAt(req *http.Request, payloadHash string, now time.Time) {
+	amzDate := now.Format(amzDateLayout)
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		lower := strings.ToLower(name)
+		if strings.HasPrefix(lower, "x-amz-") || lower == "range" || lower == "content-type" || lower == "content-md5" {
+			headers[lower] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := now.Format("20060102") + "/" + c.Region + "/s3/aws4_request"
+	sum := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(sum[:])
+	key := hmacSHA256([]byte("AWS4"+c.SecretKey), now.Format("20060102"))
+	key = hmacSHA256(key, c.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		c.AccessKey, scope, signedHeaders, signature))
+}
+
+// do 发送签名后的请求，非 2xx 应答转换为错误
+func (c *Client) do(method string, key string, query url.Values, header http.Header, body []byte) (*http.Response, error) {
+	u, err := c.objectURL(key, query)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	// 保持签名使用的编码
+	req.URL = u
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.ContentLength = int64(len(body))
+	payloadHash := emptySHA256
+	if len(body) > 0 {
+		sum := sha256.Sum256(body)
+		payloadHash = hex.EncodeToString(sum[:])
+	}
+	c.sign(req, payloadHash)
+	client := c.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		defer resp.Body.Close()
+		data, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+		e := &s3Error{}
+		xml.Unmarshal(data, e)
+		if e.Code == "" {
+			e.Code = resp.Status
+		}
+		return nil, fmt.Errorf("%w: %s %s: %s %s", sync.ErrRemoteFailed, method, key, e.Code, e.Message)
+	}
+	return resp, nil
+}
+
+func (c *Client) doXML(method string, key string, query url.Values, body []byte, out any) error {
+	resp, err := c.do(method, key, query, nil, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if out == nil {
+		_, err = io.Copy(io.Discard, resp.Body)
+		return err
+	}
+	return xml.NewDecoder(resp.Body).Decode(out)
+}
+
+func metaHeader(meta map[string]string) http.Header {
+	header := http.Header{}
+	for k, v := range meta {
+		header.Set("X-Amz-Meta-"+k, v)
+	}
+	return header
+}
+
+// PutObject 上传小对象
+func (c *Client) PutObject(key string, data []byte, meta map[string]string) error {
+	resp, err := c.do(http.MethodPut, key, nil, metaHeader(meta), data)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// HeadObject 读取对象大小和用户元数据
+func (c *Client) HeadObject(key string) (*Object, error) {
+	resp, err := c.do(http.MethodHead, key, nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	return responseObject(key, resp), nil
+}
+
+// GetObject 读取对象内容和元数据，调用方负责关闭内容
+func (c *Client) GetObject(key string) (*Object, io.ReadCloser, error) {
+	resp, err := c.do(http.MethodGet, key, nil, nil, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	return responseObject(key, resp), resp.Body, nil
+}
+
+func responseObject(key string, resp *http.Response) *Object {
+	obj := &Object{Key: key, Size: resp.ContentLength, Meta: make(map[string]string)}
+	obj.LastModified, _ = http.ParseTime(resp.Header.Get("Last-Modified"))
+	for name := range resp.Header {
+		if lower := strings.ToLower(name); strings.HasPrefix(lower, "x-amz-meta-") {
+			obj.Meta[strings.TrimPrefix(lower, "x-amz-meta-")] = resp.Header.Get(name)
+		}
+	}
+	return obj
+}
+
+type listResult struct {
+	IsTruncated           bool
+	NextContinuationToken string
+	Contents              []struct {
+		Key          string
+		LastModified time.Time
+		Size         int64
+	}
+}
+
+// ListObjects 用 ListObjectsV2 分页列出 prefix 下的全部对象
+func (c *Client) ListObjects(prefix string, fn func(obj *Object)) error {
+	token := ""
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		result := &listResult{}
+		if err := c.doXML(http.MethodGet, "", query, nil, result); err != nil {
+			return err
+		}
+		for _, content := range result.Contents {
+			fn(&Object{Key: content.Key, Size: content.Size, LastModified: content.LastModified})
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+type completePart struct {
+	PartNumber int
+	ETag       string
+}
+
+type completeUpload struct {
+	XMLName xml.Name       `xml:"CompleteMultipartUpload"`
+	Parts   []completePart `xml:"Part"`
+}
+
+// MultipartUpload 分片上传，read 按顺序返回每个分片，返回 io.EOF 时结束。失败时放弃已上传的分片
+func (c *Client) MultipartUpload(key string, meta map[string]string, read func() ([]byte, error)) error {
+	resp, err := c.do(http.MethodPost, key, url.Values{"uploads": {""}}, metaHeader(meta), nil)
+	if err != nil {
+		return err
+	}
+	initiate := &struct{ UploadId string }{}
+	err = xml.NewDecoder(resp.Body).Decode(initiate)
+	resp.Body.Close()
+	if err != nil {
+		return err
+	}
+	uploadID := initiate.UploadId
+	complete := &completeUpload{}
+	err = func() error {
+		for number := 1; ; number++ {
+			data, err := read()
+			if err == io.EOF {
+				return nil
+			} else if err != nil {
+				return err
+			}
+			query := url.Values{"partNumber": {strconv.Itoa(number)}, "uploadId": {uploadID}}
+			resp, err := c.do(http.MethodPut, key, query, nil, data)
+			if err != nil {
+				return err
+			}
+			resp.Body.Close()
+			complete.Parts = append(complete.Parts, completePart{PartNumber: number, ETag: resp.Header.Get("ETag")})
+		}
+	}()
+	if err == nil {
+		body, _ := xml.Marshal(complete)
+		// 完成请求即使失败也可能返回 200，需要检查应答内容
+		result := &struct {
+			XMLName xml.Name
+			s3Error
+		}{}
+		err = c.doXML(http.MethodPost, key, url.Values{"uploadId": {uploadID}}, body, result)
+		if err == nil && result.XMLName.Local == "Error" {
+			err = fmt.Errorf("%w: complete %s: %s %s", sync.ErrRemoteFailed, key, result.Code, result.Message)
+		}
+	}
+	if err != nil {
+		c.doXML(http.MethodDelete, key, url.Values{"uploadId": {uploadID}}, nil, nil)
+	}
+	return err
+}
@@ -0,0 +1,264 @@
+package s3
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"stacktrace.top/filesync/config"
+	"stacktrace.top/filesync/logger"
+	"stacktrace.top/filesync/sync"
+)
+
+const (
+	// 默认分片大小，也是使用分片上传的文件大小阈值
+	defaultPartSize = 16 * 1024 * 1024
+	// S3 要求的最小分片和最多分片数
+	minPartSize    = 5 * 1024 * 1024
+	maxParts       = 10000
+	defaultThreads = 4
+)
+
+// 对象元数据的名称
+const (
+	metaMtime  = "mtime"
+	metaMode   = "mode"
+	metaSHA256 = "sha256"
+)
+
+// S3SyncOper 把源目录同步到桶中的前缀下，目录保存为以 / 结尾的空对象
+type S3SyncOper struct {
+	scanner  *sync.Scanner
+	client   *Client
+	prefix   string
+	partSize int64
+	// 并行上传的文件数
+	threads int
+}
+
+// NewS3SyncOper 按 cfg 连接对象存储，并行上传数量使用 client 的 threads
+func NewS3SyncOper(scanner *sync.Scanner, cfg config.S3Config, client config.ClientConfig) (*S3SyncOper, error) {
+	if cfg.Bucket == "" {
+		return nil, fmt.Errorf("s3 bucket is not configured")
+	}
+	region := cfg.Region
+	if region == "" {
+		region = "us-east-1"
+	}
+	partSize := int64(cfg.Partsize) * 1024 * 1024
+	if partSize <= 0 {
+		partSize = defaultPartSize
+	} else if partSize < minPartSize {
+		partSize = minPartSize
+	}
+	return &S3SyncOper{
+		scanner: scanner,
+		threads: client.Threads,
+		client: &Client{
+			Endpoint:   cfg.Endpoint,
+			Region:     region,
+			Bucket:     cfg.Bucket,
+			AccessKey:  cfg.Accesskey,
+			SecretKey:  cfg.Secretkey,
+			PathStyle:  cfg.Pathstyle,
+			HTTPClient: &http.Client{Timeout: 10 * time.Minute},
+		},
+		prefix:   strings.Trim(cfg.Prefix, "/"),
+		partSize: partSize,
+	}, nil
+}
+
+func (o *S3SyncOper) objectKey(relPath string, isDir bool) string {
+	key := filepath.ToSlash(relPath)
+	if o.prefix != "" {
+		key = o.prefix + "/" + key
+	}
+	if isDir {
+		key += "/"
+	}
+	return key
+}
+
+func (o *S3SyncOper) relPath(key string) string {
+	if o.prefix != "" {
+		key = strings.TrimPrefix(key, o.prefix+"/")
+	}
+	return filepath.FromSlash(strings.TrimSuffix(key, "/"))
+}
+
+// FileInfos 用 ListObjectsV2 构造目标端文件信息。列表不含用户元数据，修改时间为上传时间；
+// withHash 为 true 时逐个读取对象，得到原始修改时间和权限，SHA-256 由下载的内容计算，
+// 不使用上传时写入的哈希元数据
+func (o *S3SyncOper) FileInfos(withHash bool) (map[string]*sync.SyncFileInfo, error) {
+	listPrefix := ""
+	if o.prefix != "" {
+		listPrefix = o.prefix + "/"
+	}
+	infos := make(map[string]*sync.SyncFileInfo)
+	err := o.client.ListObjects(listPrefix, func(obj *Object) {
+		relPath := o.relPath(obj.Key)
+		if relPath == "." || relPath == "" {
+			return
+		}
+		isDir := strings.HasSuffix(obj.Key, "/")
+		info := &sync.SyncFileInfo{
+			Name:    path.Base(strings.TrimSuffix(obj.Key, "/")),
+			Size:    obj.Size,
+			ModTime: obj.LastModified,
+			Mode:    0644,
+			IsDir:   isDir,
+		}
+		if isDir {
+			info.Size = 0
+			info.Mode = os.ModeDir | 0755
+		}
+		infos[relPath] = info
+	})
+	if err != nil || !withHash {
+		return infos, err
+	}
+	for relPath, info := range infos {
+		obj, err := o.readObject(relPath, info)
+		if err != nil {
+			return nil, err
+		}
+		if t, err := time.Parse(time.RFC3339Nano, obj.Meta[metaMtime]); err == nil {
+			info.ModTime = t
+		}
+		if mode, err := strconv.ParseUint(obj.Meta[metaMode], 8, 32); err == nil {
+			info.Mode = os.FileMode(mode)
+		}
+	}
+	return infos, nil
+}
+
+// readObject 读取对象元数据，文件同时下载内容计算哈希
+func (o *S3SyncOper) readObject(relPath string, info *sync.SyncFileInfo) (*Object, error) {
+	key := o.objectKey(relPath, info.IsDir)
+	if info.IsDir {
+		return o.client.HeadObject(key)
+	}
+	obj, body, err := o.client.GetObject(key)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, body); err != nil {
+		return nil, err
+	}
+	info.Hash = hex.EncodeToString(hasher.Sum(nil))
+	return obj, nil
+}
+
+func (o *S3SyncOper) CompareDiffFiles() (map[string]*sync.SyncFileInfo, error) {
+	o.scanner.LoadSrcCache()
+	infos, err := o.FileInfos(false)
+	if err != nil {
+		return nil, err
+	}
+	o.scanner.SetDst(infos)
+	return o.scanner.Compare(), nil
+}
+
+func (o *S3SyncOper) SyncFiles(diffFiles map[string]*sync.SyncFileInfo, stats *sync.Stats) {
+	threads := o.threads
+	if threads <= 0 {
+		threads = defaultThreads
+	}
+	o.scanner.SyncParallel(diffFiles, stats, threads, o.upload)
+}
+
+func (o *S3SyncOper) SyncFile(srcFilePath string, dstFilePath string, fileInfo *sync.SyncFileInfo) error {
+	relPath, err := filepath.Rel(o.scanner.Config.Srcpath, srcFilePath)
+	if err != nil {
+		return err
+	}
+	return o.upload(relPath, fileInfo, nil)
+}
+
+// upload 上传一个文件或目录，大文件使用分片上传
+func (o *S3SyncOper) upload(relPath string, fileInfo *sync.SyncFileInfo, progress func(offset int64)) error {
+	key := o.objectKey(relPath, fileInfo.IsDir)
+	meta := map[string]string{
+		metaMtime: fileInfo.ModTime.UTC().Format(time.RFC3339Nano),
+		metaMode:  strconv.FormatUint(uint64(fileInfo.Mode), 8),
+	}
+	if fileInfo.IsDir {
+		return o.client.PutObject(key, nil, meta)
+	}
+	srcFilePath := filepath.Join(o.scanner.Config.Srcpath, relPath)
+	if fileInfo.Size < o.partSize {
+		data, err := os.ReadFile(srcFilePath)
+		if err != nil {
+			logger.Error("read file: %v failed.err: %v", srcFilePath, err)
+			return err
+		}
+		sum := sha256.Sum256(data)
+		meta[metaSHA256] = hex.EncodeToString(sum[:])
+		if err := o.client.PutObject(key, data, meta); err != nil {
+			return err
+		}
+		if progress != nil {
+			progress(int64(len(data)))
+		}
+		return nil
+	}
+	// 元数据在开始分片上传时提交，需要先计算整个文件的哈希
+	hash, err := sync.HashFile(srcFilePath)
+	if err != nil {
+		logger.Error("hash file: %v failed.err: %v", srcFilePath, err)
+		return err
+	}
+	meta[metaSHA256] = hash
+	file, err := os.Open(srcFilePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	partSize := o.partSize
+	if parts := (fileInfo.Size + partSize - 1) / partSize; parts > maxParts {
+		partSize = (fileInfo.Size + maxParts - 1) / maxParts
+	}
+	buf := make([]byte, partSize)
+	offset := int64(0)
+	hasher := sha256.New()
+	return o.client.MultipartUpload(key, meta, func() ([]byte, error) {
+		n, err := io.ReadFull(file, buf)
+		if err == io.ErrUnexpectedEOF {
+			err = nil
+		} else if err == io.EOF {
+			// 上传的内容与提交的哈希不一致时放弃本次上传
+			if hex.EncodeToString(hasher.Sum(nil)) != hash {
+				return nil, fmt.Errorf("file changed during upload: %v", srcFilePath)
+			}
+			return nil, io.EOF
+		}
+		if err != nil {
+			return nil, err
+		}
+		hasher.Write(buf[:n])
+		offset += int64(n)
+		if progress != nil {
+			progress(offset)
+		}
+		return buf[:n], nil
+	})
+}
+
+// DstFileInfos 返回桶中带元数据和哈希的文件信息，用于校验
+func DstFileInfos(scanner *sync.Scanner, cfg config.S3Config) (map[string]*sync.SyncFileInfo, error) {
+	o, err := NewS3SyncOper(scanner, cfg, config.ClientConfig{})
+	if err != nil {
+		return nil, err
+	}
+	return o.FileInfos(true)
+}
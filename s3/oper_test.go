@@ -0,0 +1,78 @@
+package s3
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"stacktrace.top/filesync/config"
+	"stacktrace.top/filesync/sync"
+)
+
+func TestSyncAndVerify(t *testing.T) {
+	s := newStubServer(t)
+	src := t.TempDir()
+	mtime := time.Date(2021, 2, 3, 4, 5, 6, 789000000, time.UTC)
+	big := bytes.Repeat([]byte("b"), 25)
+	files := map[string][]byte{"a": []byte("aaa"), filepath.Join("d", "big"): big}
+	for name, data := range files {
+		p := filepath.Join(src, name)
+		os.MkdirAll(filepath.Dir(p), 0755)
+		if err := os.WriteFile(p, data, 0600); err != nil {
+			t.Fatal(err)
+		}
+		os.Chtimes(p, mtime, mtime)
+	}
+	scanner, err := sync.NewScanner(config.SyncConfig{Srcpath: src, Retries: -1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	scanner.Src = scanner.ScanDir(sync.Local, src, false)
+	// 分片大小 10 字节，big 分 3 片上传
+	o := &S3SyncOper{scanner: scanner, client: s.client(), prefix: "pre", partSize: 10, threads: 2}
+	diff := scanner.Compare()
+	stats := sync.NewStats(diff, scanner.Src)
+	o.SyncFiles(diff, stats)
+	stats.Finish()
+	if report := stats.Report(); report.FilesDone != 3 || report.FilesFailed != 0 {
+		t.Fatalf("report: %+v", report)
+	}
+	if obj := s.object("pre/d/big"); obj == nil || !bytes.Equal(obj.data, big) || s.count("part") != 3 {
+		t.Fatalf("multipart object: %+v, requests %v", obj, s.requests)
+	}
+	if s.object("pre/d/") == nil {
+		t.Fatal("dir object missing")
+	}
+
+	infos, err := o.FileInfos(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != 3 {
+		t.Fatalf("infos: %v", infos)
+	}
+	a := infos["a"]
+	sum := sha256.Sum256([]byte("aaa"))
+	if !a.ModTime.Equal(mtime) || a.Mode != 0600 || a.Hash != hex.EncodeToString(sum[:]) {
+		t.Fatalf("info: %+v", a)
+	}
+	if d := infos["d"]; d == nil || !d.IsDir {
+		t.Fatalf("dir info: %+v", d)
+	}
+	// 对象内容被修改，元数据中的哈希不变，校验使用内容的哈希
+	s.mu.Lock()
+	s.objects["pre/a"].data = []byte("evil")
+	s.mu.Unlock()
+	infos, err = o.FileInfos(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum = sha256.Sum256([]byte("evil"))
+	if infos["a"].Hash != hex.EncodeToString(sum[:]) {
+		t.Fatalf("hash %v should be computed from content", infos["a"].Hash)
+	}
+}
@@ -0,0 +1,187 @@
+package sftp
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	pkgsftp "github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+	"stacktrace.top/filesync/config"
+	"stacktrace.top/filesync/logger"
+)
+
+const dialTimeout = 30 * time.Second
+
+// 未配置 identityfile 时依次尝试的 ~/.ssh 下的密钥
+var defaultIdentities = []string{"id_ed25519", "id_ecdsa", "id_rsa"}
+
+// Client 是一条 ssh 连接上的 sftp 会话
+type Client struct {
+	*pkgsftp.Client
+	conn *ssh.Client
+}
+
+// Dial 连接 conf 中的主机并打开 sftp 子系统。认证使用 identityfile(为空时为 ~/.ssh 下的默认密钥)
+// 和 ssh-agent 中的密钥，不支持密码；主机密钥按 known_hosts 校验
+func Dial(conf config.SshConfig) (*Client, error) {
+	if conf.Host == "" {
+		return nil, errors.New("ssh host is not configured")
+	}
+	clientConfig, closeAgent, err := clientConfig(conf)
+	if err != nil {
+		return nil, err
+	}
+	defer closeAgent()
+	port := conf.Port
+	if port <= 0 {
+		port = 22
+	}
+	addr := net.JoinHostPort(conf.Host, strconv.Itoa(port))
+	conn, err := ssh.Dial("tcp", addr, clientConfig)
+	if err != nil {
+		logger.Error("ssh connect %v failed. err: %v", addr, err)
+		return nil, err
+	}
+	client, err := pkgsftp.NewClient(conn, pkgsftp.UseConcurrentWrites(true))
+	if err != nil {
+		conn.Close()
+		logger.Error("start sftp subsystem on %v failed. err: %v", addr, err)
+		return nil, err
+	}
+	return &Client{Client: client, conn: conn}, nil
+}
+
+func (c *Client) Close() error {
+	c.Client.Close()
+	return c.conn.Close()
+}
+
+// Rename 覆盖已存在的目标，服务端不支持 posix-rename 扩展时先删除目标
+func (c *Client) Rename(oldPath string, newPath string) error {
+	if _, ok := c.HasExtension("posix-rename@openssh.com"); ok {
+		return c.PosixRename(oldPath, newPath)
+	}
+	if err := c.Remove(newPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return c.Client.Rename(oldPath, newPath)
+}
+
+// clientConfig 按配置生成 ssh 客户端设置，返回的函数关闭与 ssh-agent 的连接，握手完成后即可调用
+func clientConfig(conf config.SshConfig) (*ssh.ClientConfig, func(), error) {
+	strict := true
+	var knownHostsFiles []string
+	for _, opt := range conf.Options {
+		key, value, _ := strings.Cut(opt, "=")
+		switch strings.ToLower(key) {
+		case "stricthostkeychecking":
+			strict = !strings.EqualFold(value, "no")
+		case "userknownhostsfile":
+			knownHostsFiles = append(knownHostsFiles, expandHome(value))
+		default:
+			return nil, nil, fmt.Errorf("unsupported ssh option: %v", opt)
+		}
+	}
+	hostKeyCallback := ssh.InsecureIgnoreHostKey()
+	if strict {
+		if len(knownHostsFiles) == 0 {
+			knownHostsFiles = []string{expandHome("~/.ssh/known_hosts")}
+		}
+		callback, err := knownhosts.New(knownHostsFiles...)
+		if err != nil {
+			return nil, nil, fmt.Errorf("load known hosts failed: %w", err)
+		}
+		hostKeyCallback = callback
+	}
+
+	signers, err := identitySigners(conf.Identityfile)
+	if err != nil {
+		return nil, nil, err
+	}
+	closeAgent := func() {}
+	var agentClient agent.ExtendedAgent
+	if sock := os.Getenv("SSH_AUTH_SOCK"); sock != "" {
+		if conn, err := net.Dial("unix", sock); err == nil {
+			agentClient = agent.NewClient(conn)
+			closeAgent = func() { conn.Close() }
+		} else {
+			logger.Error("connect ssh-agent failed. err: %v", err)
+		}
+	}
+	if len(signers) == 0 && agentClient == nil {
+		return nil, nil, errors.New("no ssh identity: configure identityfile or run ssh-agent")
+	}
+	auth := ssh.PublicKeysCallback(func() ([]ssh.Signer, error) {
+		if agentClient == nil {
+			return signers, nil
+		}
+		agentSigners, err := agentClient.Signers()
+		if err != nil {
+			logger.Error("list ssh-agent keys failed. err: %v", err)
+		}
+		return append(signers, agentSigners...), nil
+	})
+
+	name := conf.User
+	if name == "" {
+		if u, err := user.Current(); err == nil {
+			name = u.Username
+		}
+	}
+	return &ssh.ClientConfig{
+		User:            name,
+		Auth:            []ssh.AuthMethod{auth},
+		HostKeyCallback: hostKeyCallback,
+		Timeout:         dialTimeout,
+	}, closeAgent, nil
+}
+
+// identitySigners 读取配置的私钥；未配置时读取 ~/.ssh 下的默认密钥，跳过不存在和带口令的密钥
+func identitySigners(identityFile string) ([]ssh.Signer, error) {
+	if identityFile != "" {
+		data, err := os.ReadFile(expandHome(identityFile))
+		if err != nil {
+			return nil, err
+		}
+		signer, err := ssh.ParsePrivateKey(data)
+		var missing *ssh.PassphraseMissingError
+		if errors.As(err, &missing) {
+			return nil, fmt.Errorf("identity file %v is encrypted, load it into ssh-agent instead", identityFile)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("parse identity file %v failed: %w", identityFile, err)
+		}
+		return []ssh.Signer{signer}, nil
+	}
+	var signers []ssh.Signer
+	for _, name := range defaultIdentities {
+		data, err := os.ReadFile(expandHome(filepath.Join("~", ".ssh", name)))
+		if err != nil {
+			continue
+		}
+		if signer, err := ssh.ParsePrivateKey(data); err == nil {
+			signers = append(signers, signer)
+		}
+	}
+	return signers, nil
+}
+
+func expandHome(p string) string {
+	if p != "~" && !strings.HasPrefix(p, "~/") && !strings.HasPrefix(p, "~"+string(filepath.Separator)) {
+		return p
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return p
+	}
+	return filepath.Join(home, p[1:])
+}
@@ -0,0 +1,295 @@
+package sftp
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	pkgsftp "github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+	"stacktrace.top/filesync/config"
+)
+
+// testServer 是进程内的 ssh 服务端，只接受 authorized 密钥，在 sftp 子系统上提供本机文件系统
+type testServer struct {
+	port       int
+	knownHosts string
+}
+
+func newKey(t *testing.T) (ed25519.PrivateKey, ssh.Signer) {
+	t.Helper()
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return priv, signer
+}
+
+func startSSHServer(t *testing.T, authorized ssh.PublicKey) *testServer {
+	t.Helper()
+	_, hostKey := newKey(t)
+	serverConfig := &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if bytes.Equal(key.Marshal(), authorized.Marshal()) {
+				return nil, nil
+			}
+			return nil, errors.New("unauthorized key")
+		},
+	}
+	serverConfig.AddHostKey(hostKey)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serveSSH(conn, serverConfig)
+		}
+	}()
+	server := &testServer{port: listener.Addr().(*net.TCPAddr).Port}
+	server.knownHosts = writeKnownHosts(t, server.port, hostKey.PublicKey())
+	return server
+}
+
+func serveSSH(conn net.Conn, serverConfig *ssh.ServerConfig) {
+	_, chans, reqs, err := ssh.NewServerConn(conn, serverConfig)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+	for newChannel := range chans {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "session only")
+			continue
+		}
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			continue
+		}
+		go func() {
+			for req := range requests {
+				// 负载为带 4 字节长度的子系统名
+				ok := req.Type == "subsystem" && len(req.Payload) > 4 &&
+					int(binary.BigEndian.Uint32(req.Payload)) == len(req.Payload)-4 && string(req.Payload[4:]) == "sftp"
+				req.Reply(ok, nil)
+				if ok {
+					go func() {
+						if server, err := pkgsftp.NewServer(channel); err == nil {
+							server.Serve()
+						}
+						channel.Close()
+					}()
+				}
+			}
+		}()
+	}
+}
+
+func writeKnownHosts(t *testing.T, port int, key ssh.PublicKey) string {
+	t.Helper()
+	name := filepath.Join(t.TempDir(), "known_hosts")
+	line := knownhosts.Line([]string{knownhosts.Normalize(net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))}, key)
+	if err := os.WriteFile(name, []byte(line+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return name
+}
+
+func writeIdentity(t *testing.T, dir string, priv ed25519.PrivateKey, passphrase string) string {
+	t.Helper()
+	var block *pem.Block
+	var err error
+	if passphrase == "" {
+		block, err = ssh.MarshalPrivateKey(priv, "")
+	} else {
+		block, err = ssh.MarshalPrivateKeyWithPassphrase(priv, "", []byte(passphrase))
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	name := filepath.Join(dir, "id_ed25519")
+	os.MkdirAll(dir, 0700)
+	if err := os.WriteFile(name, pem.EncodeToMemory(block), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return name
+}
+
+// isolate 让测试不使用本机的 ~/.ssh 和 ssh-agent
+func isolate(t *testing.T) string {
+	t.Helper()
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("SSH_AUTH_SOCK", "")
+	return home
+}
+
+func (s *testServer) config(identity string) config.SshConfig {
+	return config.SshConfig{
+		Host:         "127.0.0.1",
+		Port:         s.port,
+		User:         "test",
+		Identityfile: identity,
+		Options:      []string{"UserKnownHostsFile=" + s.knownHosts},
+	}
+}
+
+// dialTest 启动服务端并用密钥文件连接
+func dialTest(t *testing.T) *Client {
+	t.Helper()
+	isolate(t)
+	priv, signer := newKey(t)
+	server := startSSHServer(t, signer.PublicKey())
+	c, err := Dial(server.config(writeIdentity(t, t.TempDir(), priv, "")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func TestDialIdentityFile(t *testing.T) {
+	isolate(t)
+	priv, signer := newKey(t)
+	server := startSSHServer(t, signer.PublicKey())
+	dir := t.TempDir()
+	c, err := Dial(server.config(writeIdentity(t, dir, priv, "")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Stat(dir); err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+
+	other, _ := newKey(t)
+	if _, err := Dial(server.config(writeIdentity(t, t.TempDir(), other, ""))); err == nil {
+		t.Fatal("unauthorized key accepted")
+	}
+	_, err = Dial(server.config(writeIdentity(t, t.TempDir(), priv, "secret")))
+	if err == nil || !strings.Contains(err.Error(), "ssh-agent") {
+		t.Fatalf("encrypted identity: %v", err)
+	}
+	if _, err := Dial(server.config("")); err == nil {
+		t.Fatal("dial without identity succeeded")
+	}
+	conf := server.config(writeIdentity(t, t.TempDir(), priv, ""))
+	conf.Options = append(conf.Options, "ProxyCommand=nc")
+	if _, err := Dial(conf); err == nil || !strings.Contains(err.Error(), "unsupported ssh option") {
+		t.Fatalf("unsupported option: %v", err)
+	}
+}
+
+func TestDialHostKey(t *testing.T) {
+	isolate(t)
+	priv, signer := newKey(t)
+	server := startSSHServer(t, signer.PublicKey())
+	identity := writeIdentity(t, t.TempDir(), priv, "")
+
+	// known_hosts 中的主机密钥不符
+	_, otherHost := newKey(t)
+	conf := server.config(identity)
+	conf.Options = []string{"UserKnownHostsFile=" + writeKnownHosts(t, server.port, otherHost.PublicKey())}
+	if _, err := Dial(conf); err == nil {
+		t.Fatal("mismatched host key accepted")
+	}
+	// 默认的 ~/.ssh/known_hosts 不存在
+	conf.Options = nil
+	if _, err := Dial(conf); err == nil {
+		t.Fatal("dial without known_hosts succeeded")
+	}
+	conf.Options = []string{"StrictHostKeyChecking=no"}
+	c, err := Dial(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+}
+
+// 未配置 identityfile 时使用 ~/.ssh 下的默认密钥
+func TestDialDefaultIdentity(t *testing.T) {
+	home := isolate(t)
+	priv, signer := newKey(t)
+	server := startSSHServer(t, signer.PublicKey())
+	writeIdentity(t, filepath.Join(home, ".ssh"), priv, "")
+	c, err := Dial(server.config(""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+}
+
+func TestDialAgent(t *testing.T) {
+	isolate(t)
+	priv, signer := newKey(t)
+	server := startSSHServer(t, signer.PublicKey())
+	keyring := agent.NewKeyring()
+	if err := keyring.Add(agent.AddedKey{PrivateKey: priv}); err != nil {
+		t.Fatal(err)
+	}
+	sock := filepath.Join(t.TempDir(), "agent.sock")
+	listener, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Skip("unix socket not supported:", err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go agent.ServeAgent(keyring, conn)
+		}
+	}()
+	t.Setenv("SSH_AUTH_SOCK", sock)
+	c, err := Dial(server.config(""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+}
+
+func TestRename(t *testing.T) {
+	c := dialTest(t)
+	dir := t.TempDir()
+	write := func(name string, data string) string {
+		p := filepath.Join(dir, name)
+		if err := os.WriteFile(p, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+	dst := write("dst", "old")
+	// 覆盖已存在的目标
+	if err := c.Rename(write("a", "new"), dst); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(dst); string(data) != "new" {
+		t.Fatalf("after rename %q", data)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "a")); !os.IsNotExist(err) {
+		t.Fatalf("source still exists: %v", err)
+	}
+}
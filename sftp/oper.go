@@ -0,0 +1,232 @@
+package sftp
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"stacktrace.top/filesync/config"
+	"stacktrace.top/filesync/logger"
+	"stacktrace.top/filesync/sync"
+)
+
+const (
+	defaultThreads = 4
+	// 上传中的临时文件，完成后改名
+	tmpSuffix = ".fstmp"
+)
+
+// SFTPSyncOper 通过 ssh 的 sftp 子系统同步到远程目录，目标端无需运行 daemon
+type SFTPSyncOper struct {
+	scanner *sync.Scanner
+	client  *Client
+	root    string
+	// 并行上传的文件数
+	threads int
+}
+
+// NewSFTPSyncOper 按 cfg 连接远程主机，并行上传数量使用 clientConf 的 threads
+func NewSFTPSyncOper(scanner *sync.Scanner, cfg config.SshConfig, clientConf config.ClientConfig) (*SFTPSyncOper, error) {
+	client, err := Dial(cfg)
+	if err != nil {
+		return nil, err
+	}
+	root := filepath.ToSlash(scanner.Config.Dstpath)
+	if root != "/" {
+		root = strings.TrimSuffix(root, "/")
+	}
+	return &SFTPSyncOper{scanner: scanner, client: client, root: root, threads: clientConf.Threads}, nil
+}
+
+func (o *SFTPSyncOper) Close() error {
+	return o.client.Close()
+}
+
+func (o *SFTPSyncOper) remotePath(relPath string) string {
+	return path.Join(o.root, filepath.ToSlash(relPath))
+}
+
+// FileInfos 遍历远程目录，修改时间只有秒级精度
+func (o *SFTPSyncOper) FileInfos() (map[string]*sync.SyncFileInfo, error) {
+	infos := make(map[string]*sync.SyncFileInfo)
+	var walk func(dir string, relDir string) error
+	walk = func(dir string, relDir string) error {
+		entries, err := o.client.ReadDir(dir)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			name := entry.Name()
+			if strings.HasSuffix(name, tmpSuffix) {
+				continue
+			}
+			relPath := path.Join(relDir, name)
+			mode := entry.Mode() & os.ModePerm
+			if entry.IsDir() {
+				mode |= os.ModeDir
+			} else if !entry.Mode().IsRegular() {
+				// 符号链接等特殊文件
+				mode |= os.ModeIrregular
+			}
+			infos[filepath.FromSlash(relPath)] = &sync.SyncFileInfo{
+				Name:    name,
+				Size:    entry.Size(),
+				ModTime: entry.ModTime(),
+				Mode:    mode,
+				IsDir:   entry.IsDir(),
+			}
+			if entry.IsDir() {
+				if err := walk(path.Join(dir, name), relPath); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+	err := walk(o.root, "")
+	if os.IsNotExist(err) {
+		return infos, nil
+	}
+	return infos, err
+}
+
+// DstFileInfos 返回带 SHA-256 的远程文件信息，需要读取全部文件内容，用于校验
+func (o *SFTPSyncOper) DstFileInfos() (map[string]*sync.SyncFileInfo, error) {
+	infos, err := o.FileInfos()
+	if err != nil {
+		return nil, err
+	}
+	for relPath, info := range infos {
+		if info.IsDir || !info.Mode.IsRegular() {
+			continue
+		}
+		hasher := sha256.New()
+		file, err := o.client.Open(o.remotePath(relPath))
+		if err != nil {
+			return nil, err
+		}
+		_, err = io.Copy(hasher, file)
+		file.Close()
+		if err != nil {
+			return nil, err
+		}
+		info.Hash = hex.EncodeToString(hasher.Sum(nil))
+	}
+	return infos, nil
+}
+
+func (o *SFTPSyncOper) CompareDiffFiles() (map[string]*sync.SyncFileInfo, error) {
+	o.scanner.LoadSrcCache()
+	infos, err := o.FileInfos()
+	if err != nil {
+		return nil, err
+	}
+	srcFiles := o.scanner.Src
+	for k, v := range infos {
+		// SFTP 只有秒级时间，同一秒内视为相同
+		if src, ok := srcFiles[k]; ok && src.ModTime.Truncate(time.Second).Equal(v.ModTime) {
+			v.ModTime = src.ModTime
+		}
+	}
+	o.scanner.SetDst(infos)
+	return o.scanner.Compare(), nil
+}
+
+func (o *SFTPSyncOper) SyncFiles(diffFiles map[string]*sync.SyncFileInfo, stats *sync.Stats) {
+	threads := o.threads
+	if threads <= 0 {
+		threads = defaultThreads
+	}
+	o.scanner.SyncParallel(diffFiles, stats, threads, o.upload)
+}
+
+func (o *SFTPSyncOper) SyncFile(srcFilePath string, dstFilePath string, fileInfo *sync.SyncFileInfo) error {
+	relPath, err := filepath.Rel(o.scanner.Config.Srcpath, srcFilePath)
+	if err != nil {
+		return err
+	}
+	return o.upload(relPath, fileInfo, nil)
+}
+
+// upload 写入临时文件，设置权限和修改时间后改名为目标文件
+func (o *SFTPSyncOper) upload(relPath string, fileInfo *sync.SyncFileInfo, progress func(offset int64)) error {
+	dstPath := o.remotePath(relPath)
+	if fileInfo.IsDir {
+		if err := o.client.MkdirAll(dstPath); err != nil {
+			logger.Error("create dir: %v failed.err: %v", dstPath, err)
+			return err
+		}
+		return o.setstat(dstPath, fileInfo)
+	}
+	srcFilePath := filepath.Join(o.scanner.Config.Srcpath, relPath)
+	file, err := os.Open(srcFilePath)
+	if err != nil {
+		logger.Error("open file: %v failed.err: %v", srcFilePath, err)
+		return err
+	}
+	defer file.Close()
+	if err := o.client.MkdirAll(path.Dir(dstPath)); err != nil {
+		logger.Error("create dir: %v failed.err: %v", path.Dir(dstPath), err)
+		return err
+	}
+	tmpPath := dstPath + tmpSuffix
+	err = o.writeFile(tmpPath, &progressReader{r: file, size: fileInfo.Size, progress: progress})
+	if err == nil {
+		err = o.setstat(tmpPath, fileInfo)
+	}
+	if err == nil {
+		err = o.client.Rename(tmpPath, dstPath)
+	}
+	if err != nil {
+		logger.Error("upload file: %v failed.err: %v", dstPath, err)
+		o.client.Remove(tmpPath)
+		return err
+	}
+	return nil
+}
+
+// writeFile 创建或截断远程文件后写入，已知大小时并发发送多个写请求
+func (o *SFTPSyncOper) writeFile(name string, r io.Reader) error {
+	file, err := o.client.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+	if err != nil {
+		return err
+	}
+	if _, err := file.ReadFrom(r); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+func (o *SFTPSyncOper) setstat(name string, fileInfo *sync.SyncFileInfo) error {
+	if err := o.client.Chmod(name, fileInfo.Mode&os.ModePerm); err != nil {
+		return err
+	}
+	return o.client.Chtimes(name, fileInfo.ModTime, fileInfo.ModTime)
+}
+
+// progressReader 在读取时报告已读取的偏移，Size 让 sftp 客户端按文件大小并发写入
+type progressReader struct {
+	r        io.Reader
+	size     int64
+	offset   int64
+	progress func(offset int64)
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	p.offset += int64(n)
+	if n > 0 && p.progress != nil {
+		p.progress(p.offset)
+	}
+	return n, err
+}
+
+func (p *progressReader) Size() int64 {
+	return p.size
+}
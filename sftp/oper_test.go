@@ -0,0 +1,81 @@
+package sftp
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"stacktrace.top/filesync/config"
+	"stacktrace.top/filesync/sync"
+)
+
+func TestSyncAndVerify(t *testing.T) {
+	src, dst := t.TempDir(), filepath.Join(t.TempDir(), "dst")
+	mtime := time.Date(2021, 2, 3, 4, 5, 6, 789000000, time.UTC)
+	// 大文件按文件大小并发写入
+	files := map[string]string{"a": "aaa", filepath.Join("d", "e", "b"): "bb", "big": strings.Repeat("0123456789", 300000)}
+	for name, data := range files {
+		p := filepath.Join(src, name)
+		os.MkdirAll(filepath.Dir(p), 0755)
+		if err := os.WriteFile(p, []byte(data), 0600); err != nil {
+			t.Fatal(err)
+		}
+		os.Chtimes(p, mtime, mtime)
+	}
+	scanner, err := sync.NewScanner(config.SyncConfig{Srcpath: src, Dstpath: dst, Retries: -1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	scanner.Src = scanner.ScanDir(sync.Local, src, false)
+	isolate(t)
+	priv, signer := newKey(t)
+	server := startSSHServer(t, signer.PublicKey())
+	o, err := NewSFTPSyncOper(scanner, server.config(writeIdentity(t, t.TempDir(), priv, "")), config.ClientConfig{Threads: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer o.Close()
+
+	diff, err := o.CompareDiffFiles()
+	if err != nil || len(diff) != 5 {
+		t.Fatalf("diff: %v %v", diff, err)
+	}
+	stats := sync.NewStats(diff, scanner.Src)
+	o.SyncFiles(diff, stats)
+	stats.Finish()
+	if report := stats.Report(); report.FilesDone != 5 || report.FilesFailed != 0 {
+		t.Fatalf("report: %+v", report)
+	}
+	for name, data := range files {
+		p := filepath.Join(dst, name)
+		got, err := os.ReadFile(p)
+		if err != nil || string(got) != data {
+			t.Fatalf("%v: %q %v", name, got, err)
+		}
+		info, _ := os.Stat(p)
+		if info.Mode().Perm() != 0600 || !info.ModTime().Equal(mtime.Truncate(time.Second)) {
+			t.Fatalf("%v: %v %v", name, info.Mode(), info.ModTime())
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dst, "a"+tmpSuffix)); !os.IsNotExist(err) {
+		t.Fatalf("temp file left: %v", err)
+	}
+	// 秒级时间相同的文件不再同步
+	if diff, err = o.CompareDiffFiles(); err != nil || len(diff) != 0 {
+		t.Fatalf("diff after sync: %v %v", diff, err)
+	}
+
+	os.WriteFile(filepath.Join(dst, "a"), []byte("evil"), 0600)
+	infos, err := o.DstFileInfos()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256([]byte("evil"))
+	if infos["a"].Hash != hex.EncodeToString(sum[:]) || infos["d"].Hash != "" {
+		t.Fatalf("hashes: %+v %+v", infos["a"], infos["d"])
+	}
+}
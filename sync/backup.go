@@ -0,0 +1,312 @@
+package sync
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"stacktrace.top/filesync/config"
+	"stacktrace.top/filesync/logger"
+)
+
+// 写入中的文件先写入同目录下的临时文件，完成后再替换目标文件
+const tmpSuffix = ".fstmp"
+
+// 历史版本的文件名为 原文件名~时间戳
+const (
+	versionSep    = "~"
+	versionLayout = "20060102-150405.000"
+	// 版本名冲突时最多顺延的次数
+	maxVersionProbe = 1000
+)
+
+func TempPath(dstPath string) string {
+	return filepath.Join(filepath.Dir(dstPath), "."+filepath.Base(dstPath)+tmpSuffix)
+}
+
+// WriteFileAtomic 写临时文件后替换目标文件，避免留下写了一半的文件
+func WriteFileAtomic(dstPath string, data []byte, mode os.FileMode) error {
+	return WriteFileAtomicFS(Local, dstPath, data, mode)
+}
+
+func WriteFileAtomicFS(fsys FS, dstPath string, data []byte, mode os.FileMode) error {
+	tmpPath := TempPath(dstPath)
+	file, err := fsys.Create(tmpPath, mode)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		// 存储开启了备份时，替换前先保留旧版本
+		err = fsys.Rename(tmpPath, dstPath)
+	}
+	if err != nil {
+		fsys.Remove(tmpPath)
+	}
+	return err
+}
+
+// BackupFS 在 Rename 覆盖文件前把旧版本保存到 Conf.Dir，Conf.Dir 为空时不备份。
+// 旧版本与目标文件保存在同一存储中
+type BackupFS struct {
+	FS
+	Conf config.BackupConfig
+}
+
+// WithBackup 返回按 conf 保存旧版本的存储
+func WithBackup(fsys FS, conf config.BackupConfig) *BackupFS {
+	if b, ok := fsys.(*BackupFS); ok {
+		fsys = b.FS
+	}
+	return &BackupFS{FS: fsys, Conf: conf}
+}
+
+// Rename 替换已存在的文件时先保留旧版本
+func (b *BackupFS) Rename(oldpath string, newpath string) error {
+	if err := b.backup(newpath); err != nil {
+		return fmt.Errorf("backup %v failed: %w", newpath, err)
+	}
+	return b.FS.Rename(oldpath, newpath)
+}
+
+// backupPath 返回文件在备份目录中的位置，按目标文件的绝对路径存放
+func (b *BackupFS) backupPath(dstPath string) (string, error) {
+	absPath, err := filepath.Abs(dstPath)
+	if err != nil {
+		return "", err
+	}
+	rel := strings.TrimPrefix(absPath, filepath.VolumeName(absPath))
+	return filepath.Join(b.Conf.Dir, rel), nil
+}
+
+// backup 在目标文件被替换前保存当前内容。文件随后被整体替换而不会原地修改，
+// 因此优先使用硬链接，不支持或跨文件系统时复制
+func (b *BackupFS) backup(dstPath string) error {
+	if b.Conf.Dir == "" {
+		return nil
+	}
+	info, err := b.FS.Stat(dstPath)
+	if errors.Is(err, fs.ErrNotExist) || (err == nil && !info.Mode().IsRegular()) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	base, err := b.backupPath(dstPath)
+	if err != nil {
+		return err
+	}
+	if err := b.FS.MkdirAll(filepath.Dir(base), 0755); err != nil {
+		return err
+	}
+	// 同一毫秒内多次替换时版本名已存在，顺延 1 毫秒，版本名仍按时间排序
+	t := time.Now()
+	for i := 0; ; i++ {
+		versionPath := base + versionSep + t.Format(versionLayout)
+		_, err := b.FS.Stat(versionPath)
+		if err == nil {
+			err = pathError("backup", versionPath, fs.ErrExist)
+		} else if errors.Is(err, fs.ErrNotExist) {
+			if err = b.FS.Link(dstPath, versionPath); err != nil && !errors.Is(err, fs.ErrExist) {
+				err = copyFile(b.FS, dstPath, versionPath, info)
+			}
+		}
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, fs.ErrExist) || i >= maxVersionProbe {
+			return err
+		}
+		t = t.Add(time.Millisecond)
+	}
+	b.pruneVersions(base, time.Now())
+	return nil
+}
+
+func copyFile(fsys FS, srcPath string, dstPath string, info os.FileInfo) error {
+	src, err := fsys.Open(srcPath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := fsys.Create(dstPath, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(dst, src)
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		fsys.Remove(dstPath)
+		return err
+	}
+	return fsys.Chtimes(dstPath, info.ModTime(), info.ModTime())
+}
+
+// FileVersion 是一个文件的历史版本
+type FileVersion struct {
+	// 时间戳，用于指定要恢复的版本
+	ID   string
+	Time time.Time
+	Path string
+	Size int64
+}
+
+// ListVersions 返回目标文件的历史版本，最新的在前
+func (b *BackupFS) ListVersions(dstPath string) ([]*FileVersion, error) {
+	if b.Conf.Dir == "" {
+		return nil, errors.New("backup is not enabled")
+	}
+	base, err := b.backupPath(dstPath)
+	if err != nil {
+		return nil, err
+	}
+	return listVersions(b.FS, base)
+}
+
+// listVersions 列出备份目录中 base 的所有版本
+func listVersions(fsys FS, base string) ([]*FileVersion, error) {
+	entries, err := ReadDirFS(fsys, filepath.Dir(base))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	prefix := filepath.Base(base) + versionSep
+	var versions []*FileVersion
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		id := name[len(prefix):]
+		t, err := time.ParseInLocation(versionLayout, id, time.Local)
+		if err != nil {
+			continue
+		}
+		versions = append(versions, &FileVersion{
+			ID:   id,
+			Time: t,
+			Path: filepath.Join(filepath.Dir(base), name),
+			Size: entry.Size(),
+		})
+	}
+	sort.Slice(versions, func(i, j int) bool {
+		return versions[i].Time.After(versions[j].Time)
+	})
+	return versions, nil
+}
+
+// expired 判断按时间倒序排第 idx 个的版本是否超出保留数量或天数
+func (b *BackupFS) expired(idx int, t time.Time, now time.Time) bool {
+	keep, days := b.Conf.Keep, b.Conf.Days
+	return (keep > 0 && idx >= keep) || (days > 0 && now.Sub(t) > time.Duration(days)*24*time.Hour)
+}
+
+// pruneVersions 删除 base 的过期版本
+func (b *BackupFS) pruneVersions(base string, now time.Time) {
+	versions, err := listVersions(b.FS, base)
+	if err != nil {
+		logger.Error("list versions of %v failed. err: %v", base, err)
+		return
+	}
+	for i, version := range versions {
+		if b.expired(i, version.Time, now) {
+			if err := b.FS.Remove(version.Path); err != nil {
+				logger.Error("remove version %v failed. err: %v", version.Path, err)
+			}
+		}
+	}
+}
+
+// Prune 遍历备份目录，清理所有文件的过期版本，返回删除的版本数
+func (b *BackupFS) Prune() int {
+	fsys, dir := b.FS, b.Conf.Dir
+	if dir == "" {
+		return 0
+	}
+	now := time.Now()
+	removed := 0
+	fsys.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || !info.IsDir() {
+			return nil
+		}
+		entries, err := ReadDirFS(fsys, path)
+		if err != nil {
+			logger.Error("read backup dir %v failed. err: %v", path, err)
+			return nil
+		}
+		// 同一文件的版本按时间倒序分组
+		groups := make(map[string][]time.Time)
+		for _, entry := range entries {
+			idx := strings.LastIndex(entry.Name(), versionSep)
+			if entry.IsDir() || idx < 0 {
+				continue
+			}
+			t, err := time.ParseInLocation(versionLayout, entry.Name()[idx+1:], time.Local)
+			if err != nil {
+				continue
+			}
+			groups[entry.Name()[:idx]] = append(groups[entry.Name()[:idx]], t)
+		}
+		for name, times := range groups {
+			sort.Slice(times, func(i, j int) bool { return times[i].After(times[j]) })
+			for i, t := range times {
+				if b.expired(i, t, now) {
+					versionPath := filepath.Join(path, name+versionSep+t.Format(versionLayout))
+					if err := fsys.Remove(versionPath); err != nil {
+						logger.Error("remove version %v failed. err: %v", versionPath, err)
+					} else {
+						removed++
+					}
+				}
+			}
+		}
+		return nil
+	})
+	return removed
+}
+
+// RestoreVersion 用指定版本替换目标文件，当前内容同样先备份，恢复操作可以撤销
+func (b *BackupFS) RestoreVersion(dstPath string, id string) error {
+	fsys := b.FS
+	versions, err := b.ListVersions(dstPath)
+	if err != nil {
+		return err
+	}
+	for _, version := range versions {
+		if version.ID != id {
+			continue
+		}
+		info, err := fsys.Stat(version.Path)
+		if err != nil {
+			return err
+		}
+		if err := fsys.MkdirAll(filepath.Dir(dstPath), os.ModePerm); err != nil {
+			return err
+		}
+		tmpPath := TempPath(dstPath)
+		fsys.Remove(tmpPath)
+		if err := copyFile(fsys, version.Path, tmpPath, info); err != nil {
+			return err
+		}
+		if err := b.Rename(tmpPath, dstPath); err != nil {
+			fsys.Remove(tmpPath)
+			return err
+		}
+		return nil
+	}
+	return fmt.Errorf("version %v of %v not found", id, dstPath)
+}
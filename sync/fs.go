@@ -0,0 +1,397 @@
+package sync
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	gosync "sync"
+	"time"
+)
+
+// FS 是同步引擎读写文件使用的存储接口，路径为该存储中的完整路径
+type FS interface {
+	Walk(root string, fn filepath.WalkFunc) error
+	Stat(name string) (os.FileInfo, error)
+	Open(name string) (io.ReadCloser, error)
+	// Create 创建或截断文件
+	Create(name string, perm os.FileMode) (File, error)
+	Rename(oldpath string, newpath string) error
+	Remove(name string) error
+	MkdirAll(path string, perm os.FileMode) error
+	Chtimes(name string, atime time.Time, mtime time.Time) error
+	Chmod(name string, mode os.FileMode) error
+	// Link 创建硬链接，用于备份和快照，不支持时返回错误，调用方改为复制
+	Link(oldname string, newname string) error
+}
+
+// File 是 Create 返回的可写文件
+type File interface {
+	io.Writer
+	Sync() error
+	Close() error
+}
+
+// LocalFS 直接使用本地文件系统
+type LocalFS struct{}
+
+// Local 是默认使用的本地存储
+var Local FS = LocalFS{}
+
+func (LocalFS) Walk(root string, fn filepath.WalkFunc) error { return filepath.Walk(root, fn) }
+func (LocalFS) Stat(name string) (os.FileInfo, error)        { return os.Stat(name) }
+func (LocalFS) Open(name string) (io.ReadCloser, error)      { return os.Open(name) }
+func (LocalFS) Rename(oldpath string, newpath string) error  { return os.Rename(oldpath, newpath) }
+func (LocalFS) Remove(name string) error                     { return os.Remove(name) }
+func (LocalFS) Chmod(name string, mode os.FileMode) error    { return os.Chmod(name, mode) }
+func (LocalFS) Link(oldname string, newname string) error    { return os.Link(oldname, newname) }
+
+func (LocalFS) Create(name string, perm os.FileMode) (File, error) {
+	file, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		// 避免返回包含 nil 指针的非 nil 接口
+		return nil, err
+	}
+	return file, nil
+}
+
+func (LocalFS) MkdirAll(path string, perm os.FileMode) error {
+	return os.MkdirAll(path, perm)
+}
+
+func (LocalFS) Chtimes(name string, atime time.Time, mtime time.Time) error {
+	return os.Chtimes(name, atime, mtime)
+}
+
+// ReadDirFS 返回目录中按名称排序的条目，不进入子目录
+func ReadDirFS(fsys FS, dir string) ([]os.FileInfo, error) {
+	dir = filepath.Clean(dir)
+	var infos []os.FileInfo
+	err := fsys.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == dir {
+			if !info.IsDir() {
+				return pathError("readdir", dir, fs.ErrInvalid)
+			}
+			return nil
+		}
+		infos = append(infos, info)
+		if info.IsDir() {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name() < infos[j].Name() })
+	return infos, nil
+}
+
+// RemoveAllFS 删除 path 及其中的所有条目，不存在时不报错
+func RemoveAllFS(fsys FS, path string) error {
+	var paths []string
+	err := fsys.Walk(path, func(name string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		paths = append(paths, name)
+		return nil
+	})
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	// 先删除目录中的条目，再删除目录
+	for i := len(paths) - 1; i >= 0; i-- {
+		if err := fsys.Remove(paths[i]); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+// MemFS 是内存中的文件系统，用于测试和嵌入，可并发使用
+type MemFS struct {
+	mu    gosync.Mutex
+	nodes map[string]*memNode
+}
+
+type memNode struct {
+	name    string
+	data    []byte
+	mode    os.FileMode
+	modTime time.Time
+}
+
+func (n *memNode) Name() string       { return n.name }
+func (n *memNode) Size() int64        { return int64(len(n.data)) }
+func (n *memNode) Mode() os.FileMode  { return n.mode }
+func (n *memNode) ModTime() time.Time { return n.modTime }
+func (n *memNode) IsDir() bool        { return n.mode.IsDir() }
+func (n *memNode) Sys() any           { return nil }
+
+func NewMemFS() *MemFS {
+	return &MemFS{nodes: make(map[string]*memNode)}
+}
+
+func pathError(op string, name string, err error) error {
+	return &fs.PathError{Op: op, Path: name, Err: err}
+}
+
+// parentExists 检查父目录，根目录总是存在。调用方持有锁
+func (m *MemFS) parentExists(name string) bool {
+	dir := filepath.Dir(name)
+	if dir == name || dir == "." || dir == string(os.PathSeparator) {
+		return true
+	}
+	node, ok := m.nodes[dir]
+	return ok && node.IsDir()
+}
+
+// children 返回目录下按名称排序的条目路径。调用方持有锁
+func (m *MemFS) children(dir string) []string {
+	var names []string
+	for name := range m.nodes {
+		if name != dir && filepath.Dir(name) == dir {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// stat 返回条目信息的副本，遍历时回调可以安全修改文件系统
+func (m *MemFS) stat(name string) (*memNode, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	node, ok := m.nodes[filepath.Clean(name)]
+	if !ok {
+		return nil, pathError("stat", name, fs.ErrNotExist)
+	}
+	copied := *node
+	return &copied, nil
+}
+
+func (m *MemFS) Stat(name string) (os.FileInfo, error) {
+	node, err := m.stat(name)
+	if err != nil {
+		return nil, err
+	}
+	return node, nil
+}
+
+// Walk 与 filepath.Walk 相同，按名称顺序先访问目录再访问其中的条目
+func (m *MemFS) Walk(root string, fn filepath.WalkFunc) error {
+	root = filepath.Clean(root)
+	node, err := m.stat(root)
+	if err != nil {
+		err = fn(root, nil, err)
+	} else {
+		err = m.walk(root, node, fn)
+	}
+	if err == filepath.SkipDir || err == filepath.SkipAll {
+		return nil
+	}
+	return err
+}
+
+func (m *MemFS) walk(path string, node *memNode, fn filepath.WalkFunc) error {
+	if err := fn(path, node, nil); err != nil || !node.IsDir() {
+		return err
+	}
+	m.mu.Lock()
+	names := m.children(path)
+	m.mu.Unlock()
+	for _, name := range names {
+		child, err := m.stat(name)
+		if err != nil {
+			// 遍历过程中被删除
+			continue
+		}
+		if err := m.walk(name, child, fn); err != nil {
+			if err == filepath.SkipDir && !child.IsDir() {
+				return nil
+			}
+			if err != filepath.SkipDir {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (m *MemFS) Open(name string) (io.ReadCloser, error) {
+	node, err := m.stat(name)
+	if err != nil {
+		return nil, pathError("open", name, fs.ErrNotExist)
+	}
+	if node.IsDir() {
+		return nil, pathError("open", name, fs.ErrInvalid)
+	}
+	return io.NopCloser(strings.NewReader(string(node.data))), nil
+}
+
+func (m *MemFS) Create(name string, perm os.FileMode) (File, error) {
+	name = filepath.Clean(name)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.parentExists(name) {
+		return nil, pathError("open", name, fs.ErrNotExist)
+	}
+	if node, ok := m.nodes[name]; ok && node.IsDir() {
+		return nil, pathError("open", name, fs.ErrExist)
+	}
+	m.nodes[name] = &memNode{name: filepath.Base(name), mode: perm.Perm(), modTime: time.Now()}
+	return &memFile{fs: m, name: name}, nil
+}
+
+// memFile 在关闭时才写入内容
+type memFile struct {
+	fs   *MemFS
+	name string
+	data []byte
+}
+
+func (f *memFile) Write(b []byte) (int, error) {
+	f.data = append(f.data, b...)
+	return len(b), nil
+}
+
+func (f *memFile) Sync() error { return nil }
+
+func (f *memFile) Close() error {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	node, ok := f.fs.nodes[f.name]
+	if !ok {
+		return pathError("close", f.name, fs.ErrNotExist)
+	}
+	node.data = f.data
+	node.modTime = time.Now()
+	return nil
+}
+
+// Rename 改名文件或整个目录，覆盖已存在的文件
+func (m *MemFS) Rename(oldpath string, newpath string) error {
+	oldpath, newpath = filepath.Clean(oldpath), filepath.Clean(newpath)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	node, ok := m.nodes[oldpath]
+	if !ok {
+		return pathError("rename", oldpath, fs.ErrNotExist)
+	}
+	if !m.parentExists(newpath) {
+		return pathError("rename", newpath, fs.ErrNotExist)
+	}
+	if dst, ok := m.nodes[newpath]; ok && dst.IsDir() && len(m.children(newpath)) > 0 {
+		return pathError("rename", newpath, fs.ErrExist)
+	}
+	prefix := oldpath + string(os.PathSeparator)
+	var moved []string
+	for name := range m.nodes {
+		if strings.HasPrefix(name, prefix) {
+			moved = append(moved, name)
+		}
+	}
+	for _, name := range moved {
+		child := m.nodes[name]
+		delete(m.nodes, name)
+		m.nodes[newpath+string(os.PathSeparator)+name[len(prefix):]] = child
+	}
+	delete(m.nodes, oldpath)
+	node.name = filepath.Base(newpath)
+	m.nodes[newpath] = node
+	return nil
+}
+
+// Remove 删除文件或空目录
+func (m *MemFS) Remove(name string) error {
+	name = filepath.Clean(name)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.nodes[name]; !ok {
+		return pathError("remove", name, fs.ErrNotExist)
+	}
+	if len(m.children(name)) > 0 {
+		return pathError("remove", name, fs.ErrExist)
+	}
+	delete(m.nodes, name)
+	return nil
+}
+
+func (m *MemFS) MkdirAll(path string, perm os.FileMode) error {
+	path = filepath.Clean(path)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var missing []string
+	for dir := path; ; dir = filepath.Dir(dir) {
+		if node, ok := m.nodes[dir]; ok {
+			if !node.IsDir() {
+				return pathError("mkdir", dir, fs.ErrExist)
+			}
+			break
+		}
+		if dir == "." || dir == filepath.Dir(dir) {
+			break
+		}
+		missing = append(missing, dir)
+	}
+	now := time.Now()
+	for _, dir := range missing {
+		m.nodes[dir] = &memNode{name: filepath.Base(dir), mode: os.ModeDir | perm.Perm(), modTime: now}
+	}
+	return nil
+}
+
+func (m *MemFS) Chtimes(name string, atime time.Time, mtime time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	node, ok := m.nodes[filepath.Clean(name)]
+	if !ok {
+		return pathError("chtimes", name, fs.ErrNotExist)
+	}
+	node.modTime = mtime
+	return nil
+}
+
+func (m *MemFS) Chmod(name string, mode os.FileMode) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	node, ok := m.nodes[filepath.Clean(name)]
+	if !ok {
+		return pathError("chmod", name, fs.ErrNotExist)
+	}
+	node.mode = node.mode&os.ModeType | mode.Perm()
+	return nil
+}
+
+// Link 添加指向同一内容的条目。文件内容只会被整体替换，复制条目与硬链接等价
+func (m *MemFS) Link(oldname string, newname string) error {
+	oldname, newname = filepath.Clean(oldname), filepath.Clean(newname)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	node, ok := m.nodes[oldname]
+	if !ok {
+		return pathError("link", oldname, fs.ErrNotExist)
+	}
+	if node.IsDir() {
+		return pathError("link", oldname, fs.ErrInvalid)
+	}
+	if _, ok := m.nodes[newname]; ok {
+		return pathError("link", newname, fs.ErrExist)
+	}
+	if !m.parentExists(newname) {
+		return pathError("link", newname, fs.ErrNotExist)
+	}
+	copied := *node
+	copied.name = filepath.Base(newname)
+	m.nodes[newname] = &copied
+	return nil
+}
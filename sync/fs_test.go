@@ -0,0 +1,289 @@
+package sync
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"stacktrace.top/filesync/config"
+)
+
+func writeMem(t *testing.T, m *MemFS, name string, data string) {
+	t.Helper()
+	if err := m.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		t.Fatal(err)
+	}
+	file, err := m.Create(name, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Write([]byte(data))
+	if err := file.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readMem(t *testing.T, m FS, name string) string {
+	t.Helper()
+	file, err := m.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	data, err := io.ReadAll(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestMemFSCreateOpen(t *testing.T) {
+	m := NewMemFS()
+	if _, err := m.Create("/a/b", 0644); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("create without parent: %v", err)
+	}
+	writeMem(t, m, "/a/b", "hello")
+	if got := readMem(t, m, "/a/b"); got != "hello" {
+		t.Fatalf("read %q", got)
+	}
+	info, err := m.Stat("/a/b")
+	if err != nil || info.Size() != 5 || info.Name() != "b" || info.Mode().Perm() != 0644 {
+		t.Fatalf("stat: %v %v", info, err)
+	}
+	if _, err := m.Open("/a"); err == nil {
+		t.Fatal("open dir should fail")
+	}
+	// 截断已有文件
+	writeMem(t, m, "/a/b", "x")
+	if got := readMem(t, m, "/a/b"); got != "x" {
+		t.Fatalf("read after truncate %q", got)
+	}
+}
+
+func TestMemFSWalk(t *testing.T) {
+	m := NewMemFS()
+	writeMem(t, m, "/r/b/2", "")
+	writeMem(t, m, "/r/a", "")
+	writeMem(t, m, "/r/b/1", "")
+	writeMem(t, m, "/r/c/3", "")
+	var paths []string
+	err := m.Walk("/r", func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		paths = append(paths, path)
+		if path == "/r/c" {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"/r", "/r/a", "/r/b", "/r/b/1", "/r/b/2", "/r/c"}
+	if !reflect.DeepEqual(paths, want) {
+		t.Fatalf("walk %v, want %v", paths, want)
+	}
+	err = m.Walk("/missing", func(path string, info os.FileInfo, err error) error {
+		return err
+	})
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("walk missing root: %v", err)
+	}
+}
+
+func TestMemFSRenameRemove(t *testing.T) {
+	m := NewMemFS()
+	writeMem(t, m, "/d/x/f", "f")
+	writeMem(t, m, "/d/g", "g")
+	// 改名目录时其中的条目一起移动
+	if err := m.Rename("/d/x", "/d/y"); err != nil {
+		t.Fatal(err)
+	}
+	if got := readMem(t, m, "/d/y/f"); got != "f" {
+		t.Fatalf("moved file %q", got)
+	}
+	if _, err := m.Stat("/d/x/f"); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("old path still exists: %v", err)
+	}
+	// 覆盖已存在的文件
+	if err := m.Rename("/d/g", "/d/y/f"); err != nil {
+		t.Fatal(err)
+	}
+	if got := readMem(t, m, "/d/y/f"); got != "g" {
+		t.Fatalf("replaced file %q", got)
+	}
+	if err := m.Remove("/d/y"); err == nil {
+		t.Fatal("remove non-empty dir should fail")
+	}
+	if err := m.Remove("/d/y/f"); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Remove("/d/y"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMemFSMetadata(t *testing.T) {
+	m := NewMemFS()
+	writeMem(t, m, "/f", "")
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	if err := m.Chtimes("/f", mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Chmod("/f", 0600); err != nil {
+		t.Fatal(err)
+	}
+	info, _ := m.Stat("/f")
+	if !info.ModTime().Equal(mtime) || info.Mode() != 0600 {
+		t.Fatalf("metadata: %v %v", info.ModTime(), info.Mode())
+	}
+	if err := m.MkdirAll("/f/sub", 0755); err == nil {
+		t.Fatal("mkdir under file should fail")
+	}
+}
+
+func TestMemFSLink(t *testing.T) {
+	m := NewMemFS()
+	writeMem(t, m, "/a", "old")
+	if err := m.Link("/a", "/b"); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Link("/a", "/b"); !errors.Is(err, fs.ErrExist) {
+		t.Fatalf("link to existing: %v", err)
+	}
+	// 替换原文件后链接仍是旧内容
+	writeMem(t, m, "/a", "new")
+	if got := readMem(t, m, "/b"); got != "old" {
+		t.Fatalf("link content %q", got)
+	}
+}
+
+func TestReadDirAndRemoveAll(t *testing.T) {
+	m := NewMemFS()
+	writeMem(t, m, "/r/b/1", "")
+	writeMem(t, m, "/r/a", "")
+	infos, err := ReadDirFS(m, "/r")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != 2 || infos[0].Name() != "a" || infos[1].Name() != "b" {
+		t.Fatalf("readdir: %v", infos)
+	}
+	if err := RemoveAllFS(m, "/r"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Stat("/r"); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("dir still exists: %v", err)
+	}
+	if err := RemoveAllFS(m, "/r"); err != nil {
+		t.Fatalf("remove missing: %v", err)
+	}
+}
+
+func TestScannerWalkStops(t *testing.T) {
+	m := NewMemFS()
+	for _, name := range []string{"/r/a", "/r/b", "/r/c"} {
+		writeMem(t, m, name, "x")
+	}
+	scanner, err := NewScanner(config.SyncConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stop := errors.New("stop")
+	var seen []string
+	err = scanner.Walk(m, "/r", false, func(relPath string, info *SyncFileInfo) error {
+		seen = append(seen, relPath)
+		return stop
+	})
+	if err != stop || len(seen) != 1 {
+		t.Fatalf("walk: %v %v", seen, err)
+	}
+}
+
+func TestBackupOnMemFS(t *testing.T) {
+	m := NewMemFS()
+	b := WithBackup(m, config.BackupConfig{Dir: "/backup", Keep: 2})
+	m.MkdirAll("/dst", 0755)
+	for _, data := range []string{"v1", "v2", "v3", "v4"} {
+		if err := WriteFileAtomicFS(b, "/dst/f", []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	versions, err := b.ListVersions("/dst/f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 2 {
+		t.Fatalf("versions: %d", len(versions))
+	}
+	if got := readMem(t, m, versions[0].Path); got != "v3" {
+		t.Fatalf("latest version %q", got)
+	}
+	if err := b.RestoreVersion("/dst/f", versions[1].ID); err != nil {
+		t.Fatal(err)
+	}
+	if got := readMem(t, m, "/dst/f"); got != "v2" {
+		t.Fatalf("restored %q", got)
+	}
+	// 没有配置备份目录时不保留旧版本
+	plain := WithBackup(m, config.BackupConfig{})
+	if err := WriteFileAtomicFS(plain, "/dst/g", []byte("1"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteFileAtomicFS(plain, "/dst/g", []byte("2"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := plain.ListVersions("/dst/g"); err == nil {
+		t.Fatal("list versions without backup dir should fail")
+	}
+	if infos, _ := ReadDirFS(m, "/backup/dst"); len(infos) != 2 {
+		t.Fatalf("backup dir entries: %d", len(infos))
+	}
+}
+
+func TestSnapshotOnMemFS(t *testing.T) {
+	m := NewMemFS()
+	writeMem(t, m, "/snap/2020-01-01_000000/d/f", "f")
+	entries := map[string]*SyncFileInfo{
+		"d":                        {Name: "d", IsDir: true, Mode: os.ModeDir | 0755},
+		filepath.Join("d", "f"):    {Name: "f", Size: 1, Mode: 0644},
+		filepath.Join("d", "gone"): {Name: "gone", Size: 1, Mode: 0644},
+	}
+	failed, err := LinkFiles(m, "/snap/2020-01-01_000000", "/snap/2020-01-02_000000", entries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(failed) != 1 || failed[filepath.Join("d", "gone")] == nil {
+		t.Fatalf("failed: %v", failed)
+	}
+	if got := readMem(t, m, "/snap/2020-01-02_000000/d/f"); got != "f" {
+		t.Fatalf("linked %q", got)
+	}
+	names, err := ListSnapshotDirs(m, "/snap")
+	if err != nil || !reflect.DeepEqual(names, []string{"2020-01-01_000000", "2020-01-02_000000"}) {
+		t.Fatalf("snapshots: %v %v", names, err)
+	}
+	if err := RemoveSnapshotDir(m, "/snap/2020-01-01_000000"); err != nil {
+		t.Fatal(err)
+	}
+	if err := RemoveSnapshotDir(m, "/snap"); err == nil {
+		t.Fatal("remove non-snapshot dir should fail")
+	}
+	names, _ = ListSnapshotDirs(m, "/snap")
+	if !reflect.DeepEqual(names, []string{"2020-01-02_000000"}) {
+		t.Fatalf("snapshots after remove: %v", names)
+	}
+	oper := &FSSyncOper{Dst: m}
+	if dir, err := LatestSnapshot(oper, "/snap"); err != nil || dir != filepath.Join("/snap", "2020-01-02_000000") {
+		t.Fatalf("latest: %v %v", dir, err)
+	}
+	if _, err := LatestSnapshot(oper, "/none"); err == nil {
+		t.Fatal("latest snapshot of an empty root should fail")
+	}
+}
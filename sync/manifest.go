@@ -0,0 +1,72 @@
+package sync
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+
+	"stacktrace.top/filesync/logger"
+)
+
+// FailedFile 是清单中的一个失败文件
+type FailedFile struct {
+	Info  *SyncFileInfo
+	Error string
+}
+
+// FailureManifest 记录一次同步中重试后仍失败的文件，filesync retry 据此只重传这些文件
+type FailureManifest struct {
+	Time    time.Time
+	Srcpath string
+	Dstpath string
+	Files   map[string]*FailedFile
+}
+
+// Write 写入清单，没有失败文件时删除旧清单
+func (m *FailureManifest) Write(name string) error {
+	if len(m.Files) == 0 {
+		if err := os.Remove(name); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(name, data, 0644)
+}
+
+func LoadFailureManifest(name string) (*FailureManifest, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	m := &FailureManifest{}
+	if err := json.Unmarshal(data, m); err != nil {
+		return nil, fmt.Errorf("invalid manifest %v: %w", name, err)
+	}
+	return m, nil
+}
+
+// DiffFiles 返回清单中待重传的文件。源文件信息重新读取，
+// 避免按失败时的旧大小发送；源文件已不存在的条目跳过
+func (m *FailureManifest) DiffFiles(srcPath string, dstPath string) (map[string]*SyncFileInfo, error) {
+	if filepath.Clean(m.Srcpath) != filepath.Clean(srcPath) || filepath.Clean(m.Dstpath) != filepath.Clean(dstPath) {
+		return nil, fmt.Errorf("manifest is for %v -> %v, config is %v -> %v", m.Srcpath, m.Dstpath, srcPath, dstPath)
+	}
+	diffFiles := make(map[string]*SyncFileInfo, len(m.Files))
+	for relPath := range m.Files {
+		info, err := os.Stat(filepath.Join(srcPath, relPath))
+		if err != nil {
+			logger.Error("skip file: %v. err: %v", relPath, err)
+			continue
+		}
+		diffFiles[relPath] = newSyncFileInfo(info)
+	}
+	return diffFiles, nil
+}
@@ -0,0 +1,225 @@
+package sync
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/text/width"
+
+	"stacktrace.top/filesync/logger"
+)
+
+// 终端进度的刷新间隔，以及非终端时输出进度行的间隔
+const (
+	progressInterval = 500 * time.Millisecond
+	plainInterval    = 5 * time.Second
+)
+
+// 进度显示中文件路径的最大显示宽度(列数)
+const maxProgressPath = 60
+
+// WorkerStatus 是一个工作协程当前同步的文件及已发送的字节数
+type WorkerStatus struct {
+	ID     int
+	Path   string
+	Size   int64
+	Offset int64
+}
+
+// ProgressSnapshot 是进度显示使用的一次快照
+type ProgressSnapshot struct {
+	FilesDone  int64
+	FilesTotal int64
+	// 已完成文件的字节数加上正在传输文件已发送的部分
+	BytesDone  int64
+	BytesTotal int64
+	Workers    []WorkerStatus
+}
+
+// WorkerStart 记录工作协程开始同步一个文件或一批文件
+func (s *Stats) WorkerStart(worker int, filePath string, size int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.workers[worker] = &WorkerStatus{ID: worker, Path: filePath, Size: size}
+}
+
+// WorkerProgress 更新工作协程当前文件已发送的字节数
+func (s *Stats) WorkerProgress(worker int, offset int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if w, ok := s.workers[worker]; ok {
+		w.Offset = offset
+	}
+}
+
+// WorkerIdle 记录工作协程当前文件已结束
+func (s *Stats) WorkerIdle(worker int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.workers, worker)
+}
+
+func (s *Stats) Progress() *ProgressSnapshot {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	snap := &ProgressSnapshot{
+		FilesDone:  s.filesDone + s.filesFailed,
+		FilesTotal: s.filesTotal,
+		BytesDone:  s.bytesTransferred,
+		BytesTotal: s.bytesTotal,
+	}
+	for _, w := range s.workers {
+		snap.BytesDone += w.Offset
+		snap.Workers = append(snap.Workers, *w)
+	}
+	sort.Slice(snap.Workers, func(i, j int) bool {
+		return snap.Workers[i].ID < snap.Workers[j].ID
+	})
+	return snap
+}
+
+// IsTerminal 判断文件是否是终端
+func IsTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return info.Mode()&os.ModeCharDevice != 0
+}
+
+// StartProgress 开始显示同步进度，返回的函数用于停止显示。
+// 标准输出是终端时原地刷新进度，期间关闭日志的控制台输出；否则定期写一行进度日志
+func StartProgress(stats *Stats) func() {
+	tty := IsTerminal(os.Stdout)
+	interval := plainInterval
+	if tty {
+		interval = progressInterval
+		logger.Flush()
+		logger.SetConsole(false)
+	}
+	done := make(chan struct{})
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		p := &progressView{out: os.Stdout, last: time.Now()}
+		for {
+			select {
+			case <-done:
+				if tty {
+					p.draw(stats.Progress())
+				}
+				return
+			case <-ticker.C:
+				snap := stats.Progress()
+				if tty {
+					p.draw(snap)
+				} else {
+					p.update(snap)
+					logger.Info("%s", p.summary(snap))
+				}
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-finished
+		if tty {
+			logger.SetConsole(true)
+		}
+	}
+}
+
+type progressView struct {
+	out io.Writer
+	// 上次绘制的行数，重绘时先回到第一行
+	lines     int
+	last      time.Time
+	lastBytes int64
+	// 平滑后的当前速度，字节/秒
+	rate float64
+}
+
+// update 根据两次快照之间的字节数计算当前速度
+func (p *progressView) update(snap *ProgressSnapshot) {
+	now := time.Now()
+	elapsed := now.Sub(p.last).Seconds()
+	if elapsed <= 0 {
+		return
+	}
+	current := float64(snap.BytesDone-p.lastBytes) / elapsed
+	if p.lastBytes == 0 && p.rate == 0 {
+		p.rate = current
+	} else {
+		p.rate = 0.7*p.rate + 0.3*current
+	}
+	p.last = now
+	p.lastBytes = snap.BytesDone
+}
+
+func (p *progressView) summary(snap *ProgressSnapshot) string {
+	percent := 100.0
+	if snap.BytesTotal > 0 {
+		percent = float64(snap.BytesDone) * 100 / float64(snap.BytesTotal)
+	}
+	eta := "-"
+	if p.rate > 0 && snap.BytesDone < snap.BytesTotal {
+		eta = time.Duration(float64(snap.BytesTotal-snap.BytesDone) / p.rate * float64(time.Second)).Round(time.Second).String()
+	}
+	return fmt.Sprintf("files: %d/%d, bytes: %s/%s (%.1f%%), speed: %s/s, eta: %s",
+		snap.FilesDone, snap.FilesTotal, FormatBytes(snap.BytesDone), FormatBytes(snap.BytesTotal),
+		percent, FormatBytes(int64(p.rate)), eta)
+}
+
+func (p *progressView) draw(snap *ProgressSnapshot) {
+	p.update(snap)
+	var b strings.Builder
+	if p.lines > 0 {
+		// 光标上移到上次绘制的第一行并清除到屏幕末尾
+		fmt.Fprintf(&b, "\033[%dF\033[J", p.lines)
+	}
+	b.WriteString(p.summary(snap))
+	b.WriteString("\n")
+	for _, w := range snap.Workers {
+		percent := 100.0
+		if w.Size > 0 {
+			percent = float64(w.Offset) * 100 / float64(w.Size)
+		}
+		fmt.Fprintf(&b, "  [%d] %5.1f%% %s\n", w.ID, percent, shortPath(w.Path))
+	}
+	p.lines = 1 + len(snap.Workers)
+	io.WriteString(p.out, b.String())
+}
+
+// runeWidth 返回字符在终端中占用的列数，中日韩等全角字符占两列
+func runeWidth(r rune) int {
+	switch width.LookupRune(r).Kind() {
+	case width.EastAsianWide, width.EastAsianFullwidth:
+		return 2
+	}
+	return 1
+}
+
+// shortPath 按显示宽度截断过长的路径，保留末尾部分，不会切断多字节字符
+func shortPath(filePath string) string {
+	total := 0
+	for _, r := range filePath {
+		total += runeWidth(r)
+	}
+	if total <= maxProgressPath {
+		return filePath
+	}
+	// 从末尾向前保留字符，加上 "..." 不超过 maxProgressPath 列
+	runes := []rune(filePath)
+	w, i := 3, len(runes)
+	for i > 0 && w+runeWidth(runes[i-1]) <= maxProgressPath {
+		i--
+		w += runeWidth(runes[i])
+	}
+	return "..." + string(runes[i:])
+}
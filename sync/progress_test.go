@@ -0,0 +1,30 @@
+package sync
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestShortPath(t *testing.T) {
+	if got := shortPath("a/b.txt"); got != "a/b.txt" {
+		t.Fatalf("short path changed: %q", got)
+	}
+	ascii := strings.Repeat("a", 100)
+	if got := shortPath(ascii); len(got) != maxProgressPath || !strings.HasPrefix(got, "...") {
+		t.Fatalf("ascii: %q", got)
+	}
+	// 全角字符占两列，截断后仍是合法的 UTF-8，宽度不超过上限
+	cjk := "备份/" + strings.Repeat("中文目录/", 20) + "文件.txt"
+	got := shortPath(cjk)
+	if !utf8.ValidString(got) || !strings.HasSuffix(got, "文件.txt") {
+		t.Fatalf("cjk: %q", got)
+	}
+	w := 0
+	for _, r := range got {
+		w += runeWidth(r)
+	}
+	if w > maxProgressPath || w < maxProgressPath-1 {
+		t.Fatalf("cjk width %d: %q", w, got)
+	}
+}
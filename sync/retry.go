@@ -0,0 +1,55 @@
+package sync
+
+import (
+	"math/rand"
+	"time"
+
+	"stacktrace.top/filesync/config"
+)
+
+const (
+	defaultRetries         = 3
+	defaultRetryBackoff    = time.Second
+	defaultRetryMaxBackoff = time.Minute
+)
+
+// RetryPolicy 单个文件失败后的重试次数与指数退避
+type RetryPolicy struct {
+	// 首次失败后最多重试的次数
+	Retries    int
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+}
+
+// NewRetryPolicy 按配置生成重试策略，Retries 为负数时不重试
+func NewRetryPolicy(conf config.SyncConfig) RetryPolicy {
+	policy := RetryPolicy{
+		Retries:    conf.Retries,
+		Backoff:    time.Duration(conf.Retrybackoff) * time.Millisecond,
+		MaxBackoff: time.Duration(conf.Retrymaxbackoff) * time.Millisecond,
+	}
+	if policy.Retries == 0 {
+		policy.Retries = defaultRetries
+	} else if policy.Retries < 0 {
+		policy.Retries = 0
+	}
+	if policy.Backoff <= 0 {
+		policy.Backoff = defaultRetryBackoff
+	}
+	if policy.MaxBackoff <= 0 {
+		policy.MaxBackoff = defaultRetryMaxBackoff
+	}
+	return policy
+}
+
+// Delay 返回第 attempt 次重试前的等待时间，每次翻倍并加入最多 20% 的随机抖动
+func (p RetryPolicy) Delay(attempt int) time.Duration {
+	delay := p.Backoff
+	for i := 1; i < attempt && delay < p.MaxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > p.MaxBackoff {
+		delay = p.MaxBackoff
+	}
+	return delay + time.Duration(rand.Int63n(int64(delay)/5+1))
+}
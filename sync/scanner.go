@@ -0,0 +1,214 @@
+package sync
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	gosync "sync"
+
+	"stacktrace.top/filesync/config"
+	"stacktrace.top/filesync/logger"
+)
+
+// Scanner 持有一次同步使用的配置、排除规则以及源端和目标端的文件信息。
+// 不同的 Scanner 互不影响，可以在多个协程中各自使用
+type Scanner struct {
+	Config config.SyncConfig
+	// 源端和目标端的文件信息，键为相对路径
+	Src map[string]*SyncFileInfo
+	Dst map[string]*SyncFileInfo
+	// 排除的文件名、相对路径或完整路径，创建后只读
+	exclude map[string]bool
+	// 保护同步过程中对 Dst 的更新
+	mu gosync.Mutex
+}
+
+// NewScanner 按配置创建 Scanner，并读取 excludefrom 中的排除规则
+func NewScanner(conf config.SyncConfig) (*Scanner, error) {
+	s := &Scanner{
+		Config:  conf,
+		Src:     make(map[string]*SyncFileInfo),
+		Dst:     make(map[string]*SyncFileInfo),
+		exclude: make(map[string]bool),
+	}
+	if conf.Excludefrom == "" {
+		return s, nil
+	}
+	file, err := os.Open(conf.Excludefrom)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		path := filepath.Clean(scanner.Text())
+		logger.Debug("exclude path: %v", path)
+		s.exclude[path] = true
+	}
+	return s, scanner.Err()
+}
+
+// Exclude 添加一条排除规则，需在扫描之前调用
+func (s *Scanner) Exclude(path string) {
+	s.exclude[filepath.Clean(path)] = true
+}
+
+// Clone 返回共享配置和排除规则、文件信息为空的新 Scanner
+func (s *Scanner) Clone() *Scanner {
+	return &Scanner{
+		Config:  s.Config,
+		Src:     make(map[string]*SyncFileInfo),
+		Dst:     make(map[string]*SyncFileInfo),
+		exclude: s.exclude,
+	}
+}
+
+// Walk 遍历 fsys 中的目录，每个条目通过回调返回，调用方无需在内存中保留整棵目录树。
+// withHash 为 true 时同时计算文件内容的 SHA-256。无法访问的条目和计算哈希失败的文件记录日志后继续，
+// 返回值汇总这些错误，同步时可以忽略，校验时据此判定失败。回调返回错误时停止遍历并原样返回该错误
+func (s *Scanner) Walk(fsys FS, rootDir string, withHash bool, fn func(relPath string, info *SyncFileInfo) error) error {
+	rootDir = filepath.Clean(rootDir)
+	var firstErr, stopErr error
+	failures := 0
+	fail := func(err error) {
+		if firstErr == nil {
+			firstErr = err
+		}
+		failures++
+	}
+	visit := func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			logger.Error("visit for path: %v failed.err: %v", path, err)
+			fail(err)
+			return nil
+		}
+		relPath := strings.Replace(path, rootDir, "", 1)
+		if strings.IndexRune(relPath, os.PathSeparator) == 0 {
+			relPath = relPath[1:]
+		}
+
+		filepaths := strings.Split(relPath, string(os.PathSeparator))
+		for i := 0; i < len(filepaths); i++ {
+			if s.exclude[filepaths[i]] {
+				return nil
+			}
+		}
+
+		if path != rootDir && !s.exclude[info.Name()] && !s.exclude[relPath] && !s.exclude[path] {
+			fileInfo := newSyncFileInfo(info)
+			if withHash && info.Mode().IsRegular() {
+				hash, err := HashFileFS(fsys, path)
+				if err != nil {
+					logger.Error("hash file: %v failed.err: %v", path, err)
+					fail(err)
+				}
+				fileInfo.Hash = hash
+			}
+			if err := fn(relPath, fileInfo); err != nil {
+				stopErr = err
+				return filepath.SkipAll
+			}
+		}
+		return nil
+	}
+	// 使用filepath.Walk来递归遍历目录
+	err := fsys.Walk(rootDir, visit)
+	if stopErr != nil {
+		return stopErr
+	}
+	if err != nil {
+		logger.Error("fetchDir for path: %v failed.err: %v", rootDir, err)
+		fail(err)
+	}
+	if failures > 0 {
+		return fmt.Errorf("scan %v: %d errors, first: %w", rootDir, failures, firstErr)
+	}
+	return nil
+}
+
+// ScanDir 扫描目录并返回新的文件信息表
+func (s *Scanner) ScanDir(fsys FS, path string, withHash bool) map[string]*SyncFileInfo {
+	fileMap := make(map[string]*SyncFileInfo)
+	s.Walk(fsys, path, withHash, func(relPath string, info *SyncFileInfo) error {
+		fileMap[relPath] = info
+		return nil
+	})
+	return fileMap
+}
+
+// HashDir 扫描目录并计算文件哈希，用于校验，扫描中的任何错误都会返回
+func (s *Scanner) HashDir(fsys FS, path string) (map[string]*SyncFileInfo, error) {
+	fileMap := make(map[string]*SyncFileInfo)
+	err := s.Walk(fsys, path, true, func(relPath string, info *SyncFileInfo) error {
+		fileMap[relPath] = info
+		return nil
+	})
+	return fileMap, err
+}
+
+// MakeSrcInfo 扫描源目录并写入源缓存文件
+func (s *Scanner) MakeSrcInfo() {
+	s.Src = s.ScanDir(Local, s.Config.Srcpath, false)
+	saveCacheFile(s.Src, s.Config.Cachefile)
+}
+
+// MakeDstInfo 重新扫描目标目录并写入目标缓存文件，返回条目数
+func (s *Scanner) MakeDstInfo() int {
+	fileMap := s.ScanDir(Local, s.Config.Dstpath, false)
+	saveCacheFile(fileMap, s.Config.Dstcachefile)
+	return len(fileMap)
+}
+
+func (s *Scanner) LoadSrcCache() {
+	// 读取JSON文件
+	tempMap := loadCacheFile(s.Config.Cachefile)
+	if tempMap != nil {
+		for k, v := range tempMap {
+			s.Src[filepath.FromSlash(k)] = v
+		}
+	} else {
+		logger.Error("load cache file: %v failed.", s.Config.Cachefile)
+	}
+}
+
+func (s *Scanner) LoadDstCache() {
+	// 读取JSON文件
+	tempMap := loadCacheFile(s.Config.Dstcachefile)
+	if tempMap != nil {
+		for k, v := range tempMap {
+			s.Dst[filepath.FromSlash(k)] = v
+		}
+	} else {
+		logger.Error("load cache file: %v failed.", s.Config.Dstcachefile)
+	}
+}
+
+// SetDst 用 infos 替换目标端文件信息
+func (s *Scanner) SetDst(infos map[string]*SyncFileInfo) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Dst = make(map[string]*SyncFileInfo, len(infos))
+	for k, v := range infos {
+		s.Dst[k] = v
+	}
+}
+
+// setSynced 记录已同步到目标端的条目，可在同步协程中调用
+func (s *Scanner) setSynced(relPath string, info *SyncFileInfo) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Dst[relPath] = info
+}
+
+func (s *Scanner) Compare() map[string]*SyncFileInfo {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return CompareInfos(s.Src, s.Dst)
+}
+
+// RetryPolicy 按 Scanner 的配置生成重试策略
+func (s *Scanner) RetryPolicy() RetryPolicy {
+	return NewRetryPolicy(s.Config)
+}
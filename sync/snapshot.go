@@ -0,0 +1,201 @@
+package sync
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"stacktrace.top/filesync/config"
+	"stacktrace.top/filesync/logger"
+)
+
+// 快照目录名，按时间排序即按名称排序
+const SnapshotLayout = "2006-01-02_150405"
+
+// Snapshotter 由支持快照模式的 SyncOper 实现，目录都是目标端路径
+type Snapshotter interface {
+	// 列出 root 下的快照，返回按时间升序的名称
+	ListSnapshots(root string) ([]string, error)
+	// 扫描一个快照的文件信息
+	SnapshotInfo(dir string) (map[string]*SyncFileInfo, error)
+	// 创建 to 并把 from 中的条目硬链接过去，目录直接创建，返回失败的条目
+	LinkSnapshot(from string, to string, entries map[string]*SyncFileInfo) (map[string]error, error)
+	RemoveSnapshot(dir string) error
+}
+
+// IsSnapshotName 判断目录名是否是快照
+func IsSnapshotName(name string) bool {
+	_, err := time.ParseInLocation(SnapshotLayout, name, time.Local)
+	return err == nil
+}
+
+// ListSnapshotDirs 列出 root 下的快照目录
+func ListSnapshotDirs(fsys FS, root string) ([]string, error) {
+	entries, err := ReadDirFS(fsys, root)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, entry := range entries {
+		if entry.IsDir() && IsSnapshotName(entry.Name()) {
+			names = append(names, entry.Name())
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// LinkFiles 创建 to 并把 from 中的文件硬链接到相同位置，目录按源信息创建
+func LinkFiles(fsys FS, from string, to string, entries map[string]*SyncFileInfo) (map[string]error, error) {
+	if err := fsys.MkdirAll(to, 0755); err != nil {
+		return nil, err
+	}
+	failed := make(map[string]error)
+	for relPath, info := range entries {
+		dstPath := filepath.Join(to, relPath)
+		if info.IsDir {
+			if err := fsys.MkdirAll(dstPath, info.Mode.Perm()); err != nil {
+				failed[relPath] = err
+			}
+			continue
+		}
+		if err := fsys.MkdirAll(filepath.Dir(dstPath), os.ModePerm); err != nil {
+			failed[relPath] = err
+			continue
+		}
+		if err := fsys.Link(filepath.Join(from, relPath), dstPath); err != nil && !errors.Is(err, fs.ErrExist) {
+			failed[relPath] = err
+		}
+	}
+	return failed, nil
+}
+
+// RemoveSnapshotDir 删除一个快照，只允许删除快照命名的目录
+func RemoveSnapshotDir(fsys FS, dir string) error {
+	if !IsSnapshotName(filepath.Base(dir)) {
+		return fmt.Errorf("not a snapshot: %v", dir)
+	}
+	return RemoveAllFS(fsys, dir)
+}
+
+func (o *OsSyncOper) ListSnapshots(root string) ([]string, error) {
+	return ListSnapshotDirs(o.dst(), root)
+}
+
+func (o *OsSyncOper) SnapshotInfo(dir string) (map[string]*SyncFileInfo, error) {
+	return o.Scanner.ScanDir(o.dst(), dir, false), nil
+}
+
+func (o *OsSyncOper) LinkSnapshot(from string, to string, entries map[string]*SyncFileInfo) (map[string]error, error) {
+	return LinkFiles(o.dst(), from, to, entries)
+}
+
+func (o *OsSyncOper) RemoveSnapshot(dir string) error {
+	return RemoveSnapshotDir(o.dst(), dir)
+}
+
+func (o *FSSyncOper) ListSnapshots(root string) ([]string, error) {
+	return ListSnapshotDirs(o.Dst, root)
+}
+
+func (o *FSSyncOper) SnapshotInfo(dir string) (map[string]*SyncFileInfo, error) {
+	return o.Scanner.ScanDir(o.Dst, dir, false), nil
+}
+
+func (o *FSSyncOper) LinkSnapshot(from string, to string, entries map[string]*SyncFileInfo) (map[string]error, error) {
+	return LinkFiles(o.Dst, from, to, entries)
+}
+
+func (o *FSSyncOper) RemoveSnapshot(dir string) error {
+	return RemoveSnapshotDir(o.Dst, dir)
+}
+
+// LatestSnapshot 返回 root 下最新快照的目录，没有快照时返回错误
+func LatestSnapshot(s Snapshotter, root string) (string, error) {
+	names, err := s.ListSnapshots(root)
+	if err != nil {
+		return "", err
+	}
+	if len(names) == 0 {
+		return "", fmt.Errorf("no snapshot in %v", root)
+	}
+	return filepath.Join(root, names[len(names)-1]), nil
+}
+
+// PrepareSnapshot 在 root 下创建本次的快照：与上一个快照对比，未变化的条目硬链接过来，
+// 返回需要传输的文件。之后的同步写入新快照目录，已链接的文件只会被整体替换，不会修改上一个快照。
+// 中断的快照同样可以作为下一次的基础，缺少的文件会再次传输
+func PrepareSnapshot(s Snapshotter, scanner *Scanner, root string) (string, map[string]*SyncFileInfo, error) {
+	names, err := s.ListSnapshots(root)
+	if err != nil {
+		return "", nil, err
+	}
+	name := time.Now().Format(SnapshotLayout)
+	if len(names) > 0 && names[len(names)-1] >= name {
+		return "", nil, fmt.Errorf("snapshot %v already exists", names[len(names)-1])
+	}
+	dir := filepath.Join(root, name)
+	scanner.LoadSrcCache()
+	scanner.SetDst(nil)
+	if len(names) > 0 {
+		prevInfos, err := s.SnapshotInfo(filepath.Join(root, names[len(names)-1]))
+		if err != nil {
+			return "", nil, err
+		}
+		scanner.SetDst(prevInfos)
+		logger.Info("snapshot %v based on %v", name, names[len(names)-1])
+	} else {
+		logger.Info("first snapshot %v", name)
+	}
+	diffFiles := scanner.Compare()
+	unchanged := make(map[string]*SyncFileInfo)
+	for k, v := range scanner.Src {
+		if _, ok := diffFiles[k]; !ok {
+			unchanged[k] = v
+		}
+	}
+	// 第一次快照时没有可链接的条目，只创建目录
+	prev := ""
+	if len(names) > 0 {
+		prev = filepath.Join(root, names[len(names)-1])
+	}
+	failed, err := s.LinkSnapshot(prev, dir, unchanged)
+	if err != nil {
+		return "", nil, err
+	}
+	// 链接失败的文件改为传输
+	for k, e := range failed {
+		logger.Error("link %v failed, transfer it instead. err: %v", k, e)
+		diffFiles[k] = unchanged[k]
+	}
+	logger.Info("snapshot %v: %v entries linked, %v to transfer", name, len(unchanged)-len(failed), len(diffFiles))
+	return dir, diffFiles, nil
+}
+
+// PruneSnapshots 按 conf 的保留数量和天数删除旧快照，最新的快照总是保留
+func PruneSnapshots(s Snapshotter, root string, conf config.SnapshotConfig) ([]string, error) {
+	keep, days := conf.Keep, conf.Days
+	names, err := s.ListSnapshots(root)
+	if err != nil || (keep <= 0 && days <= 0) {
+		return nil, err
+	}
+	now := time.Now()
+	var removed []string
+	for i := 0; i < len(names)-1; i++ {
+		t, _ := time.ParseInLocation(SnapshotLayout, names[i], time.Local)
+		// names 按时间升序，从新到旧数第 len(names)-i 个
+		if (keep > 0 && len(names)-i > keep) || (days > 0 && now.Sub(t) > time.Duration(days)*24*time.Hour) {
+			if err := s.RemoveSnapshot(filepath.Join(root, names[i])); err != nil {
+				return removed, err
+			}
+			removed = append(removed, names[i])
+		}
+	}
+	return removed, nil
+}
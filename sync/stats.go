@@ -0,0 +1,257 @@
+package sync
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+var ErrChecksumMismatch = errors.New("checksum mismatch")
+
+// ErrRemoteFailed 表示目标端处理失败
+var ErrRemoteFailed = errors.New("remote failed")
+
+// 汇总中保留的最慢文件数量
+const slowestFiles = 10
+
+type FileTiming struct {
+	Path     string
+	Size     int64
+	Duration time.Duration
+}
+
+// Stats 记录一次同步的计数，多个工作协程并发更新
+type Stats struct {
+	mu               sync.Mutex
+	start            time.Time
+	end              time.Time
+	filesTotal       int64
+	bytesTotal       int64
+	filesDone        int64
+	filesFailed      int64
+	bytesTransferred int64
+	filesSkipped     int64
+	bytesSkipped     int64
+	retries          int64
+	errors           map[string]int64
+	// 重试后仍失败的文件及最后一次的错误
+	failures map[string]*FailedFile
+	slowest  []FileTiming
+	// 各工作协程正在同步的文件，用于进度显示
+	workers map[int]*WorkerStatus
+}
+
+// StatsReport 是 Stats 的快照，也是 JSON 报告的格式
+type StatsReport struct {
+	Start            time.Time
+	End              time.Time
+	Elapsed          string
+	FilesTotal       int64
+	BytesTotal       int64
+	FilesDone        int64
+	FilesFailed      int64
+	BytesTransferred int64
+	FilesSkipped     int64
+	BytesSkipped     int64
+	Retries          int64
+	// 平均吞吐，字节/秒
+	Throughput float64
+	Errors     map[string]int64
+	Failures   map[string]string `json:",omitempty"`
+	Slowest    []FileTiming
+}
+
+// NewStats 根据待同步文件和源目录全部文件统计计划量与跳过量
+func NewStats(diffFiles map[string]*SyncFileInfo, srcFiles map[string]*SyncFileInfo) *Stats {
+	s := &Stats{
+		start:    time.Now(),
+		errors:   make(map[string]int64),
+		failures: make(map[string]*FailedFile),
+		workers:  make(map[int]*WorkerStatus),
+	}
+	for _, info := range diffFiles {
+		s.filesTotal++
+		if !info.IsDir {
+			s.bytesTotal += info.Size
+		}
+	}
+	for filePath, info := range srcFiles {
+		if _, ok := diffFiles[filePath]; !ok {
+			s.filesSkipped++
+			if !info.IsDir {
+				s.bytesSkipped += info.Size
+			}
+		}
+	}
+	return s
+}
+
+// FileRetry 记录一次失败后的重试
+func (s *Stats) FileRetry() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.retries++
+}
+
+// FileDone 记录一个文件的最终同步结果，重试中的失败不调用
+func (s *Stats) FileDone(filePath string, info *SyncFileInfo, elapsed time.Duration, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err != nil {
+		s.filesFailed++
+		s.errors[ErrorKind(err)]++
+		s.failures[filePath] = &FailedFile{Info: info, Error: err.Error()}
+		return
+	}
+	s.filesDone++
+	if info.IsDir {
+		return
+	}
+	s.bytesTransferred += info.Size
+	// 维护按耗时降序的最慢文件列表
+	idx := sort.Search(len(s.slowest), func(i int) bool {
+		return s.slowest[i].Duration < elapsed
+	})
+	if idx < slowestFiles {
+		s.slowest = append(s.slowest, FileTiming{})
+		copy(s.slowest[idx+1:], s.slowest[idx:])
+		s.slowest[idx] = FileTiming{Path: filePath, Size: info.Size, Duration: elapsed}
+		if len(s.slowest) > slowestFiles {
+			s.slowest = s.slowest[:slowestFiles]
+		}
+	}
+}
+
+// Finish 记录结束时间
+func (s *Stats) Finish() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.end = time.Now()
+}
+
+func (s *Stats) Report() *StatsReport {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	end := s.end
+	if end.IsZero() {
+		end = time.Now()
+	}
+	elapsed := end.Sub(s.start)
+	report := &StatsReport{
+		Start:            s.start,
+		End:              end,
+		Elapsed:          elapsed.Round(time.Millisecond).String(),
+		FilesTotal:       s.filesTotal,
+		BytesTotal:       s.bytesTotal,
+		FilesDone:        s.filesDone,
+		FilesFailed:      s.filesFailed,
+		BytesTransferred: s.bytesTransferred,
+		FilesSkipped:     s.filesSkipped,
+		BytesSkipped:     s.bytesSkipped,
+		Retries:          s.retries,
+		Errors:           make(map[string]int64, len(s.errors)),
+		Failures:         make(map[string]string, len(s.failures)),
+		Slowest:          append([]FileTiming(nil), s.slowest...),
+	}
+	if elapsed > 0 {
+		report.Throughput = float64(s.bytesTransferred) / elapsed.Seconds()
+	}
+	for k, v := range s.errors {
+		report.Errors[k] = v
+	}
+	for k, v := range s.failures {
+		report.Failures[k] = v.Error
+	}
+	return report
+}
+
+func (r *StatsReport) Print(w io.Writer) {
+	fmt.Fprintf(w, "files: %d/%d synced, %d failed, %d unchanged\n", r.FilesDone, r.FilesTotal, r.FilesFailed, r.FilesSkipped)
+	fmt.Fprintf(w, "bytes: %s transferred, %s unchanged\n", FormatBytes(r.BytesTransferred), FormatBytes(r.BytesSkipped))
+	fmt.Fprintf(w, "elapsed: %s, throughput: %s/s, retries: %d\n", r.Elapsed, FormatBytes(int64(r.Throughput)), r.Retries)
+	if len(r.Errors) > 0 {
+		kinds := make([]string, 0, len(r.Errors))
+		for k := range r.Errors {
+			kinds = append(kinds, k)
+		}
+		sort.Strings(kinds)
+		for _, k := range kinds {
+			fmt.Fprintf(w, "errors: %s %d\n", k, r.Errors[k])
+		}
+	}
+	for _, t := range r.Slowest {
+		fmt.Fprintf(w, "slow: %s %s %s\n", t.Duration.Round(time.Millisecond), FormatBytes(t.Size), t.Path)
+	}
+}
+
+// WriteReport 把报告以 JSON 写入目录，文件名带时间戳
+func (r *StatsReport) WriteReport(dir string) (string, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	name := filepath.Join(dir, "filesync_report_"+r.Start.Format("20060102_150405")+".json")
+	return name, os.WriteFile(name, data, 0644)
+}
+
+// FailureManifest 返回重试后仍失败的文件清单，记录本次同步的源目录和目标目录
+func (s *Stats) FailureManifest(srcPath string, dstPath string) *FailureManifest {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m := &FailureManifest{
+		Time:    s.start,
+		Srcpath: srcPath,
+		Dstpath: dstPath,
+		Files:   make(map[string]*FailedFile, len(s.failures)),
+	}
+	for filePath, failed := range s.failures {
+		m.Files[filePath] = failed
+	}
+	return m
+}
+
+// ErrorKind 把错误归类，用于按类型统计
+func ErrorKind(err error) string {
+	var netErr net.Error
+	var pathErr *fs.PathError
+	switch {
+	case errors.Is(err, ErrChecksumMismatch):
+		return "checksum"
+	case errors.Is(err, fs.ErrNotExist):
+		return "not_exist"
+	case errors.Is(err, fs.ErrPermission):
+		return "permission"
+	case errors.As(err, &netErr), errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return "network"
+	case errors.As(err, &pathErr):
+		return "io"
+	case errors.Is(err, ErrRemoteFailed):
+		return "remote"
+	default:
+		return "other"
+	}
+}
+
+func FormatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
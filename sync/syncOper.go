@@ -1,75 +1,184 @@
-package sync
-
-import (
-	"os"
-	"path/filepath"
-	"sync"
-
-	"stacktrace.top/filesync/config"
-	"stacktrace.top/filesync/logger"
-)
-
-type SyncOper interface {
-	// 对比目录
-	CompareDiffFiles() (map[string]*SyncFileInfo, error)
-	// 同步文件
-	SyncFile(srcFilePath string, dstFilePath string, fileInfo *SyncFileInfo) error
-
-	SyncFiles(diffFiles map[string]*SyncFileInfo)
-}
-
-type OsSyncOper struct {
-}
-
-func (o *OsSyncOper) CompareDiffFiles() (map[string]*SyncFileInfo, error) {
-	LoadSrcCache()
-	loadDstCache()
-	return Compare(), nil
-}
-
-func (o *OsSyncOper) SyncFiles(diffFiles map[string]*SyncFileInfo) {
-	var wg sync.WaitGroup
-	for fp, fi := range diffFiles {
-		wg.Add(1)
-		go func(filePath string, fileInfo *SyncFileInfo) {
-			defer wg.Done()
-			logger.Info("sync file: %v", filePath)
-			srcFilePath := filepath.Join(config.InstanceConfig.Sync.Srcpath, filePath)
-			dstFilePath := filepath.Join(config.InstanceConfig.Sync.Dstpath, filePath)
-			err := o.SyncFile(srcFilePath, dstFilePath, fileInfo)
-			if err == nil {
-				DstSyncFileMap[filePath] = fileInfo
-			}
-		}(fp, fi)
-	}
-	wg.Wait()
-}
-
-func (o *OsSyncOper) SyncFile(srcFilePath string, dstFilePath string, fileInfo *SyncFileInfo) error {
-	if fileInfo.IsDir {
-		err := os.MkdirAll(dstFilePath, fileInfo.Mode)
-		if err != nil {
-			logger.Error("create dir: %v failed.err: %v", dstFilePath, err)
-			return err
-		}
-	} else {
-		data, err := os.ReadFile(srcFilePath)
-		if err != nil {
-			logger.Error("read file: %v failed.err: %v", srcFilePath, err)
-			return err
-		}
-		path := filepath.Dir(dstFilePath)
-		os.MkdirAll(path, os.ModePerm)
-		err = os.WriteFile(dstFilePath, data, fileInfo.Mode)
-		if err != nil {
-			logger.Error("write file: %v failed.err: %v", dstFilePath, err)
-			return err
-		}
-		err = os.Chtimes(dstFilePath, fileInfo.ModTime, fileInfo.ModTime)
-		if err != nil {
-			logger.Error("change file: %v time failed.err: %v", dstFilePath, err)
-			return err
-		}
-	}
-	return nil
-}
+package sync
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"time"
+
+	"stacktrace.top/filesync/logger"
+)
+
+type SyncOper interface {
+	// 对比目录
+	CompareDiffFiles() (map[string]*SyncFileInfo, error)
+	// 同步文件
+	SyncFile(srcFilePath string, dstFilePath string, fileInfo *SyncFileInfo) error
+
+	// 批量同步，结果记录到 stats
+	SyncFiles(diffFiles map[string]*SyncFileInfo, stats *Stats)
+}
+
+// OsSyncOper 按缓存文件对比，在本地目录之间同步
+type OsSyncOper struct {
+	Scanner *Scanner
+	// 写入目标目录使用的存储，为空时使用本地文件系统，需要备份旧版本时传入 WithBackup 的结果
+	Dst FS
+	// 并行同步的文件数，0 为 CPU 数
+	Workers int
+}
+
+func (o *OsSyncOper) dst() FS {
+	if o.Dst == nil {
+		return Local
+	}
+	return o.Dst
+}
+
+func (o *OsSyncOper) CompareDiffFiles() (map[string]*SyncFileInfo, error) {
+	o.Scanner.LoadSrcCache()
+	o.Scanner.LoadDstCache()
+	return o.Scanner.Compare(), nil
+}
+
+// SyncFiles 用 Workers 个协程同步，失败按重试策略重试
+func (o *OsSyncOper) SyncFiles(diffFiles map[string]*SyncFileInfo, stats *Stats) {
+	workers := o.Workers
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	o.Scanner.SyncParallel(diffFiles, stats, workers, func(filePath string, fileInfo *SyncFileInfo, progress func(offset int64)) error {
+		srcFilePath := filepath.Join(o.Scanner.Config.Srcpath, filePath)
+		dstFilePath := filepath.Join(o.Scanner.Config.Dstpath, filePath)
+		err := o.SyncFile(srcFilePath, dstFilePath, fileInfo)
+		if err == nil {
+			progress(fileInfo.Size)
+		}
+		return err
+	})
+}
+
+func (o *OsSyncOper) SyncFile(srcFilePath string, dstFilePath string, fileInfo *SyncFileInfo) error {
+	return ApplyFile(Local, srcFilePath, o.dst(), dstFilePath, fileInfo)
+}
+
+// FSSyncOper 在两个存储之间同步，直接扫描两端而不使用缓存文件
+type FSSyncOper struct {
+	Scanner *Scanner
+	Src     FS
+	SrcRoot string
+	Dst     FS
+	DstRoot string
+}
+
+func (o *FSSyncOper) CompareDiffFiles() (map[string]*SyncFileInfo, error) {
+	o.Scanner.Src = o.Scanner.ScanDir(o.Src, o.SrcRoot, false)
+	o.Scanner.SetDst(o.Scanner.ScanDir(o.Dst, o.DstRoot, false))
+	return o.Scanner.Compare(), nil
+}
+
+func (o *FSSyncOper) SyncFiles(diffFiles map[string]*SyncFileInfo, stats *Stats) {
+	o.Scanner.SyncParallel(diffFiles, stats, runtime.NumCPU(), func(filePath string, fileInfo *SyncFileInfo, progress func(offset int64)) error {
+		err := o.SyncFile(filepath.Join(o.SrcRoot, filePath), filepath.Join(o.DstRoot, filePath), fileInfo)
+		if err == nil {
+			progress(fileInfo.Size)
+		}
+		return err
+	})
+}
+
+func (o *FSSyncOper) SyncFile(srcFilePath string, dstFilePath string, fileInfo *SyncFileInfo) error {
+	return ApplyFile(o.Src, srcFilePath, o.Dst, dstFilePath, fileInfo)
+}
+
+// ApplyFile 把 src 中的一个条目复制到 dst，本地和内存等存储共用
+func ApplyFile(src FS, srcFilePath string, dst FS, dstFilePath string, fileInfo *SyncFileInfo) error {
+	var data []byte
+	if !fileInfo.IsDir {
+		file, err := src.Open(srcFilePath)
+		if err != nil {
+			logger.Error("read file: %v failed.err: %v", srcFilePath, err)
+			return err
+		}
+		data, err = io.ReadAll(file)
+		file.Close()
+		if err != nil {
+			logger.Error("read file: %v failed.err: %v", srcFilePath, err)
+			return err
+		}
+	}
+	return WriteEntry(dst, dstFilePath, fileInfo, data)
+}
+
+// WriteEntry 写入一个条目：目录直接创建，文件整体替换，最后设置修改时间
+func WriteEntry(dst FS, dstFilePath string, fileInfo *SyncFileInfo, data []byte) error {
+	if fileInfo.IsDir {
+		err := dst.MkdirAll(dstFilePath, fileInfo.Mode)
+		if err != nil {
+			logger.Error("create dir: %v failed.err: %v", dstFilePath, err)
+			return err
+		}
+	} else {
+		path := filepath.Dir(dstFilePath)
+		dst.MkdirAll(path, os.ModePerm)
+		// 整体替换而不是原地写入，备份的硬链接不会被修改
+		err := WriteFileAtomicFS(dst, dstFilePath, data, fileInfo.Mode)
+		if err != nil {
+			logger.Error("write file: %v failed.err: %v", dstFilePath, err)
+			return err
+		}
+	}
+	err := dst.Chtimes(dstFilePath, fileInfo.ModTime, fileInfo.ModTime)
+	if err != nil {
+		logger.Error("change file: %v time failed.err: %v", dstFilePath, err)
+		return err
+	}
+	return nil
+}
+
+// SyncParallel 用 workers 个协程同步文件，失败按重试策略重试，结果记录到 stats，成功的条目记入 Dst。
+// fn 通过 progress 报告当前文件已处理的字节数
+func (s *Scanner) SyncParallel(diffFiles map[string]*SyncFileInfo, stats *Stats, workers int, fn func(filePath string, fileInfo *SyncFileInfo, progress func(offset int64)) error) {
+	if workers <= 0 {
+		workers = 1
+	}
+	policy := s.RetryPolicy()
+	jobs := make(chan string)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			for filePath := range jobs {
+				fileInfo := diffFiles[filePath]
+				logger.Info("sync file: %v", filePath)
+				stats.WorkerStart(worker, filePath, fileInfo.Size)
+				progress := func(offset int64) {
+					stats.WorkerProgress(worker, offset)
+				}
+				start := time.Now()
+				err := fn(filePath, fileInfo, progress)
+				for attempt := 1; err != nil && attempt <= policy.Retries; attempt++ {
+					delay := policy.Delay(attempt)
+					logger.Error("sync file: %v failed, retry %v/%v in %v. err: %v", filePath, attempt, policy.Retries, delay, err)
+					stats.FileRetry()
+					time.Sleep(delay)
+					start = time.Now()
+					err = fn(filePath, fileInfo, progress)
+				}
+				stats.WorkerIdle(worker)
+				stats.FileDone(filePath, fileInfo, time.Since(start), err)
+				if err == nil {
+					s.setSynced(filePath, fileInfo)
+				}
+			}
+		}(i)
+	}
+	for filePath := range diffFiles {
+		jobs <- filePath
+	}
+	close(jobs)
+	wg.Wait()
+}
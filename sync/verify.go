@@ -0,0 +1,92 @@
+package sync
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"time"
+)
+
+// VerifyReport 记录源目录与目标目录按内容对比的结果
+type VerifyReport struct {
+	// 源目录有、目标目录没有
+	Missing []string
+	// 目标目录有、源目录没有
+	Extra []string
+	// 内容不同
+	Differ []string
+	// 内容相同，但修改时间或权限不同
+	MetaDiffer []string
+	// 缺少哈希、无法按内容对比的文件，通常是读取失败
+	Errors []string
+	// 双方一致的条目数
+	Same int
+}
+
+// Diverged 存在任何差异时返回 true
+func (r *VerifyReport) Diverged() bool {
+	return len(r.Missing) > 0 || len(r.Extra) > 0 || len(r.Differ) > 0 || len(r.MetaDiffer) > 0
+}
+
+// Failed 存在无法校验的文件时返回 true
+func (r *VerifyReport) Failed() bool {
+	return len(r.Errors) > 0
+}
+
+// VerifyTrees 对比两边带哈希的文件信息表
+func VerifyTrees(src map[string]*SyncFileInfo, dst map[string]*SyncFileInfo) *VerifyReport {
+	report := &VerifyReport{}
+	for filePath, srcInfo := range src {
+		dstInfo, ok := dst[filePath]
+		if !ok {
+			report.Missing = append(report.Missing, filePath)
+			continue
+		}
+		if srcInfo.IsDir != dstInfo.IsDir {
+			report.Differ = append(report.Differ, filePath)
+			continue
+		}
+		// 普通文件总有哈希，为空说明读取失败，不能当作一致
+		if srcInfo.Mode.IsRegular() && (srcInfo.Hash == "" || dstInfo.Hash == "") {
+			report.Errors = append(report.Errors, filePath)
+			continue
+		}
+		if !srcInfo.IsDir && (srcInfo.Size != dstInfo.Size || srcInfo.Hash != dstInfo.Hash) {
+			report.Differ = append(report.Differ, filePath)
+			continue
+		}
+		// 目录的修改时间会随子项写入改变，只比较权限；时间按秒比较以兼容不同文件系统的精度
+		if srcInfo.Mode.Perm() != dstInfo.Mode.Perm() ||
+			(!srcInfo.IsDir && !srcInfo.ModTime.Truncate(time.Second).Equal(dstInfo.ModTime.Truncate(time.Second))) {
+			report.MetaDiffer = append(report.MetaDiffer, filePath)
+			continue
+		}
+		report.Same++
+	}
+	for filePath := range dst {
+		if _, ok := src[filePath]; !ok {
+			report.Extra = append(report.Extra, filePath)
+		}
+	}
+	sort.Strings(report.Missing)
+	sort.Strings(report.Extra)
+	sort.Strings(report.Differ)
+	sort.Strings(report.MetaDiffer)
+	sort.Strings(report.Errors)
+	return report
+}
+
+func (r *VerifyReport) Print(w io.Writer) {
+	printList := func(title string, paths []string) {
+		for _, p := range paths {
+			fmt.Fprintf(w, "%s\t%s\n", title, p)
+		}
+	}
+	printList("missing", r.Missing)
+	printList("extra", r.Extra)
+	printList("differ", r.Differ)
+	printList("metadata", r.MetaDiffer)
+	printList("error", r.Errors)
+	fmt.Fprintf(w, "same: %d, missing: %d, extra: %d, differ: %d, metadata: %d, errors: %d\n",
+		r.Same, len(r.Missing), len(r.Extra), len(r.Differ), len(r.MetaDiffer), len(r.Errors))
+}
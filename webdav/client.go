@@ -0,0 +1,259 @@
+package webdav
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"stacktrace.top/filesync/sync"
+)
+
+// 自定义属性的命名空间，保存原始修改时间、权限和 SHA-256
+const propNS = "http://stacktrace.top/filesync"
+
+// Client 是最小的 WebDAV 客户端，路径都是相对 base 的 / 分隔路径
+type Client struct {
+	base       *url.URL
+	user       string
+	password   string
+	httpClient *http.Client
+}
+
+// Resource 是 PROPFIND 返回的一个条目
+type Resource struct {
+	// 相对 base 的路径
+	Path         string
+	IsDir        bool
+	Size         int64
+	LastModified time.Time
+	// 自定义属性，没有时为空
+	Props map[string]string
+}
+
+func NewClient(baseURL string, user string, password string, timeout time.Duration) (*Client, error) {
+	u, err := url.Parse(baseURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("invalid webdav url: %v", baseURL)
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/"
+	u.RawPath = ""
+	return &Client{base: u, user: user, password: password, httpClient: &http.Client{Timeout: timeout}}, nil
+}
+
+// resourceURL 返回资源地址，目录以 / 结尾
+func (c *Client) resourceURL(relPath string, isDir bool) string {
+	u := *c.base
+	u.Path = path.Join(c.base.Path, relPath)
+	if isDir && !strings.HasSuffix(u.Path, "/") {
+		u.Path += "/"
+	}
+	return u.String()
+}
+
+func (c *Client) do(method string, relPath string, isDir bool, header http.Header, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequest(method, c.resourceURL(relPath, isDir), body)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if c.user != "" {
+		req.SetBasicAuth(c.user, c.password)
+	}
+	return c.httpClient.Do(req)
+}
+
+// expect 检查应答码，不符合时读取应答内容作为错误信息
+func expect(resp *http.Response, method string, relPath string, codes ...int) error {
+	defer resp.Body.Close()
+	for _, code := range codes {
+		if resp.StatusCode == code {
+			io.Copy(io.Discard, resp.Body)
+			return nil
+		}
+	}
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	return fmt.Errorf("%w: %s %s: %s %s", sync.ErrRemoteFailed, method, relPath, resp.Status, strings.TrimSpace(string(data)))
+}
+
+type multistatus struct {
+	Responses []struct {
+		Href      string `xml:"DAV: href"`
+		Propstats []struct {
+			Status string `xml:"DAV: status"`
+			Prop   struct {
+				LastModified  string `xml:"DAV: getlastmodified"`
+				ContentLength string `xml:"DAV: getcontentlength"`
+				ResourceType  struct {
+					Collection *struct{} `xml:"DAV: collection"`
+				} `xml:"DAV: resourcetype"`
+				Custom []struct {
+					XMLName xml.Name
+					Value   string `xml:",chardata"`
+				} `xml:",any"`
+			} `xml:"DAV: prop"`
+		} `xml:"DAV: propstat"`
+	} `xml:"DAV: response"`
+}
+
+// ReadDir 用 Depth: 1 的 PROPFIND 列出目录，不含目录自身。目录不存在时返回 nil
+func (c *Client) ReadDir(relDir string, props []string) ([]*Resource, error) {
+	var body bytes.Buffer
+	body.WriteString(`<?xml version="1.0" encoding="utf-8"?><d:propfind xmlns:d="DAV:" xmlns:f="` + propNS + `"><d:prop>`)
+	body.WriteString(`<d:getlastmodified/><d:getcontentlength/><d:resourcetype/>`)
+	for _, name := range props {
+		body.WriteString("<f:" + name + "/>")
+	}
+	body.WriteString(`</d:prop></d:propfind>`)
+	header := http.Header{"Depth": {"1"}, "Content-Type": {"application/xml; charset=utf-8"}}
+	resp, err := c.do("PROPFIND", relDir, true, header, &body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return nil, nil
+	}
+	if resp.StatusCode != http.StatusMultiStatus {
+		return nil, expect(resp, "PROPFIND", relDir)
+	}
+	defer resp.Body.Close()
+	ms := &multistatus{}
+	if err := xml.NewDecoder(resp.Body).Decode(ms); err != nil {
+		return nil, fmt.Errorf("parse propfind of %v failed: %w", relDir, err)
+	}
+	dirPath := strings.TrimSuffix(path.Join(c.base.Path, relDir), "/")
+	var resources []*Resource
+	for _, r := range ms.Responses {
+		href, err := url.Parse(r.Href)
+		if err != nil {
+			return nil, fmt.Errorf("invalid href %v: %w", r.Href, err)
+		}
+		hrefPath := strings.TrimSuffix(href.Path, "/")
+		if hrefPath == dirPath || !strings.HasPrefix(hrefPath, dirPath+"/") {
+			continue
+		}
+		res := &Resource{
+			Path:  strings.TrimPrefix(path.Join(relDir, path.Base(hrefPath)), "/"),
+			Props: make(map[string]string),
+		}
+		for _, ps := range r.Propstats {
+			// 只使用成功的属性，不存在的自定义属性在 404 的 propstat 中
+			if !strings.Contains(ps.Status, " 200 ") {
+				continue
+			}
+			res.IsDir = ps.Prop.ResourceType.Collection != nil
+			res.Size, _ = strconv.ParseInt(ps.Prop.ContentLength, 10, 64)
+			res.LastModified, _ = http.ParseTime(ps.Prop.LastModified)
+			for _, custom := range ps.Prop.Custom {
+				if custom.XMLName.Space == propNS {
+					res.Props[custom.XMLName.Local] = custom.Value
+				}
+			}
+		}
+		resources = append(resources, res)
+	}
+	return resources, nil
+}
+
+// Mkcol 创建目录，已存在时返回 nil
+func (c *Client) Mkcol(relDir string) error {
+	resp, err := c.do("MKCOL", relDir, true, nil, nil)
+	if err != nil {
+		return err
+	}
+	// 405 表示已存在
+	return expect(resp, "MKCOL", relDir, http.StatusCreated, http.StatusMethodNotAllowed)
+}
+
+// Put 上传文件，X-OC-Mtime 让 Nextcloud/ownCloud 同时设置修改时间，其他服务器忽略
+func (c *Client) Put(relPath string, body io.Reader, size int64, mtime time.Time) error {
+	req, err := http.NewRequest(http.MethodPut, c.resourceURL(relPath, false), body)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	req.Header.Set("X-OC-Mtime", strconv.FormatInt(mtime.Unix(), 10))
+	if c.user != "" {
+		req.SetBasicAuth(c.user, c.password)
+	}
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	return expect(resp, "PUT", relPath, http.StatusOK, http.StatusCreated, http.StatusNoContent)
+}
+
+// Proppatch 设置自定义属性，服务器不支持时返回错误
+func (c *Client) Proppatch(relPath string, isDir bool, props map[string]string) error {
+	var body bytes.Buffer
+	body.WriteString(`<?xml version="1.0" encoding="utf-8"?><d:propertyupdate xmlns:d="DAV:" xmlns:f="` + propNS + `"><d:set><d:prop>`)
+	for name, value := range props {
+		body.WriteString("<f:" + name + ">")
+		xml.EscapeText(&body, []byte(value))
+		body.WriteString("</f:" + name + ">")
+	}
+	body.WriteString(`</d:prop></d:set></d:propertyupdate>`)
+	header := http.Header{"Content-Type": {"application/xml; charset=utf-8"}}
+	resp, err := c.do("PROPPATCH", relPath, isDir, header, &body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusMultiStatus {
+		return expect(resp, "PROPPATCH", relPath)
+	}
+	defer resp.Body.Close()
+	ms := &multistatus{}
+	if err := xml.NewDecoder(resp.Body).Decode(ms); err != nil {
+		return err
+	}
+	for _, r := range ms.Responses {
+		for _, ps := range r.Propstats {
+			if !strings.Contains(ps.Status, " 200 ") {
+				return fmt.Errorf("%w: PROPPATCH %s: %s", sync.ErrRemoteFailed, relPath, ps.Status)
+			}
+		}
+	}
+	return nil
+}
+
+// Move 改名，覆盖已存在的目标
+func (c *Client) Move(oldPath string, newPath string) error {
+	header := http.Header{"Destination": {c.resourceURL(newPath, false)}, "Overwrite": {"T"}}
+	resp, err := c.do("MOVE", oldPath, false, header, nil)
+	if err != nil {
+		return err
+	}
+	return expect(resp, "MOVE", oldPath, http.StatusCreated, http.StatusNoContent)
+}
+
+func (c *Client) Delete(relPath string) error {
+	resp, err := c.do(http.MethodDelete, relPath, false, nil, nil)
+	if err != nil {
+		return err
+	}
+	return expect(resp, "DELETE", relPath, http.StatusOK, http.StatusNoContent, http.StatusNotFound)
+}
+
+// Get 读取文件内容，调用方负责关闭
+func (c *Client) Get(relPath string) (io.ReadCloser, error) {
+	resp, err := c.do(http.MethodGet, relPath, false, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, expect(resp, "GET", relPath)
+	}
+	return resp.Body, nil
+}
@@ -0,0 +1,403 @@
+package webdav
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	gosync "sync"
+	"testing"
+	"time"
+)
+
+// 不支持自定义属性时 PROPPATCH 的应答方式
+const (
+	patchOK = iota
+	// 207 中的 propstat 为 403
+	patchForbidden
+	// 直接返回 405
+	patchNotAllowed
+)
+
+// fakeServer 是内存中的 WebDAV 服务器，只实现客户端用到的方法，路径为 /dav/ 下的 / 分隔路径
+type fakeServer struct {
+	t     *testing.T
+	mu    gosync.Mutex
+	dirs  map[string]bool
+	files map[string][]byte
+	mtime map[string]time.Time
+	props map[string]map[string]string
+	patch int
+	// 收到的请求，方法 + 空格 + 路径
+	requests []string
+	srv      *httptest.Server
+}
+
+func newFakeServer(t *testing.T) *fakeServer {
+	f := &fakeServer{
+		t:     t,
+		dirs:  map[string]bool{"": true},
+		files: make(map[string][]byte),
+		mtime: make(map[string]time.Time),
+		props: make(map[string]map[string]string),
+	}
+	f.srv = httptest.NewServer(f)
+	t.Cleanup(f.srv.Close)
+	return f
+}
+
+func (f *fakeServer) client(t *testing.T) *Client {
+	client, err := NewClient(f.srv.URL+"/dav", "user", "pass", 10*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client
+}
+
+func (f *fakeServer) methods(method string) []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var paths []string
+	for _, req := range f.requests {
+		if strings.HasPrefix(req, method+" ") {
+			paths = append(paths, req[len(method)+1:])
+		}
+	}
+	return paths
+}
+
+func (f *fakeServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if user, pass, ok := r.BasicAuth(); !ok || user != "user" || pass != "pass" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if !strings.HasPrefix(r.URL.Path, "/dav/") {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	p := strings.Trim(strings.TrimPrefix(r.URL.Path, "/dav/"), "/")
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.requests = append(f.requests, r.Method+" "+p)
+	switch r.Method {
+	case "PROPFIND":
+		f.propfind(w, r, p)
+	case "MKCOL":
+		switch {
+		case f.dirs[p] || f.files[p] != nil:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		case !f.dirs[parent(p)]:
+			w.WriteHeader(http.StatusConflict)
+		default:
+			f.dirs[p] = true
+			w.WriteHeader(http.StatusCreated)
+		}
+	case http.MethodPut:
+		if !f.dirs[parent(p)] {
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+		data, _ := io.ReadAll(r.Body)
+		f.files[p] = data
+		f.mtime[p] = time.Now()
+		if sec, err := strconv.ParseInt(r.Header.Get("X-OC-Mtime"), 10, 64); err == nil {
+			f.mtime[p] = time.Unix(sec, 0)
+		}
+		w.WriteHeader(http.StatusCreated)
+	case "PROPPATCH":
+		f.proppatch(w, r, p)
+	case "MOVE":
+		dst, err := url.Parse(r.Header.Get("Destination"))
+		if err != nil || f.files[p] == nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		to := strings.Trim(strings.TrimPrefix(dst.Path, "/dav/"), "/")
+		_, exists := f.files[to]
+		if exists && r.Header.Get("Overwrite") != "T" {
+			w.WriteHeader(http.StatusPreconditionFailed)
+			return
+		}
+		f.files[to], f.mtime[to], f.props[to] = f.files[p], f.mtime[p], f.props[p]
+		delete(f.files, p)
+		delete(f.mtime, p)
+		delete(f.props, p)
+		if exists {
+			w.WriteHeader(http.StatusNoContent)
+		} else {
+			w.WriteHeader(http.StatusCreated)
+		}
+	case http.MethodGet:
+		data, ok := f.files[p]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write(data)
+	case http.MethodDelete:
+		delete(f.files, p)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func parent(p string) string {
+	dir := path.Dir(p)
+	if dir == "." {
+		return ""
+	}
+	return dir
+}
+
+func (f *fakeServer) propfind(w http.ResponseWriter, r *http.Request, p string) {
+	if r.Header.Get("Depth") != "1" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if !f.dirs[p] {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	var children []string
+	for name := range f.dirs {
+		if name != "" && name != p && parent(name) == p {
+			children = append(children, name)
+		}
+	}
+	for name := range f.files {
+		if parent(name) == p {
+			children = append(children, name)
+		}
+	}
+	sort.Strings(children)
+	var b strings.Builder
+	b.WriteString(`<?xml version="1.0"?><d:multistatus xmlns:d="DAV:" xmlns:x="` + propNS + `">`)
+	f.writeResponse(&b, p)
+	for _, name := range children {
+		f.writeResponse(&b, name)
+	}
+	b.WriteString(`</d:multistatus>`)
+	w.WriteHeader(http.StatusMultiStatus)
+	io.WriteString(w, b.String())
+}
+
+func (f *fakeServer) writeResponse(b *strings.Builder, p string) {
+	href := (&url.URL{Path: path.Join("/dav", p)}).EscapedPath()
+	if f.dirs[p] {
+		href += "/"
+	}
+	fmt.Fprintf(b, `<d:response><d:href>%s</d:href><d:propstat><d:prop>`, href)
+	if f.dirs[p] {
+		b.WriteString(`<d:resourcetype><d:collection/></d:resourcetype>`)
+	} else {
+		fmt.Fprintf(b, `<d:resourcetype/><d:getcontentlength>%d</d:getcontentlength><d:getlastmodified>%s</d:getlastmodified>`,
+			len(f.files[p]), f.mtime[p].UTC().Format(http.TimeFormat))
+	}
+	var missing []string
+	for _, name := range allProps {
+		if value, ok := f.props[p][name]; ok {
+			fmt.Fprintf(b, `<x:%s>`, name)
+			xml.EscapeText(b, []byte(value))
+			fmt.Fprintf(b, `</x:%s>`, name)
+		} else {
+			missing = append(missing, name)
+		}
+	}
+	b.WriteString(`</d:prop><d:status>HTTP/1.1 200 OK</d:status></d:propstat>`)
+	if len(missing) > 0 {
+		b.WriteString(`<d:propstat><d:prop>`)
+		for _, name := range missing {
+			fmt.Fprintf(b, `<x:%s/>`, name)
+		}
+		b.WriteString(`</d:prop><d:status>HTTP/1.1 404 Not Found</d:status></d:propstat>`)
+	}
+	b.WriteString(`</d:response>`)
+}
+
+func (f *fakeServer) proppatch(w http.ResponseWriter, r *http.Request, p string) {
+	if f.patch == patchNotAllowed {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	var update struct {
+		Set struct {
+			Prop struct {
+				Any []struct {
+					XMLName xml.Name
+					Value   string `xml:",chardata"`
+				} `xml:",any"`
+			} `xml:"DAV: prop"`
+		} `xml:"DAV: set"`
+	}
+	if err := xml.NewDecoder(r.Body).Decode(&update); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	status := "HTTP/1.1 200 OK"
+	if f.patch == patchForbidden {
+		status = "HTTP/1.1 403 Forbidden"
+	} else {
+		if f.props[p] == nil {
+			f.props[p] = make(map[string]string)
+		}
+		for _, prop := range update.Set.Prop.Any {
+			if prop.XMLName.Space != propNS {
+				f.t.Errorf("proppatch namespace %q", prop.XMLName.Space)
+			}
+			f.props[p][prop.XMLName.Local] = prop.Value
+		}
+	}
+	w.WriteHeader(http.StatusMultiStatus)
+	fmt.Fprintf(w, `<?xml version="1.0"?><d:multistatus xmlns:d="DAV:"><d:response><d:href>/dav/%s</d:href>`+
+		`<d:propstat><d:prop/><d:status>%s</d:status></d:propstat></d:response></d:multistatus>`, p, status)
+}
+
+func TestReadDirParse(t *testing.T) {
+	// 固定的应答，包含目录自身、转义的文件名、子目录和 404 的自定义属性
+	const body = `<?xml version="1.0" encoding="utf-8"?>
+<d:multistatus xmlns:d="DAV:" xmlns:x="http://stacktrace.top/filesync" xmlns:o="http://owncloud.org/ns">
+ <d:response><d:href>/dav/dir/</d:href>
+  <d:propstat><d:prop><d:resourcetype><d:collection/></d:resourcetype></d:prop><d:status>HTTP/1.1 200 OK</d:status></d:propstat>
+ </d:response>
+ <d:response><d:href>/dav/dir/a%20b.txt</d:href>
+  <d:propstat><d:prop>
+   <d:getlastmodified>Wed, 01 Jan 2020 10:00:00 GMT</d:getlastmodified>
+   <d:getcontentlength>12</d:getcontentlength>
+   <d:resourcetype/>
+   <x:mtime>2020-01-01T10:00:00.123456789Z</x:mtime>
+   <x:mode>644</x:mode>
+   <o:id>1</o:id>
+  </d:prop><d:status>HTTP/1.1 200 OK</d:status></d:propstat>
+  <d:propstat><d:prop><x:sha256/></d:prop><d:status>HTTP/1.1 404 Not Found</d:status></d:propstat>
+ </d:response>
+ <d:response><d:href>http://other.example/dav/dir/sub/</d:href>
+  <d:propstat><d:prop><d:resourcetype><d:collection/></d:resourcetype></d:prop><d:status>HTTP/1.1 200 OK</d:status></d:propstat>
+ </d:response>
+ <d:response><d:href>/elsewhere/x</d:href>
+  <d:propstat><d:prop><d:resourcetype/></d:prop><d:status>HTTP/1.1 200 OK</d:status></d:propstat>
+ </d:response>
+</d:multistatus>`
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "PROPFIND" || r.Header.Get("Depth") != "1" {
+			t.Errorf("request %v depth %q", r.Method, r.Header.Get("Depth"))
+		}
+		switch r.URL.Path {
+		case "/dav/dir/":
+			data, _ := io.ReadAll(r.Body)
+			if !strings.Contains(string(data), "<f:sha256/>") {
+				t.Errorf("propfind body %s", data)
+			}
+			w.WriteHeader(http.StatusMultiStatus)
+			io.WriteString(w, body)
+		case "/dav/missing/":
+			w.WriteHeader(http.StatusNotFound)
+		default:
+			w.WriteHeader(http.StatusForbidden)
+		}
+	}))
+	defer srv.Close()
+	client, err := NewClient(srv.URL+"/dav/", "", "", 10*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resources, err := client.ReadDir("dir", allProps)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resources) != 2 {
+		t.Fatalf("resources: %d", len(resources))
+	}
+	file, dir := resources[0], resources[1]
+	if file.Path != "dir/a b.txt" || file.IsDir || file.Size != 12 {
+		t.Fatalf("file: %+v", file)
+	}
+	if !file.LastModified.Equal(time.Date(2020, 1, 1, 10, 0, 0, 0, time.UTC)) {
+		t.Fatalf("last modified %v", file.LastModified)
+	}
+	if len(file.Props) != 2 || file.Props[propMtime] != "2020-01-01T10:00:00.123456789Z" || file.Props[propMode] != "644" {
+		t.Fatalf("props: %v", file.Props)
+	}
+	if dir.Path != "dir/sub" || !dir.IsDir {
+		t.Fatalf("dir: %+v", dir)
+	}
+	if resources, err := client.ReadDir("missing", nil); err != nil || resources != nil {
+		t.Fatalf("missing dir: %v %v", resources, err)
+	}
+	if _, err := client.ReadDir("other", nil); err == nil {
+		t.Fatal("403 should fail")
+	}
+}
+
+func TestMkcol(t *testing.T) {
+	f := newFakeServer(t)
+	client := f.client(t)
+	if err := client.Mkcol("a"); err != nil {
+		t.Fatal(err)
+	}
+	// 已存在的目录返回 405，视为成功
+	if err := client.Mkcol("a"); err != nil {
+		t.Fatalf("existing dir: %v", err)
+	}
+	// 父目录不存在返回 409
+	if err := client.Mkcol("x/y"); err == nil {
+		t.Fatal("mkcol without parent should fail")
+	}
+	if got := f.methods("MKCOL"); strings.Join(got, ",") != "a,a,x/y" {
+		t.Fatalf("mkcol requests: %v", got)
+	}
+}
+
+func TestMoveOverwrite(t *testing.T) {
+	f := newFakeServer(t)
+	client := f.client(t)
+	for name, data := range map[string]string{"a.tmp": "new", "a": "old"} {
+		if err := client.Put(name, strings.NewReader(data), int64(len(data)), time.Now()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := client.Move("a.tmp", "a"); err != nil {
+		t.Fatal(err)
+	}
+	body, err := client.Get("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := io.ReadAll(body)
+	body.Close()
+	if string(data) != "new" {
+		t.Fatalf("moved content %q", data)
+	}
+	if _, err := client.Get("a.tmp"); err == nil {
+		t.Fatal("source still exists")
+	}
+	if err := client.Move("missing", "a"); err == nil {
+		t.Fatal("move missing source should fail")
+	}
+}
+
+func TestProppatch(t *testing.T) {
+	f := newFakeServer(t)
+	client := f.client(t)
+	client.Put("f", strings.NewReader(""), 0, time.Now())
+	if err := client.Proppatch("f", false, map[string]string{propMode: "644", propSHA256: "<&>"}); err != nil {
+		t.Fatal(err)
+	}
+	if f.props["f"][propSHA256] != "<&>" || f.props["f"][propMode] != "644" {
+		t.Fatalf("props: %v", f.props["f"])
+	}
+	f.patch = patchForbidden
+	if err := client.Proppatch("f", false, map[string]string{propMode: "600"}); err == nil {
+		t.Fatal("403 propstat should fail")
+	}
+	f.patch = patchNotAllowed
+	if err := client.Proppatch("f", false, map[string]string{propMode: "600"}); err == nil {
+		t.Fatal("405 should fail")
+	}
+}
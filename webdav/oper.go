@@ -0,0 +1,237 @@
+package webdav
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"stacktrace.top/filesync/config"
+	"stacktrace.top/filesync/logger"
+	"stacktrace.top/filesync/sync"
+)
+
+const (
+	defaultThreads = 4
+	// 上传中的临时文件，完成后改名
+	tmpSuffix = ".fstmp"
+)
+
+// 自定义属性名称
+const (
+	propMtime  = "mtime"
+	propMode   = "mode"
+	propSHA256 = "sha256"
+)
+
+var allProps = []string{propMtime, propMode, propSHA256}
+
+// WebDAVSyncOper 同步到 WebDAV 目录，如 Nextcloud 的 remote.php/dav/files/<user>/<dir>
+type WebDAVSyncOper struct {
+	scanner *sync.Scanner
+	client  *Client
+	// 服务器不支持 PROPPATCH 时置 1，之后不再尝试
+	noProps int32
+	// 并行上传的文件数
+	threads int
+}
+
+// NewWebDAVSyncOper 按 cfg 连接 WebDAV 目录，并行上传数量使用 client 的 threads
+func NewWebDAVSyncOper(scanner *sync.Scanner, cfg config.WebdavConfig, client config.ClientConfig) (*WebDAVSyncOper, error) {
+	davClient, err := NewClient(cfg.Url, cfg.User, cfg.Password, 10*time.Minute)
+	if err != nil {
+		return nil, err
+	}
+	return &WebDAVSyncOper{scanner: scanner, client: davClient, threads: client.Threads}, nil
+}
+
+// FileInfos 逐级 PROPFIND 构造目标端文件信息。有自定义属性时使用其中的原始修改时间和权限，
+// 否则修改时间为服务器记录的时间
+func (o *WebDAVSyncOper) FileInfos() (map[string]*sync.SyncFileInfo, error) {
+	infos := make(map[string]*sync.SyncFileInfo)
+	dirs := []string{""}
+	for len(dirs) > 0 {
+		dir := dirs[0]
+		dirs = dirs[1:]
+		resources, err := o.client.ReadDir(dir, allProps)
+		if err != nil {
+			return nil, err
+		}
+		for _, res := range resources {
+			if strings.HasSuffix(res.Path, tmpSuffix) {
+				continue
+			}
+			info := &sync.SyncFileInfo{
+				Name:    path.Base(res.Path),
+				Size:    res.Size,
+				ModTime: res.LastModified,
+				Mode:    0644,
+				IsDir:   res.IsDir,
+				Hash:    res.Props[propSHA256],
+			}
+			if res.IsDir {
+				info.Size = 0
+				info.Mode = os.ModeDir | 0755
+				dirs = append(dirs, res.Path)
+			}
+			if t, err := time.Parse(time.RFC3339Nano, res.Props[propMtime]); err == nil {
+				info.ModTime = t
+			}
+			if mode, err := strconv.ParseUint(res.Props[propMode], 8, 32); err == nil {
+				info.Mode = os.FileMode(mode)
+			}
+			infos[filepath.FromSlash(res.Path)] = info
+		}
+	}
+	return infos, nil
+}
+
+// DstFileInfos 返回带 SHA-256 的文件信息，用于校验。哈希由下载的内容计算，不使用上传时保存的哈希属性
+func (o *WebDAVSyncOper) DstFileInfos() (map[string]*sync.SyncFileInfo, error) {
+	infos, err := o.FileInfos()
+	if err != nil {
+		return nil, err
+	}
+	for relPath, info := range infos {
+		if info.IsDir {
+			continue
+		}
+		body, err := o.client.Get(filepath.ToSlash(relPath))
+		if err != nil {
+			return nil, err
+		}
+		hasher := sha256.New()
+		_, err = io.Copy(hasher, body)
+		body.Close()
+		if err != nil {
+			return nil, err
+		}
+		info.Hash = hex.EncodeToString(hasher.Sum(nil))
+	}
+	return infos, nil
+}
+
+func (o *WebDAVSyncOper) CompareDiffFiles() (map[string]*sync.SyncFileInfo, error) {
+	o.scanner.LoadSrcCache()
+	infos, err := o.FileInfos()
+	if err != nil {
+		return nil, err
+	}
+	srcFiles := o.scanner.Src
+	for k, v := range infos {
+		// getlastmodified 只有秒级时间，同一秒内视为相同
+		if src, ok := srcFiles[k]; ok && src.ModTime.Truncate(time.Second).Equal(v.ModTime) {
+			v.ModTime = src.ModTime
+		}
+	}
+	o.scanner.SetDst(infos)
+	return o.scanner.Compare(), nil
+}
+
+func (o *WebDAVSyncOper) SyncFiles(diffFiles map[string]*sync.SyncFileInfo, stats *sync.Stats) {
+	threads := o.threads
+	if threads <= 0 {
+		threads = defaultThreads
+	}
+	o.scanner.SyncParallel(diffFiles, stats, threads, o.upload)
+}
+
+func (o *WebDAVSyncOper) SyncFile(srcFilePath string, dstFilePath string, fileInfo *sync.SyncFileInfo) error {
+	relPath, err := filepath.Rel(o.scanner.Config.Srcpath, srcFilePath)
+	if err != nil {
+		return err
+	}
+	return o.upload(relPath, fileInfo, nil)
+}
+
+// mkdirAll 逐级创建目录
+func (o *WebDAVSyncOper) mkdirAll(dir string) error {
+	if dir == "" || dir == "." {
+		return nil
+	}
+	if err := o.mkdirAll(path.Dir(dir)); err != nil {
+		return err
+	}
+	return o.client.Mkcol(dir)
+}
+
+// setProps 保存修改时间、权限和哈希，服务器不支持时只记录一次日志
+func (o *WebDAVSyncOper) setProps(relPath string, fileInfo *sync.SyncFileInfo, hash string) {
+	if atomic.LoadInt32(&o.noProps) == 1 {
+		return
+	}
+	props := map[string]string{
+		propMtime: fileInfo.ModTime.UTC().Format(time.RFC3339Nano),
+		propMode:  strconv.FormatUint(uint64(fileInfo.Mode), 8),
+	}
+	if hash != "" {
+		props[propSHA256] = hash
+	}
+	if err := o.client.Proppatch(relPath, fileInfo.IsDir, props); err != nil {
+		if atomic.CompareAndSwapInt32(&o.noProps, 0, 1) {
+			logger.Info("webdav server does not support custom properties, mtime is kept only via X-OC-Mtime. err: %v", err)
+		}
+	}
+}
+
+// upload 上传到临时文件并设置属性，再改名为目标文件
+func (o *WebDAVSyncOper) upload(relPath string, fileInfo *sync.SyncFileInfo, progress func(offset int64)) error {
+	dstPath := filepath.ToSlash(relPath)
+	if fileInfo.IsDir {
+		if err := o.mkdirAll(dstPath); err != nil {
+			logger.Error("create dir: %v failed.err: %v", dstPath, err)
+			return err
+		}
+		o.setProps(dstPath, fileInfo, "")
+		return nil
+	}
+	srcFilePath := filepath.Join(o.scanner.Config.Srcpath, relPath)
+	file, err := os.Open(srcFilePath)
+	if err != nil {
+		logger.Error("open file: %v failed.err: %v", srcFilePath, err)
+		return err
+	}
+	defer file.Close()
+	if err := o.mkdirAll(path.Dir(dstPath)); err != nil {
+		logger.Error("create dir: %v failed.err: %v", path.Dir(dstPath), err)
+		return err
+	}
+	hasher := sha256.New()
+	reader := &progressReader{r: io.TeeReader(file, hasher), progress: progress}
+	tmpPath := dstPath + tmpSuffix
+	err = o.client.Put(tmpPath, reader, fileInfo.Size, fileInfo.ModTime)
+	if err == nil && reader.offset != fileInfo.Size {
+		err = os.ErrInvalid
+	}
+	if err == nil {
+		o.setProps(tmpPath, fileInfo, hex.EncodeToString(hasher.Sum(nil)))
+		err = o.client.Move(tmpPath, dstPath)
+	}
+	if err != nil {
+		logger.Error("upload file: %v failed.err: %v", dstPath, err)
+		o.client.Delete(tmpPath)
+		return err
+	}
+	return nil
+}
+
+type progressReader struct {
+	r        io.Reader
+	offset   int64
+	progress func(offset int64)
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	p.offset += int64(n)
+	if p.progress != nil && n > 0 {
+		p.progress(p.offset)
+	}
+	return n, err
+}
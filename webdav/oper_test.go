@@ -0,0 +1,114 @@
+package webdav
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"stacktrace.top/filesync/config"
+	"stacktrace.top/filesync/sync"
+)
+
+// newTestOper 在临时目录中创建源文件，返回同步到 f 的 WebDAVSyncOper
+func newTestOper(t *testing.T, f *fakeServer, files map[string]string) *WebDAVSyncOper {
+	src := t.TempDir()
+	mtime := time.Date(2021, 2, 3, 4, 5, 6, 789000000, time.UTC)
+	for name, data := range files {
+		p := filepath.Join(src, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(data), 0600); err != nil {
+			t.Fatal(err)
+		}
+		os.Chtimes(p, mtime, mtime)
+	}
+	scanner, err := sync.NewScanner(config.SyncConfig{Srcpath: src, Retries: -1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	scanner.Src = scanner.ScanDir(sync.Local, src, false)
+	return &WebDAVSyncOper{scanner: scanner, client: f.client(t), threads: 2}
+}
+
+func syncAll(t *testing.T, o *WebDAVSyncOper) *sync.StatsReport {
+	diff := o.scanner.Compare()
+	stats := sync.NewStats(diff, o.scanner.Src)
+	o.SyncFiles(diff, stats)
+	stats.Finish()
+	return stats.Report()
+}
+
+func TestSyncFiles(t *testing.T) {
+	f := newFakeServer(t)
+	o := newTestOper(t, f, map[string]string{"a": "aaa", "d/e/b": "bb"})
+	if report := syncAll(t, o); report.FilesFailed != 0 || report.FilesDone != 4 {
+		t.Fatalf("report: %+v", report)
+	}
+	if string(f.files["d/e/b"]) != "bb" || f.files["a.fstmp"] != nil {
+		t.Fatalf("files: %v", f.files)
+	}
+	infos, err := o.FileInfos()
+	if err != nil {
+		t.Fatal(err)
+	}
+	src := o.scanner.Src["a"]
+	got := infos["a"]
+	if got == nil || !got.ModTime.Equal(src.ModTime) || got.Mode != src.Mode || got.Size != 3 {
+		t.Fatalf("info: %+v, want %+v", got, src)
+	}
+	if dir := infos[filepath.Join("d", "e")]; dir == nil || !dir.IsDir {
+		t.Fatalf("dir info: %+v", dir)
+	}
+	// 再次比较时没有需要同步的文件
+	diff, err := o.CompareDiffFiles()
+	if err != nil || len(diff) != 0 {
+		t.Fatalf("diff after sync: %v %v", diff, err)
+	}
+}
+
+func TestSyncWithoutProppatch(t *testing.T) {
+	f := newFakeServer(t)
+	f.patch = patchNotAllowed
+	o := newTestOper(t, f, map[string]string{"a": "1", "b": "2", "c": "3"})
+	if report := syncAll(t, o); report.FilesFailed != 0 || report.FilesDone != 3 {
+		t.Fatalf("report: %+v", report)
+	}
+	// 第一次失败后不再尝试 PROPPATCH
+	if n := len(f.methods("PROPPATCH")); n < 1 || n > o.threads {
+		t.Fatalf("proppatch requests: %d", n)
+	}
+	// 没有自定义属性时修改时间来自 X-OC-Mtime，只有秒级
+	infos, err := o.FileInfos()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := o.scanner.Src["a"].ModTime.Truncate(time.Second); !infos["a"].ModTime.Equal(want) {
+		t.Fatalf("mtime %v, want %v", infos["a"].ModTime, want)
+	}
+}
+
+func TestDstFileInfosHashesContent(t *testing.T) {
+	f := newFakeServer(t)
+	o := newTestOper(t, f, map[string]string{"a": "good"})
+	syncAll(t, o)
+	sum := sha256.Sum256([]byte("good"))
+	if f.props["a"][propSHA256] != hex.EncodeToString(sum[:]) {
+		t.Fatalf("stored hash %v", f.props["a"][propSHA256])
+	}
+	// 服务器上的内容被修改，保存的哈希属性不变
+	f.mu.Lock()
+	f.files["a"] = []byte("evil")
+	f.mu.Unlock()
+	infos, err := o.DstFileInfos()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum = sha256.Sum256([]byte("evil"))
+	if infos["a"].Hash != hex.EncodeToString(sum[:]) {
+		t.Fatalf("hash %v should be computed from content", infos["a"].Hash)
+	}
+}